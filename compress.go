@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/contentcoding"
+)
+
+// CompressionConfig is the configuration for compressing responses at the proxy.
+//
+// Responses are compressed only if the client accepts one of the encodings,
+// the upstream did not encode them, and Cache-Control has no no-transform.
+type CompressionConfig struct {
+	// Encodings are the encodings the proxy may use, in preference order.
+	//	Default is br, zstd, gzip.
+	Encodings []string
+	// MinSize is the minimum Content-Length to compress, negative means every size,
+	//	responses without Content-Length, like streams, are always compressed.
+	//	Default is 0, which means 1024.
+	MinSize int64
+	// ContentTypes are the media types to compress, type/* matches all the subtypes.
+	//	Default is DefaultCompressionContentTypes.
+	ContentTypes []string
+}
+
+// DefaultCompressionContentTypes are the media types compressed by default.
+var DefaultCompressionContentTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/x-javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/x-ndjson",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+func (c *CompressionConfig) encodings() []string {
+	if len(c.Encodings) != 0 {
+		return c.Encodings
+	}
+
+	return []string{"br", "zstd", "gzip"}
+}
+
+func (c *CompressionConfig) minSize() int64 {
+	if c.MinSize == 0 {
+		return 1024
+	}
+
+	if c.MinSize < 0 {
+		return 0
+	}
+
+	return c.MinSize
+}
+
+func (c *CompressionConfig) isCompressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	contentTypes := c.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = DefaultCompressionContentTypes
+	}
+
+	for _, ct := range contentTypes {
+		if ct == mediaType {
+			return true
+		}
+
+		if strings.HasSuffix(ct, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(ct, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compressResponse returns the encoding to compress the response with, empty means no compression.
+//
+//	The response headers are updated for the encoding.
+func (r *Proxy) compressResponse(res *http.Response, inReq *http.Request) string {
+	if r.compression == nil {
+		return ""
+	}
+
+	if inReq.Method == http.MethodHead || !hasResponseBody(res) || res.StatusCode == http.StatusPartialContent {
+		return ""
+	}
+
+	if !contentcoding.IsIdentity(res.Header.Get(headers.ContentEncoding)) {
+		return ""
+	}
+
+	if strings.Contains(strings.ToLower(res.Header.Get(headers.CacheControl)), "no-transform") {
+		return ""
+	}
+
+	if res.ContentLength != -1 && res.ContentLength < r.compression.minSize() {
+		return ""
+	}
+
+	// gRPC has its own message compression
+	if isGRPCContentType(res.Header.Get(headers.ContentType)) {
+		return ""
+	}
+
+	if !r.compression.isCompressible(res.Header.Get(headers.ContentType)) {
+		return ""
+	}
+
+	encoding := negotiateEncoding(inReq.Header.Get(headers.AcceptEncoding), r.compression.encodings())
+	if encoding == "" {
+		return ""
+	}
+
+	res.Header.Set(headers.ContentEncoding, encoding)
+	res.Header.Del(headers.ContentLength)
+	res.Header.Del(headers.AcceptRanges)
+	addVary(res.Header, headers.AcceptEncoding)
+	res.ContentLength = -1
+
+	// the representation changed, so a strong validator is no longer valid
+	if etag := res.Header.Get(headers.ETag); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.Header.Set(headers.ETag, "W/"+etag)
+	}
+
+	return encoding
+}
+
+// addVary adds name to the Vary header, unless it is already listed or Vary is *.
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values(headers.Vary) {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+
+	h.Add(headers.Vary, name)
+}
+
+// negotiateEncoding returns the encoding with the highest q accepted by the client,
+// ties are broken by the order of encodings.
+func negotiateEncoding(acceptEncoding string, encodings []string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = v
+			}
+		}
+
+		accepted[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		if !contentcoding.IsSupported(encoding) {
+			continue
+		}
+
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+
+	return best
+}
+
+// compressWriter compresses the response body, Flush flushes the encoder
+// and the ResponseWriter, so streams like SSE are still flushed per event.
+type compressWriter struct {
+	rw      http.ResponseWriter
+	encoder contentcoding.Writer
+	closed  bool
+}
+
+func newCompressWriter(rw http.ResponseWriter, encoding string) (*compressWriter, error) {
+	encoder, err := contentcoding.NewWriter(rw, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressWriter{rw: rw, encoder: encoder}, nil
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	return c.encoder.Write(p)
+}
+
+func (c *compressWriter) Flush() {
+	if err := c.encoder.Flush(); err != nil {
+		return
+	}
+
+	http.NewResponseController(c.rw).Flush()
+}
+
+// Close closes the encoder, once.
+func (c *compressWriter) Close() error {
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+	return c.encoder.Close()
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/rewriter"
+)
+
+// CookieRewrite rewrites every Set-Cookie header of the response,
+// like nginx proxy_cookie_domain and proxy_cookie_path.
+type CookieRewrite struct {
+	// Domain rewrites the Domain attribute, rewriting to empty removes it.
+	//	Example: { From: "^(\\.)?github\\.com$", To: "" }
+	Domain rewriter.Rewriters `json:"domain"`
+	// Path rewrites the Path attribute.
+	//	Example: { From: "^/(.*)", To: "/github/$1" }
+	Path rewriter.Rewriters `json:"path"`
+
+	// Secure forces the Secure attribute.
+	Secure bool `json:"secure"`
+	// HttpOnly forces the HttpOnly attribute.
+	HttpOnly bool `json:"http_only"`
+	// SameSite forces the SameSite attribute, one of Strict, Lax, None, ignoring case.
+	//	None implies Secure, browsers reject SameSite=None cookies without it.
+	SameSite string `json:"same_site"`
+}
+
+// Compile compiles the domain and path rules, and checks SameSite.
+func (c *CookieRewrite) Compile() error {
+	switch strings.ToLower(c.SameSite) {
+	case "", "strict", "lax", "none":
+	default:
+		return fmt.Errorf("cookie rewrite: invalid SameSite %q, expected Strict, Lax or None", c.SameSite)
+	}
+
+	if err := c.Domain.Compile(); err != nil {
+		return err
+	}
+
+	return c.Path.Compile()
+}
+
+// Rewrite rewrites all the Set-Cookie headers.
+func (c *CookieRewrite) Rewrite(h http.Header) {
+	cookies := h.Values(headers.SetCookie)
+	if len(cookies) == 0 {
+		return
+	}
+
+	rewritten := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		rewritten = append(rewritten, c.rewrite(cookie))
+	}
+
+	h[headers.SetCookie] = rewritten
+}
+
+// rewrite rewrites a single Set-Cookie value, unknown attributes are kept as is.
+func (c *CookieRewrite) rewrite(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	attributes := []string{strings.TrimSpace(parts[0])}
+
+	secure := c.Secure || strings.EqualFold(c.SameSite, "none")
+	for _, part := range parts[1:] {
+		attribute := strings.TrimSpace(part)
+		if attribute == "" {
+			continue
+		}
+
+		name, value, _ := strings.Cut(attribute, "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			if len(c.Domain) == 0 {
+				break
+			}
+
+			value = c.Domain.Rewrite(strings.TrimSpace(value))
+			if value == "" {
+				continue
+			}
+			attribute = name + "=" + value
+		case "path":
+			if len(c.Path) == 0 {
+				break
+			}
+
+			attribute = name + "=" + c.Path.Rewrite(strings.TrimSpace(value))
+		case "secure":
+			if secure {
+				continue
+			}
+		case "httponly":
+			if c.HttpOnly {
+				continue
+			}
+		case "samesite":
+			if c.SameSite != "" {
+				continue
+			}
+		}
+
+		attributes = append(attributes, attribute)
+	}
+
+	if secure {
+		attributes = append(attributes, "Secure")
+	}
+
+	if c.HttpOnly {
+		attributes = append(attributes, "HttpOnly")
+	}
+
+	if c.SameSite != "" {
+		attributes = append(attributes, "SameSite="+c.SameSite)
+	}
+
+	return strings.Join(attributes, "; ")
+}
@@ -1,6 +1,9 @@
 package proxy
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+)
 
 // HTTPError is an error that wraps an HTTP status code.
 type HTTPError struct {
@@ -26,3 +29,34 @@ func (h *HTTPError) Status() int {
 func (h *HTTPError) Error() string {
 	return h.message
 }
+
+// RedirectError is an error that makes the proxy answer with a redirect,
+// without contacting the upstream. Return it from OnRequest.
+type RedirectError struct {
+	status   int
+	location string
+}
+
+// NewRedirectError creates a new RedirectError.
+func NewRedirectError(status int, location string) error {
+	return &RedirectError{status, location}
+}
+
+// Status returns the HTTP status code.
+func (r *RedirectError) Status() int {
+	if r.status == 0 {
+		return http.StatusFound
+	}
+
+	return r.status
+}
+
+// Location returns the redirect location.
+func (r *RedirectError) Location() string {
+	return r.location
+}
+
+// Error returns the error message.
+func (r *RedirectError) Error() string {
+	return fmt.Sprintf("redirect(%d) to %s", r.Status(), r.location)
+}
@@ -0,0 +1,541 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/hostport"
+	"github.com/go-zoox/proxy/utils/matcher"
+)
+
+// ForwardConfig is the configuration for the forward proxy mode,
+// where clients use the proxy as their HTTP proxy:
+//
+//	absolute-form requests, like GET http://example.com/ HTTP/1.1, are proxied through the hooks,
+//	CONNECT requests, like CONNECT example.com:443 HTTP/1.1, are tunneled.
+type ForwardConfig struct {
+	// Policy decides which destinations can be reached, nil means all.
+	Policy *ForwardPolicy
+
+	// Auth checks the Proxy-Authorization basic credentials, nil means no auth.
+	Auth func(username, password string) bool
+
+	// Realm is the realm sent in Proxy-Authenticate.
+	//	Default is proxy.
+	Realm string
+
+	// DialTimeout is the timeout to connect to destinations.
+	//	Default is 30s.
+	DialTimeout time.Duration
+
+	// IdleTimeout closes CONNECT and SOCKS5 tunnels without a byte in either direction for this duration.
+	//	Default is 10m, negative means no timeout.
+	IdleTimeout time.Duration
+
+	// MITM intercepts CONNECT tunnels, see MITMConfig.
+	//	Default is nil, which means tunnels are not intercepted.
+	MITM *MITMConfig
+}
+
+// ForwardPolicy decides which destinations the forward proxy can reach,
+// hosts are patterns like the routes of MultiHosts, see utils/matcher.
+//
+// Hosts are matched normalized, lower-cased and IP addresses in their canonical form,
+// DenyHosts are also matched against the addresses destinations resolve to when dialing,
+// so names or odd IP forms, like 127.1, resolving to denied addresses are denied too.
+type ForwardPolicy struct {
+	// AllowHosts are the allowed hosts, empty means all hosts.
+	AllowHosts []string `json:"allow_hosts"`
+	// DenyHosts are the denied hosts, checked before AllowHosts.
+	DenyHosts []string `json:"deny_hosts"`
+	// AllowPorts are the allowed ports, empty means all ports.
+	AllowPorts []int `json:"allow_ports"`
+
+	allowHosts *matcher.Matcher
+	denyHosts  *matcher.Matcher
+}
+
+// Compile compiles the host patterns, it is called by New.
+func (p *ForwardPolicy) Compile() (err error) {
+	if p.allowHosts, err = matcher.New(p.AllowHosts...); err != nil {
+		return fmt.Errorf("allow hosts: %v", err)
+	}
+
+	if p.denyHosts, err = matcher.New(p.DenyHosts...); err != nil {
+		return fmt.Errorf("deny hosts: %v", err)
+	}
+
+	return nil
+}
+
+// Allow returns true if the destination host and port can be reached,
+// the policy must be compiled first, uncompiled policies allow nothing.
+func (p *ForwardPolicy) Allow(host string, port int) bool {
+	if p.allowHosts == nil || p.denyHosts == nil {
+		return false
+	}
+
+	host = normalizePolicyHost(host)
+	if _, ok := p.denyHosts.Match(host); ok {
+		return false
+	}
+
+	if len(p.AllowHosts) != 0 {
+		if _, ok := p.allowHosts.Match(host); !ok {
+			return false
+		}
+	}
+
+	if len(p.AllowPorts) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.AllowPorts {
+		if allowed == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowIP returns false if the resolved ip is denied.
+func (p *ForwardPolicy) allowIP(ip string) bool {
+	if p.denyHosts == nil {
+		return false
+	}
+
+	_, denied := p.denyHosts.Match(normalizePolicyHost(ip))
+	return !denied
+}
+
+// normalizePolicyHost returns host normalized, IP addresses in their canonical form,
+// like 127.0.0.1 for ::ffff:127.0.0.1.
+func normalizePolicyHost(host string) string {
+	host = hostport.Normalize(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+
+	return host
+}
+
+// NewForward creates a new forward proxy, see ForwardConfig.
+//
+// Example:
+//
+//	// curl -x http://127.0.0.1:8080 https://httpbin.org/ip
+//	http.ListenAndServe(":8080", NewForward(&ForwardConfig{
+//		Policy: &ForwardPolicy{
+//			DenyHosts:  []string{`^localhost$`, `^127\.`, `^::1$`},
+//			AllowPorts: []int{80, 443},
+//		},
+//	}))
+func NewForward(cfg ...*ForwardConfig) *Proxy {
+	cfgX := &ForwardConfig{}
+	if len(cfg) != 0 && cfg[0] != nil {
+		cfgX = cfg[0]
+	}
+
+	return New(&Config{
+		Forward: cfgX,
+	})
+}
+
+type forwardProxy struct {
+	cfg    *ForwardConfig
+	dialer *net.Dialer
+	mitm   *mitm
+	// err is the config error, every request fails with it
+	err error
+}
+
+func newForwardProxy(cfg *ForwardConfig) *forwardProxy {
+	f := &forwardProxy{
+		cfg:    cfg,
+		dialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+
+	if cfg.DialTimeout != 0 {
+		f.dialer.Timeout = cfg.DialTimeout
+	}
+
+	if cfg.Policy != nil {
+		if err := cfg.Policy.Compile(); err != nil {
+			f.err = fmt.Errorf("forward policy: %v", err)
+		}
+		f.dialer.Control = f.control
+	}
+
+	if cfg.MITM != nil && f.err == nil {
+		f.mitm, f.err = newMITM(cfg.MITM)
+	}
+
+	if f.err != nil {
+		log.Printf("error: %s\n", f.err)
+	}
+
+	return f
+}
+
+// transport dials through the policy, so destinations changed by OnRequest are checked too.
+func (f *forwardProxy) transport() http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = f.dial
+	return transport
+}
+
+// check returns a 403 HTTPError if the policy denies addr, host:port.
+func (f *forwardProxy) check(addr string) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	if f.cfg.Policy == nil {
+		return nil
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &HTTPError{http.StatusBadRequest, fmt.Sprintf("invalid destination %q: %s", addr, err)}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return &HTTPError{http.StatusBadRequest, fmt.Sprintf("invalid destination port %q", portStr)}
+	}
+
+	if !f.cfg.Policy.Allow(host, port) {
+		return &HTTPError{http.StatusForbidden, fmt.Sprintf("destination %s is not allowed", addr)}
+	}
+
+	return nil
+}
+
+// control checks the resolved address against the policy, before connecting.
+func (f *forwardProxy) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if !f.cfg.Policy.allowIP(host) {
+		return &HTTPError{http.StatusForbidden, fmt.Sprintf("destination address %s is not allowed", host)}
+	}
+
+	return nil
+}
+
+// dial connects to addr if the policy allows it.
+func (f *forwardProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := f.check(addr); err != nil {
+		return nil, err
+	}
+
+	conn, err := f.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		// denied by control, answered like the checks above
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			return nil, httpErr
+		}
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (f *forwardProxy) authenticate(req *http.Request) bool {
+	if f.cfg.Auth == nil {
+		return true
+	}
+
+	username, password, ok := parseProxyAuthorization(req.Header.Get(headers.ProxyAuthorization))
+	return ok && f.cfg.Auth(username, password)
+}
+
+func (f *forwardProxy) realm() string {
+	if f.cfg.Realm != "" {
+		return f.cfg.Realm
+	}
+
+	return "proxy"
+}
+
+// idleTimeout returns the idle timeout of tunnels, 0 for none.
+func (f *forwardProxy) idleTimeout() time.Duration {
+	if f.cfg.IdleTimeout < 0 {
+		return 0
+	}
+
+	if f.cfg.IdleTimeout == 0 {
+		return 10 * time.Minute
+	}
+
+	return f.cfg.IdleTimeout
+}
+
+// parseProxyAuthorization parses basic credentials, like Request.BasicAuth for Authorization.
+func parseProxyAuthorization(value string) (username, password string, ok bool) {
+	req := &http.Request{Header: http.Header{headers.Authorization: []string{value}}}
+	return req.BasicAuth()
+}
+
+// handleForward handles the forward proxy part of the request,
+// it returns false if the request is answered, like CONNECT tunnels, or rejected.
+func (r *Proxy) handleForward(rw http.ResponseWriter, req *http.Request) bool {
+	if !r.forward.authenticate(req) {
+		rw.Header().Set(headers.ProxyAuthenticate, fmt.Sprintf("Basic realm=%q", r.forward.realm()))
+		rw.WriteHeader(http.StatusProxyAuthRequired)
+		rw.Write([]byte(http.StatusText(http.StatusProxyAuthRequired)))
+		return false
+	}
+
+	if req.Method == http.MethodConnect {
+		r.serveConnect(rw, req)
+		return false
+	}
+
+	if !req.URL.IsAbs() {
+		r.OnError(&HTTPError{http.StatusBadRequest, "forward proxy requires absolute-form requests"}, rw, req)
+		return false
+	}
+
+	if err := r.forward.check(hostPortOrDefault(req.URL.Host, req.URL.Scheme)); err != nil {
+		r.OnError(err, rw, req)
+		return false
+	}
+
+	return true
+}
+
+// serveConnect tunnels the CONNECT request to the destination,
+// or intercepts it, see MITMConfig.
+func (r *Proxy) serveConnect(rw http.ResponseWriter, req *http.Request) {
+	addr := hostPortOrDefault(req.Host, "https")
+	host, _, _ := net.SplitHostPort(addr)
+	intercept := r.forward.mitm != nil && !r.forward.mitm.isBypassed(host)
+
+	// intercepted requests are sent by the transport, which dials by itself
+	var backConn net.Conn
+	var err error
+	if intercept {
+		err = r.forward.check(addr)
+	} else {
+		backConn, err = r.forward.dial(req.Context(), "tcp", addr)
+	}
+	if err != nil {
+		r.OnError(err, rw, req)
+		return
+	}
+
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		closeConn(backConn)
+		r.OnError(fmt.Errorf("can't tunnel using non-Hijacker ResponseWriter type %T", rw), rw, req)
+		return
+	}
+
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		closeConn(backConn)
+		r.OnError(fmt.Errorf("hijack failed on connect: %v", err), rw, req)
+		return
+	}
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		log.Printf("connect response write: %v", err)
+		closeConn(backConn)
+		conn.Close()
+		return
+	}
+
+	userConn := &bufferedConn{conn, brw.Reader}
+	if intercept {
+		r.serveMITM(userConn, addr)
+		return
+	}
+
+	defer conn.Close()
+	defer backConn.Close()
+	tunnel(userConn, backConn, r.forward.idleTimeout())
+}
+
+func closeConn(conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// hostPortOrDefault returns host:port, with the default port of scheme if host has none.
+func hostPortOrDefault(rawHost, scheme string) string {
+	host, port := ParseHostPort(rawHost, scheme)
+	return hostport.Join(host, port)
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// tunnel copies data both ways until both sides are done, the end of one direction
+// half-closes the other connection, so the peer sees EOF and can still answer.
+// If idleTimeout is positive, it ends when no byte goes either way for that long.
+func tunnel(user, backend net.Conn, idleTimeout time.Duration) {
+	if idleTimeout > 0 {
+		idle := &idleTunnel{conns: [2]net.Conn{user, backend}, timeout: idleTimeout}
+		idle.touch()
+		user, backend = &idleConn{user, idle}, &idleConn{backend, idle}
+	}
+
+	errc := make(chan error, 2)
+	go copyHalf(backend, user, errc)
+	go copyHalf(user, backend, errc)
+
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			// the caller closes both connections, which stops the other direction
+			return
+		}
+	}
+}
+
+func copyHalf(dst, src net.Conn, errc chan<- error) {
+	_, err := io.Copy(dst, src)
+	if err == nil {
+		if cw, ok := dst.(closeWriter); !ok || cw.CloseWrite() != nil {
+			err = errors.New("half-close is not supported")
+		}
+	}
+
+	errc <- err
+}
+
+// idleTunnel extends the read deadlines of both sides of a tunnel on every read,
+// so a side waiting while the other is busy is not timed out.
+type idleTunnel struct {
+	conns   [2]net.Conn
+	timeout time.Duration
+}
+
+func (t *idleTunnel) touch() {
+	deadline := time.Now().Add(t.timeout)
+	for _, conn := range t.conns {
+		conn.SetReadDeadline(deadline)
+	}
+}
+
+type idleConn struct {
+	net.Conn
+	tunnel *idleTunnel
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.tunnel.touch()
+	}
+
+	return n, err
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("half-close is not supported")
+}
+
+// bufferedConn reads the data buffered by the server before hijacking first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("half-close is not supported")
+}
+
+// serveTunnelHTTP serves the http requests sent on the tunnel to addr, host:port,
+// through the hooks, the connection is owned by the server from now on.
+func (r *Proxy) serveTunnelHTTP(conn net.Conn, scheme, addr string) {
+	listener := newConnListener(conn)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			// the destination is the tunnel, not the Host header
+			req.URL.Scheme = scheme
+			req.URL.Host = addr
+			r.serve(rw, req)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			// hijacked connections, like websockets, are closed by handleUpgrade
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+
+	server.Serve(listener)
+}
+
+// connListener is a listener accepting a single connection.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	accept chan net.Conn
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{
+		conn:   conn,
+		closed: make(chan struct{}),
+		accept: make(chan net.Conn, 1),
+	}
+	l.accept <- conn
+
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newForwardClient(t *testing.T, proxyURL string) *http.Client {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyURL(u),
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+func TestForward(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("expected Proxy-Authorization not to be forwarded")
+		}
+		w.Write([]byte("hello " + r.URL.Path))
+	})
+	backend := httptest.NewServer(handler)
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(handler)
+	defer tlsBackend.Close()
+
+	proxyServer := httptest.NewServer(NewForward(&ForwardConfig{
+		Auth: func(username, password string) bool {
+			return username == "zero" && password == "secret"
+		},
+	}))
+	defer proxyServer.Close()
+
+	for _, target := range []string{backend.URL, tlsBackend.URL} {
+		// absolute-form for http, CONNECT for https
+		res, err := newForwardClient(t, strings.Replace(proxyServer.URL, "http://", "http://zero:secret@", 1)).Get(target + "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello /foo" {
+			t.Errorf("%s: got %q; expected %q", target, body, "hello /foo")
+		}
+	}
+
+	res, err := newForwardClient(t, proxyServer.URL).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("got status %d; expected %d", res.StatusCode, http.StatusProxyAuthRequired)
+	}
+	if res.Header.Get("Proxy-Authenticate") != `Basic realm="proxy"` {
+		t.Errorf("got Proxy-Authenticate %q", res.Header.Get("Proxy-Authenticate"))
+	}
+}
+
+func TestForwardPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer tlsBackend.Close()
+
+	testcases := []struct {
+		name   string
+		policy *ForwardPolicy
+		allow  bool
+	}{
+		{"no policy", nil, true},
+		{"deny host", &ForwardPolicy{DenyHosts: []string{`^127\.0\.0\.1$`}}, false},
+		{"allow other host", &ForwardPolicy{AllowHosts: []string{"*.example.com"}}, false},
+		{"allow host", &ForwardPolicy{AllowHosts: []string{`^127\.0\.0\.1$`}}, true},
+		{"allow other port", &ForwardPolicy{AllowPorts: []int{443}}, false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxyServer := httptest.NewServer(NewForward(&ForwardConfig{Policy: tc.policy}))
+			defer proxyServer.Close()
+			client := newForwardClient(t, proxyServer.URL)
+
+			res, err := client.Get(backend.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if allowed := res.StatusCode == http.StatusOK; allowed != tc.allow {
+				t.Errorf("http: got status %d; expected allowed %v", res.StatusCode, tc.allow)
+			}
+
+			res, err = client.Get(tlsBackend.URL)
+			if err == nil {
+				res.Body.Close()
+			}
+			if allowed := err == nil && res.StatusCode == http.StatusOK; allowed != tc.allow {
+				t.Errorf("connect: got error %v; expected allowed %v", err, tc.allow)
+			}
+		})
+	}
+}
+
+func TestForwardPolicyNormalize(t *testing.T) {
+	policy := &ForwardPolicy{DenyHosts: []string{`^localhost$`, `^127\.0\.0\.1$`, `^::1$`}}
+	if policy.Allow("example.com", 80) {
+		t.Errorf("uncompiled policy should allow nothing")
+	}
+	if err := policy.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"LOCALHOST", "localhost.", "[::1]", "0:0::1", "::ffff:127.0.0.1"} {
+		if policy.Allow(host, 80) {
+			t.Errorf("%s: allowed; expected denied", host)
+		}
+	}
+	if !policy.Allow("example.com", 80) {
+		t.Errorf("example.com: denied; expected allowed")
+	}
+}
+
+func TestForwardPolicyResolved(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	// localhost is not denied by name, but by the addresses it resolves to
+	proxyServer := httptest.NewServer(NewForward(&ForwardConfig{
+		Policy: &ForwardPolicy{DenyHosts: []string{`^127\.`, `^::1$`}},
+	}))
+	defer proxyServer.Close()
+	client := newForwardClient(t, proxyServer.URL)
+
+	res, err := client.Get("http://localhost:" + port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d; expected %d", res.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestForwardRejectsOriginForm(t *testing.T) {
+	p := NewForward()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d; expected %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestForwardConnectIdleTimeout(t *testing.T) {
+	// a destination that never talks
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	proxyServer := httptest.NewServer(NewForward(&ForwardConfig{IdleTimeout: 50 * time.Millisecond}))
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	addr := l.Addr().String()
+	conn.Write([]byte("CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(br); err != nil {
+		t.Errorf("expected the idle tunnel to be closed, got %v", err)
+	}
+}
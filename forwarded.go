@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/forwarded"
+	"github.com/go-zoox/proxy/utils/ipnet"
+)
+
+// Headers sent to the upstreams, see ForwardedConfig.Headers.
+const (
+	ForwardedHeadersXForwarded = "x-forwarded"
+	ForwardedHeadersForwarded  = "forwarded"
+	ForwardedHeadersBoth       = "both"
+)
+
+const (
+	clientIPKey key = "client_ip"
+	schemeKey   key = "scheme"
+)
+
+// ForwardedConfig is the configuration of the client address, how it is found
+// behind trusted proxies, and how it is sent to the upstreams.
+//
+// Spoofed headers are only stripped with a ForwardedConfig, without one, the
+// X-Forwarded-* and X-Real-IP headers of every client are trusted as they are.
+type ForwardedConfig struct {
+	// TrustedProxies are the CIDRs or IPs of the proxies in front, like load balancers,
+	//	their X-Forwarded-*, X-Real-IP and Forwarded headers are used to find the client IP,
+	//	these headers from other clients are spoofed, they are dropped.
+	//	Default is empty, which means no proxy is trusted.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// Headers are the headers sent to the upstreams, x-forwarded for X-Forwarded-*,
+	//	forwarded for Forwarded of RFC 7239, or both. X-Real-IP is always sent.
+	//	Default is x-forwarded.
+	Headers string `json:"headers"`
+
+	// Obfuscate sends an obfuscated identifier instead of the client IP in for= of Forwarded,
+	//	the same for a client IP during the lifetime of the proxy.
+	//	Default is false.
+	Obfuscate bool `json:"obfuscate"`
+
+	// By is the identifier of the proxy in by= of Forwarded, like _proxy1.
+	//	Default is empty, which means no by=.
+	By string `json:"by"`
+}
+
+// ClientIP returns the client IP of the request, resolved through the trusted proxies,
+// see ForwardedConfig. It is available for the requests of OnRequest.
+func ClientIP(req *http.Request) string {
+	if ip, ok := req.Context().Value(clientIPKey).(string); ok {
+		return ip
+	}
+
+	return remoteIP(req.RemoteAddr)
+}
+
+type forwardedResolver struct {
+	// cfg is nil without ForwardedConfig, all the clients are trusted, as before
+	cfg     *ForwardedConfig
+	trusted []*net.IPNet
+	// secret is the key of the obfuscated identifiers
+	secret []byte
+	err    error
+}
+
+func newForwardedResolver(cfg *ForwardedConfig) *forwardedResolver {
+	f := &forwardedResolver{cfg: cfg}
+	if cfg == nil {
+		return f
+	}
+
+	switch cfg.Headers {
+	case "", ForwardedHeadersXForwarded, ForwardedHeadersForwarded, ForwardedHeadersBoth:
+	default:
+		f.err = fmt.Errorf("forwarded: unsupported headers %q", cfg.Headers)
+		return f
+	}
+
+	var err error
+	if f.trusted, err = ipnet.Parse(cfg.TrustedProxies...); err != nil {
+		f.err = fmt.Errorf("forwarded: trusted proxies: %v", err)
+		return f
+	}
+
+	f.secret = make([]byte, 32)
+	if _, err := rand.Read(f.secret); err != nil {
+		f.err = err
+	}
+
+	return f
+}
+
+// enabled returns false without ForwardedConfig, or for a Proxy not made by New.
+func (f *forwardedResolver) enabled() bool {
+	return f != nil && f.cfg != nil
+}
+
+func (f *forwardedResolver) isTrusted(ip net.IP) bool {
+	if !f.enabled() {
+		return true
+	}
+
+	return ipnet.Contains(f.trusted, ip)
+}
+
+// clientIP returns the client IP of req, the first untrusted address from the right
+// of Forwarded or X-Forwarded-For, then X-Real-IP, if the peer is a trusted proxy.
+func (f *forwardedResolver) clientIP(req *http.Request) string {
+	peer := remoteIP(req.RemoteAddr)
+	if !f.enabled() || !f.isTrusted(net.ParseIP(peer)) {
+		return peer
+	}
+
+	var chain []net.IP
+	if values := req.Header.Values(forwarded.Header); len(values) != 0 {
+		if elements, err := forwarded.Parse(values); err == nil {
+			for _, e := range elements {
+				chain = append(chain, forwarded.NodeIP(e.For))
+			}
+		}
+	} else {
+		for _, value := range req.Header.Values(headers.XForwardedFor) {
+			for _, addr := range strings.Split(value, ",") {
+				chain = append(chain, net.ParseIP(remoteIP(strings.TrimSpace(addr))))
+			}
+		}
+	}
+
+	if len(chain) == 0 {
+		if ip := net.ParseIP(req.Header.Get(headers.XRealIP)); ip != nil {
+			return ip.String()
+		}
+
+		return peer
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		// obfuscated or unknown, the chain cannot be followed further
+		if chain[i] == nil {
+			break
+		}
+
+		client = chain[i].String()
+		if !f.isTrusted(chain[i]) {
+			break
+		}
+	}
+
+	return client
+}
+
+// scheme returns the scheme the client requested, the proto= of Forwarded or X-Forwarded-Proto
+// if the peer is a trusted proxy, like a load balancer terminating TLS, see connScheme otherwise.
+func (f *forwardedResolver) scheme(req *http.Request) string {
+	scheme := connScheme(req)
+	if !f.enabled() || !f.isTrusted(net.ParseIP(remoteIP(req.RemoteAddr))) {
+		return scheme
+	}
+
+	proto := ""
+	if values := req.Header.Values(forwarded.Header); len(values) != 0 {
+		elements, err := forwarded.Parse(values)
+		if err != nil {
+			return scheme
+		}
+
+		// the proto= of the hop from the client to the first trusted proxy, like clientIP
+		for i := len(elements) - 1; i >= 0; i-- {
+			if elements[i].Proto != "" {
+				proto = elements[i].Proto
+			}
+
+			if ip := forwarded.NodeIP(elements[i].For); ip == nil || !f.isTrusted(ip) {
+				break
+			}
+		}
+	} else if value := req.Header.Get(headers.XForwardedProto); value != "" {
+		// the value of the nearest proxy
+		proto = strings.ToLower(strings.TrimSpace(value[strings.LastIndexByte(value, ',')+1:]))
+	}
+
+	if proto == "http" || proto == "https" {
+		return proto
+	}
+
+	return scheme
+}
+
+// strip removes the forwarding headers sent by clients which are not trusted proxies.
+func (f *forwardedResolver) strip(h http.Header, req *http.Request) {
+	if f.isTrusted(net.ParseIP(remoteIP(req.RemoteAddr))) {
+		return
+	}
+
+	for _, name := range []string{
+		forwarded.Header,
+		headers.XForwardedFor,
+		headers.XForwardedProto,
+		headers.XForwardedHost,
+		headers.XForwardedPort,
+		headers.XRealIP,
+	} {
+		h.Del(name)
+	}
+}
+
+// update sets the Forwarded header, and keeps the X-Forwarded-* headers of trusted proxies,
+// after addRequestHeaders and updateRequestXForwardedForHeader.
+func (f *forwardedResolver) update(h http.Header, req *http.Request, isAnonymouse bool) {
+	if !f.enabled() || isAnonymouse {
+		return
+	}
+
+	peer := net.ParseIP(remoteIP(req.RemoteAddr))
+	if f.isTrusted(peer) {
+		// like the scheme of the TLS terminated by the balancer
+		for _, name := range []string{headers.XForwardedProto, headers.XForwardedHost, headers.XForwardedPort} {
+			if value := req.Header.Get(name); value != "" {
+				h.Set(name, value)
+			}
+		}
+	}
+
+	if f.cfg.Headers == ForwardedHeadersForwarded || f.cfg.Headers == ForwardedHeadersBoth {
+		var elements []forwarded.Element
+		if f.isTrusted(peer) {
+			// invalid values of trusted proxies are dropped
+			elements, _ = forwarded.Parse(req.Header.Values(forwarded.Header))
+		}
+
+		elements = append(elements, forwarded.Element{
+			For:   f.node(peer),
+			By:    f.cfg.By,
+			Host:  req.Host,
+			Proto: connScheme(req),
+		})
+		h.Set(forwarded.Header, forwarded.Format(elements))
+	}
+
+	if f.cfg.Headers == ForwardedHeadersForwarded {
+		for _, name := range []string{headers.XForwardedFor, headers.XForwardedProto, headers.XForwardedHost, headers.XForwardedPort} {
+			h.Del(name)
+		}
+	}
+}
+
+// node returns the for= node of ip, obfuscated if configured.
+func (f *forwardedResolver) node(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+
+	if f.cfg.Obfuscate {
+		mac := hmac.New(sha256.New, f.secret)
+		mac.Write(ip.To16())
+		return "_" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+
+	return forwarded.Node(ip, "")
+}
+
+// remoteIP returns the host of addr, ip:port, or addr if it has no port.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwarded(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	testcases := []struct {
+		name       string
+		cfg        *ForwardedConfig
+		remoteAddr string
+		header     http.Header
+		expected   map[string]string
+	}{
+		{
+			name:       "untrusted client spoofing",
+			cfg:        &ForwardedConfig{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "198.51.100.17:4711",
+			header: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4"},
+				"X-Real-Ip":         {"1.2.3.4"},
+				"X-Forwarded-Proto": {"https"},
+				"Forwarded":         {"for=1.2.3.4"},
+			},
+			expected: map[string]string{
+				"X-Real-Ip":         "198.51.100.17",
+				"X-Forwarded-For":   "198.51.100.17",
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "",
+			},
+		},
+		{
+			name:       "trusted proxies chain",
+			cfg:        &ForwardedConfig{TrustedProxies: []string{"10.0.0.0/8"}},
+			remoteAddr: "10.0.0.2:4711",
+			header: http.Header{
+				"X-Forwarded-For":   {"1.2.3.4, 198.51.100.17, 10.0.0.1"},
+				"X-Forwarded-Proto": {"https"},
+			},
+			expected: map[string]string{
+				"X-Real-Ip":         "198.51.100.17",
+				"X-Forwarded-For":   "1.2.3.4, 198.51.100.17, 10.0.0.1, 10.0.0.2",
+				"X-Forwarded-Proto": "https",
+			},
+		},
+		{
+			name:       "trusted proxy x-real-ip",
+			cfg:        &ForwardedConfig{TrustedProxies: []string{"10.0.0.2"}},
+			remoteAddr: "10.0.0.2:4711",
+			header:     http.Header{"X-Real-Ip": {"198.51.100.17"}},
+			expected:   map[string]string{"X-Real-Ip": "198.51.100.17"},
+		},
+		{
+			name:       "forwarded",
+			cfg:        &ForwardedConfig{TrustedProxies: []string{"10.0.0.0/8", "2001:db8::/32"}, Headers: ForwardedHeadersForwarded, By: "_proxy"},
+			remoteAddr: "[2001:db8::2]:4711",
+			header:     http.Header{"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https`}},
+			expected: map[string]string{
+				"X-Real-Ip":       "2001:db8:cafe::17",
+				"Forwarded":       `for="[2001:db8:cafe::17]:4711";proto=https, for="[2001:db8::2]";by=_proxy;host=example.com;proto=http`,
+				"X-Forwarded-For": "",
+			},
+		},
+		{
+			name:       "both",
+			cfg:        &ForwardedConfig{Headers: ForwardedHeadersBoth},
+			remoteAddr: "198.51.100.17:4711",
+			expected: map[string]string{
+				"X-Forwarded-For": "198.51.100.17",
+				"Forwarded":       "for=198.51.100.17;host=example.com;proto=http",
+			},
+		},
+		{
+			name:       "without config",
+			remoteAddr: "198.51.100.17:4711",
+			header:     http.Header{"X-Forwarded-For": {"1.2.3.4"}},
+			expected: map[string]string{
+				"X-Real-Ip":       "198.51.100.17",
+				"X-Forwarded-For": "1.2.3.4, 198.51.100.17",
+				"Forwarded":       "",
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var clientIP string
+			p := NewSingleHost(backend.URL, &SingleHostConfig{
+				Forwarded: tc.cfg,
+				OnRequest: func(req *http.Request) error {
+					clientIP = ClientIP(req)
+					return nil
+				},
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			for k, v := range tc.header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d", rec.Code)
+			}
+
+			for k, v := range tc.expected {
+				if got.Get(k) != v {
+					t.Errorf("got %s %q; expected %q", k, got.Get(k), v)
+				}
+			}
+			if expected := tc.expected["X-Real-Ip"]; expected != "" && clientIP != expected {
+				t.Errorf("got client ip %q; expected %q", clientIP, expected)
+			}
+		})
+	}
+}
+
+func TestForwardedObfuscate(t *testing.T) {
+	var got []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get("Forwarded"))
+	}))
+	defer backend.Close()
+
+	p := NewSingleHost(backend.URL, &SingleHostConfig{
+		Forwarded: &ForwardedConfig{Headers: ForwardedHeadersForwarded, Obfuscate: true},
+	})
+	for _, remoteAddr := range []string{"198.51.100.17:1", "198.51.100.17:2", "198.51.100.18:1"} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		p.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if !strings.HasPrefix(got[0], "for=_") || strings.Contains(got[0], "198.51.100.17") {
+		t.Errorf("got %q; expected an obfuscated identifier", got[0])
+	}
+	if got[0] != got[1] || got[0] == got[2] {
+		t.Errorf("got %q; expected the same identifier per client ip", got)
+	}
+}
+
+func TestForwardedInvalidConfig(t *testing.T) {
+	for _, cfg := range []*ForwardedConfig{
+		{TrustedProxies: []string{"10.0.0.0/33"}},
+		{Headers: "x-real-ip"},
+	} {
+		rec := httptest.NewRecorder()
+		New(&Config{Forwarded: cfg}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusBadGateway {
+			t.Errorf("%+v: got status %d; expected %d", cfg, rec.Code, http.StatusBadGateway)
+		}
+	}
+}
@@ -3,13 +3,18 @@ module github.com/go-zoox/proxy
 go 1.20
 
 require (
+	github.com/andybalholm/brotli v1.1.0
 	github.com/go-zoox/cache v1.0.1
-	github.com/go-zoox/compress v1.0.1
-	github.com/go-zoox/core-utils v1.2.7
 	github.com/go-zoox/headers v1.0.6
 	github.com/go-zoox/logger v1.4.4
-	github.com/tidwall/gjson v1.14.1
-	golang.org/x/net v0.8.0
+	github.com/klauspost/compress v1.17.4
+	github.com/tidwall/gjson v1.14.2
+	github.com/tidwall/sjson v1.2.5
+	golang.org/x/net v0.12.0
+	golang.org/x/sync v0.3.0
+	google.golang.org/genproto/googleapis/api v0.0.0-20230711160842-782d3b101e98
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
 )
 
 require (
@@ -18,14 +23,18 @@ require (
 	github.com/fsnotify/fsnotify v1.6.0 // indirect
 	github.com/go-redis/redis/v8 v8.11.5 // indirect
 	github.com/go-zoox/chalk v1.0.2 // indirect
+	github.com/go-zoox/core-utils v1.2.7 // indirect
 	github.com/go-zoox/datetime v1.1.1 // indirect
 	github.com/go-zoox/encoding v1.2.1 // indirect
 	github.com/go-zoox/fs v1.3.9 // indirect
 	github.com/go-zoox/kv v1.5.0 // indirect
 	github.com/go-zoox/uuid v0.0.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
-	golang.org/x/sys v0.6.0 // indirect
-	golang.org/x/text v0.8.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/genproto v0.0.0-20230711160842-782d3b101e98 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
 )
@@ -0,0 +1,276 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zoox/headers"
+)
+
+const grpcWebKey key = "grpc_web"
+
+// GRPCWebConfig is the configuration for translating gRPC-Web to gRPC, see Config.GRPCWeb.
+//
+// Requests with Content-Type application/grpc-web or application/grpc-web-text (base64)
+// are sent to the upstreams as gRPC, in gRPC mode, see Config.GRPC, and the responses
+// are encoded back in gRPC-Web, with the trailers in the body.
+// Browsers need CORS for other origins, the preflights asking for X-Grpc-Web are answered.
+type GRPCWebConfig struct {
+	// AllowOrigins are the origins allowed by CORS, like https://app.example.com, * for all.
+	//	Default is empty, which means no CORS, for clients of the same origin only.
+	AllowOrigins []string `json:"allow_origins"`
+
+	// AllowHeaders are the request headers allowed besides the ones of gRPC-Web clients,
+	//	like Authorization.
+	AllowHeaders []string `json:"allow_headers"`
+
+	// ExposeHeaders are the response headers exposed besides grpc-status and grpc-message.
+	ExposeHeaders []string `json:"expose_headers"`
+
+	// AllowCredentials allows cookies and authorization of other origins.
+	//	Default is false.
+	AllowCredentials bool `json:"allow_credentials"`
+
+	// MaxAge is how long browsers cache the preflights.
+	//	Default is 24h.
+	MaxAge time.Duration `json:"max_age"`
+}
+
+// grpcWebAllowHeaders are the headers sent by gRPC-Web clients.
+var grpcWebAllowHeaders = []string{
+	"Content-Type",
+	"Grpc-Timeout",
+	"X-Grpc-Web",
+	"X-User-Agent",
+	"X-Accept-Content-Transfer-Encoding",
+	"X-Accept-Response-Streaming",
+}
+
+// isGRPCWebRequest returns true for gRPC-Web requests, and their CORS preflights.
+func isGRPCWebRequest(req *http.Request) bool {
+	if req.Method == http.MethodOptions && req.Header.Get(headers.AccessControlRequestMethod) != "" {
+		for _, value := range strings.Split(req.Header.Get("Access-Control-Request-Headers"), ",") {
+			if strings.EqualFold(strings.TrimSpace(value), "x-grpc-web") {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get(headers.ContentType))
+	return strings.HasPrefix(mediaType, "application/grpc-web")
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin for origin, empty if not allowed.
+func (c *GRPCWebConfig) allowOrigin(origin string) string {
+	for _, allowed := range c.AllowOrigins {
+		if allowed == "*" && !c.AllowCredentials {
+			return "*"
+		}
+
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+
+	return ""
+}
+
+// setCORSHeaders sets the CORS headers of the responses, false if origin is not allowed.
+func (c *GRPCWebConfig) setCORSHeaders(h http.Header, origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	h.Add(headers.Vary, "Origin")
+	allowOrigin := c.allowOrigin(origin)
+	if allowOrigin == "" {
+		return false
+	}
+
+	h.Set(headers.AccessControlAllowOrigin, allowOrigin)
+	if c.AllowCredentials {
+		h.Set(headers.AccessControlAllowCredentials, "true")
+	}
+	h.Set(headers.AccessControlExposeHeaders, strings.Join(append([]string{"Grpc-Status", "Grpc-Message"}, c.ExposeHeaders...), ", "))
+	return true
+}
+
+// serveGRPCWeb answers the preflights, and translates the requests to gRPC.
+func (r *Proxy) serveGRPCWeb(rw http.ResponseWriter, inReq *http.Request) {
+	origin := inReq.Header.Get(headers.Origin)
+
+	if inReq.Method == http.MethodOptions {
+		h := rw.Header()
+		if !r.grpcWeb.setCORSHeaders(h, origin) {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		maxAge := r.grpcWeb.MaxAge
+		if maxAge == 0 {
+			maxAge = 24 * time.Hour
+		}
+
+		h.Set(headers.AccessControlAllowMethods, "POST, OPTIONS")
+		h.Set(headers.AccessControlAllowHeaders, strings.Join(append(grpcWebAllowHeaders, r.grpcWeb.AllowHeaders...), ", "))
+		h.Set(headers.AccessControlMaxAge, strconv.Itoa(int(maxAge.Seconds())))
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(inReq.Header.Get(headers.ContentType))
+	text := strings.HasPrefix(mediaType, "application/grpc-web-text")
+
+	req := inReq.WithContext(context.WithValue(inReq.Context(), grpcWebKey, true))
+	req.Header = inReq.Header.Clone()
+	req.Header.Set(headers.ContentType, "application/grpc"+grpcSubtype(mediaType))
+	req.Header.Del("X-Grpc-Web")
+	if text {
+		// the size changes, it is not known anymore
+		req.Body = io.NopCloser(base64.NewDecoder(base64.StdEncoding, inReq.Body))
+		req.ContentLength = -1
+		req.Header.Del(headers.ContentLength)
+	}
+
+	w := &grpcWebResponseWriter{rw: rw, text: text, header: http.Header{}}
+	r.grpcWeb.setCORSHeaders(rw.Header(), origin)
+	r.serve(w, req)
+	w.finish()
+}
+
+// grpcSubtype returns the subtype of the gRPC-Web media type, like +proto.
+func grpcSubtype(mediaType string) string {
+	if i := strings.IndexByte(mediaType, '+'); i >= 0 {
+		return mediaType[i:]
+	}
+
+	return ""
+}
+
+// grpcWebResponseWriter encodes the gRPC response in gRPC-Web, the trailers are
+// sent as the last frame of the body.
+type grpcWebResponseWriter struct {
+	rw     http.ResponseWriter
+	text   bool
+	header http.Header
+	// trailers are the names announced by the Trailer header
+	trailers    []string
+	wroteHeader bool
+}
+
+func (w *grpcWebResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *grpcWebResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	for _, value := range w.header.Values(headers.Trailer) {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				w.trailers = append(w.trailers, name)
+			}
+		}
+	}
+	w.header.Del(headers.Trailer)
+
+	h := w.rw.Header()
+	for k, vv := range w.header {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			h[k] = vv
+		}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(h.Get(headers.ContentType))
+	if isGRPCContentType(mediaType) {
+		encoding := "application/grpc-web"
+		if w.text {
+			encoding = "application/grpc-web-text"
+		}
+		h.Set(headers.ContentType, encoding+grpcSubtype(mediaType))
+	}
+	h.Del(headers.ContentLength)
+
+	w.rw.WriteHeader(status)
+}
+
+func (w *grpcWebResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if !w.text {
+		return w.rw.Write(p)
+	}
+
+	// each write is padded, clients decode the body by groups of 4 characters
+	if _, err := w.rw.Write([]byte(base64.StdEncoding.EncodeToString(p))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (w *grpcWebResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish writes the trailers frame, for the trailers set after the body.
+func (w *grpcWebResponseWriter) finish() {
+	trailer := http.Header{}
+	for _, name := range w.trailers {
+		if values := w.header.Values(name); len(values) != 0 {
+			trailer[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	for k, vv := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			trailer[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = vv
+		}
+	}
+
+	// trailers-only responses have the status in headers
+	if len(trailer) == 0 {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+
+	names := make([]string, 0, len(trailer))
+	for name := range trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var block bytes.Buffer
+	for _, name := range names {
+		for _, value := range trailer[name] {
+			block.WriteString(strings.ToLower(name) + ": " + value + "\r\n")
+		}
+	}
+
+	frame := []byte{0x80}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(block.Len()))
+	w.Write(append(frame, block.Bytes()...))
+}
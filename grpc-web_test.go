@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcWebFrames splits the gRPC-Web body in messages and the trailers.
+func grpcWebFrames(t *testing.T, body []byte) ([][]byte, string) {
+	var messages [][]byte
+	var trailers string
+	for len(body) >= 5 {
+		size := binary.BigEndian.Uint32(body[1:5])
+		if int(size) > len(body)-5 {
+			t.Fatalf("truncated frame")
+		}
+
+		if body[0]&0x80 != 0 {
+			trailers += string(body[5 : 5+size])
+		} else {
+			messages = append(messages, body[5:5+size])
+		}
+		body = body[5+size:]
+	}
+
+	return messages, trailers
+}
+
+// decodeGRPCWebText decodes the base64 body, padded chunks by chunks.
+func decodeGRPCWebText(t *testing.T, body []byte) []byte {
+	var decoded []byte
+	for i := 0; i+4 <= len(body); i += 4 {
+		b, err := base64.StdEncoding.DecodeString(string(body[i : i+4]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, b...)
+	}
+
+	return decoded
+}
+
+func TestGRPCWeb(t *testing.T) {
+	addr := newGRPCBackend(t)
+	front := httptest.NewServer(NewSingleHost("http://"+addr, &SingleHostConfig{
+		GRPCWeb: &GRPCWebConfig{AllowOrigins: []string{"https://app.example.com"}},
+	}))
+	defer front.Close()
+
+	message, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "svc"})
+	frame := append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message))), message...)
+
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text"} {
+		t.Run(contentType, func(t *testing.T) {
+			text := strings.HasPrefix(contentType, "application/grpc-web-text")
+			body := frame
+			if text {
+				body = []byte(base64.StdEncoding.EncodeToString(frame))
+			}
+
+			req, _ := http.NewRequest(http.MethodPost, front.URL+"/grpc.health.v1.Health/Check", bytes.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set("X-Grpc-Web", "1")
+			req.Header.Set("Origin", "https://app.example.com")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resBody, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			if got := res.Header.Get("Content-Type"); got != contentType {
+				t.Errorf("got content type %q; expected %q", got, contentType)
+			}
+			if res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+				!strings.Contains(res.Header.Get("Access-Control-Expose-Headers"), "Grpc-Status") {
+				t.Errorf("got cors headers %v", res.Header)
+			}
+
+			if text {
+				resBody = decodeGRPCWebText(t, resBody)
+			}
+			messages, trailers := grpcWebFrames(t, resBody)
+			if len(messages) != 1 {
+				t.Fatalf("got %d messages; expected 1", len(messages))
+			}
+
+			var reply healthpb.HealthCheckResponse
+			if err := proto.Unmarshal(messages[0], &reply); err != nil || reply.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Errorf("got %v, %v; expected SERVING", &reply, err)
+			}
+			if !strings.Contains(trailers, "grpc-status: 0\r\n") {
+				t.Errorf("got trailers %q; expected grpc-status 0", trailers)
+			}
+		})
+	}
+}
+
+func TestGRPCWebCORS(t *testing.T) {
+	p := NewSingleHost("http://127.0.0.1:1", &SingleHostConfig{
+		GRPCWeb: &GRPCWebConfig{
+			AllowOrigins: []string{"https://app.example.com"},
+			AllowHeaders: []string{"Authorization"},
+		},
+	})
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/grpc.health.v1.Health/Check", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web,authorization")
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := preflight("https://app.example.com")
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d; expected %d", rec.Code, http.StatusNoContent)
+	}
+	if rec.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		!strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "X-Grpc-Web") ||
+		!strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "Authorization") ||
+		rec.Header().Get("Access-Control-Max-Age") != "86400" {
+		t.Errorf("got preflight headers %v", rec.Header())
+	}
+
+	if rec := preflight("https://evil.example.com"); rec.Code != http.StatusForbidden {
+		t.Errorf("got status %d; expected %d for another origin", rec.Code, http.StatusForbidden)
+	}
+
+	// errors of the proxy are gRPC statuses, in headers
+	req := httptest.NewRequest(http.MethodPost, "/grpc.health.v1.Health/Check", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/grpc-web")
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Grpc-Status") != "14" {
+		t.Errorf("got status %d, grpc-status %q; expected 14 (unavailable)", rec.Code, rec.Header().Get("Grpc-Status"))
+	}
+}
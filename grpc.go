@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-zoox/headers"
+)
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcCodeOK                 = 0
+	grpcCodeCanceled           = 1
+	grpcCodeUnknown            = 2
+	grpcCodeInvalidArgument    = 3
+	grpcCodeDeadlineExceeded   = 4
+	grpcCodeNotFound           = 5
+	grpcCodeAlreadyExists      = 6
+	grpcCodePermissionDenied   = 7
+	grpcCodeResourceExhausted  = 8
+	grpcCodeFailedPrecondition = 9
+	grpcCodeAborted            = 10
+	grpcCodeOutOfRange         = 11
+	grpcCodeUnimplemented      = 12
+	grpcCodeInternal           = 13
+	grpcCodeUnavailable        = 14
+	grpcCodeDataLoss           = 15
+	grpcCodeUnauthenticated    = 16
+)
+
+const grpcKey key = "grpc"
+
+// SetGRPC enables the gRPC mode for the request being proxied, like per route, see Config.GRPC,
+// it is meant to be called in OnRequest, with the outgoing request.
+func SetGRPC(req *http.Request, enabled bool) {
+	if current, ok := req.Context().Value(grpcKey).(*bool); ok && enabled {
+		*current = true
+	}
+}
+
+func withGRPC(ctx context.Context, enabled bool) context.Context {
+	return context.WithValue(ctx, grpcKey, &enabled)
+}
+
+// isGRPC returns true if the gRPC mode is enabled for req, and it is a gRPC request.
+func isGRPC(ctx context.Context, req *http.Request) bool {
+	enabled, ok := ctx.Value(grpcKey).(*bool)
+	return ok && *enabled && isGRPCContentType(req.Header.Get(headers.ContentType))
+}
+
+// isGRPCContentType returns true for application/grpc and its subtypes, like application/grpc+proto,
+// gRPC-Web is not gRPC.
+func isGRPCContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "application/grpc" || strings.HasPrefix(mediaType, "application/grpc+")
+}
+
+// prepareGRPCRequest applies the gRPC mode to the outgoing request,
+// the returned cancel must be called when the request is done.
+func prepareGRPCRequest(req, inReq *http.Request) (*http.Request, context.CancelFunc, error) {
+	// gRPC needs trailers, whatever the client told
+	req.Header.Set("Te", "trailers")
+
+	// gRPC is HTTP/2 only
+	if getUpstreamProtocol(req.Context()) == "" {
+		protocol := UpstreamProtocolH2C
+		if req.URL.Scheme == "https" {
+			protocol = UpstreamProtocolHTTP2
+		}
+		SetUpstreamProtocol(req, protocol)
+	}
+
+	value := inReq.Header.Get("Grpc-Timeout")
+	if value == "" {
+		return req, func() {}, nil
+	}
+
+	timeout, err := parseGRPCTimeout(value)
+	if err != nil {
+		return nil, nil, NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	return req.WithContext(ctx), cancel, nil
+}
+
+// parseGRPCTimeout parses the grpc-timeout header, like 100m or 5S.
+func parseGRPCTimeout(value string) (time.Duration, error) {
+	if len(value) < 2 || len(value) > 9 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", value)
+	}
+
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout unit %q", value)
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+// grpcCodeOf returns the gRPC status code for the proxy error.
+func grpcCodeOf(err error) int {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return grpcCodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return grpcCodeCanceled
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return grpcCodeUnavailable
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return grpcCodeOfHTTPStatus(httpErr.Status())
+	}
+
+	// like the transport failing to reach the upstream
+	return grpcCodeUnavailable
+}
+
+// grpcCodeOfHTTPStatus maps HTTP status codes like gRPC clients do,
+// see https://github.com/grpc/grpc/blob/master/doc/http-grpc-status-mapping.md
+func grpcCodeOfHTTPStatus(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcCodeInternal
+	case http.StatusUnauthorized:
+		return grpcCodeUnauthenticated
+	case http.StatusForbidden:
+		return grpcCodePermissionDenied
+	case http.StatusNotFound:
+		return grpcCodeUnimplemented
+	case http.StatusRequestEntityTooLarge:
+		return grpcCodeResourceExhausted
+	case http.StatusGatewayTimeout:
+		return grpcCodeDeadlineExceeded
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcCodeUnavailable
+	}
+
+	return grpcCodeUnknown
+}
+
+// writeGRPCError answers with a trailers-only gRPC response, the status in headers.
+func writeGRPCError(rw http.ResponseWriter, err error) {
+	h := rw.Header()
+	h.Set(headers.ContentType, "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(grpcCodeOf(err)))
+	h.Set("Grpc-Message", encodeGRPCMessage(err.Error()))
+	rw.WriteHeader(http.StatusOK)
+}
+
+// setGRPCErrorTrailers sends the status in trailers, for errors after the response started.
+func setGRPCErrorTrailers(rw http.ResponseWriter, err error) {
+	h := rw.Header()
+	h.Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(grpcCodeOf(err)))
+	h.Set(http.TrailerPrefix+"Grpc-Message", encodeGRPCMessage(err.Error()))
+}
+
+// encodeGRPCMessage percent-encodes the message, as required for grpc-message.
+func encodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+
+	return b.String()
+}
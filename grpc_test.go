@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// newGRPCBackend starts a gRPC server with the health service, svc is serving.
+func newGRPCBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("svc", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	return l.Addr().String()
+}
+
+// serveGRPCProxy serves p with h2c, and returns a client connection to it.
+func serveGRPCProxy(t *testing.T, p *Proxy) *grpc.ClientConn {
+	front := httptest.NewServer(p.H2CHandler())
+	t.Cleanup(front.Close)
+
+	conn, err := grpc.Dial(front.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestGRPC(t *testing.T) {
+	addr := newGRPCBackend(t)
+	client := healthpb.NewHealthClient(serveGRPCProxy(t, NewSingleHost("http://"+addr, &SingleHostConfig{GRPC: true})))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got %s; expected SERVING", res.Status)
+	}
+
+	// the status of the upstream is passed through
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("got %v; expected %s", err, codes.NotFound)
+	}
+
+	// the stream stays open, messages are not buffered
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := stream.Recv(); err != nil || res.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("got %v, %v; expected SERVING while the stream is open", res, err)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+
+	// not a gRPC server
+	notFound := httptest.NewServer(h2c.NewHandler(http.NotFoundHandler(), &http2.Server{}))
+	defer notFound.Close()
+
+	denied := New(&Config{
+		GRPC: true,
+		OnRequest: func(req, inReq *http.Request) error {
+			return NewHTTPError(http.StatusForbidden, "denied")
+		},
+	})
+
+	testcases := []struct {
+		name     string
+		proxy    *Proxy
+		expected codes.Code
+	}{
+		{"upstream down", NewSingleHost("http://"+down.Addr().String(), &SingleHostConfig{GRPC: true}), codes.Unavailable},
+		{"http status", NewSingleHost(notFound.URL, &SingleHostConfig{GRPC: true}), codes.Unimplemented},
+		{"hook error", denied, codes.PermissionDenied},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := healthpb.NewHealthClient(serveGRPCProxy(t, tc.proxy))
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "svc"})
+			if status.Code(err) != tc.expected {
+				t.Errorf("got %v; expected %s", err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	addr := newGRPCBackend(t)
+	front := httptest.NewServer(NewSingleHost("http://"+addr, &SingleHostConfig{GRPC: true}).H2CHandler())
+	defer front.Close()
+
+	// a raw client, which does not enforce the deadline itself
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+
+	message, _ := proto.Marshal(&healthpb.HealthCheckRequest{Service: "svc"})
+	frame := append([]byte{0}, binary.BigEndian.AppendUint32(nil, uint32(len(message)))...)
+	req, _ := http.NewRequest(http.MethodPost, front.URL+"/grpc.health.v1.Health/Watch", bytes.NewReader(append(frame, message...)))
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Grpc-Timeout", "200m")
+
+	start := time.Now()
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the watch never ends by itself
+	io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if got := res.Trailer.Get("Grpc-Status"); got != "4" {
+		t.Errorf("got grpc-status %q; expected 4 (deadline exceeded)", got)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("took %s; expected the deadline of 200ms", elapsed)
+	}
+
+	if _, err := parseGRPCTimeout("1x"); err == nil {
+		t.Errorf("expected an error for an invalid unit")
+	}
+	if d, _ := parseGRPCTimeout("5S"); d != 5*time.Second {
+		t.Errorf("got %s; expected 5s", d)
+	}
+}
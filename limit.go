@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/contentcoding"
+)
+
+const bodyLimitKey key = "body_limit"
+
+// BodyLimit limits the sizes of the bodies going through the proxy, 0 means no limit.
+type BodyLimit struct {
+	// MaxRequestBodySize is the max request body size,
+	//	larger requests are rejected with 413, by Content-Length before contacting the upstream,
+	//	or while streaming for requests without Content-Length.
+	MaxRequestBodySize int64 `json:"max_request_body_size"`
+
+	// MaxResponseBodySize is the max upstream response body size,
+	//	larger responses are aborted, with 502 if Content-Length tells it before the headers are sent,
+	//	or by closing the connection while streaming.
+	MaxResponseBodySize int64 `json:"max_response_body_size"`
+
+	// TruncateResponseBody truncates larger responses to MaxResponseBodySize instead of aborting them.
+	//	Responses with a Content-Encoding, like gzip, are still aborted, a truncated encoded body is corrupt.
+	//	Default is false.
+	TruncateResponseBody bool `json:"truncate_response_body"`
+}
+
+// SetBodyLimit overrides the body limit of the request being proxied, like per route,
+// it is meant to be called in OnRequest, with the outgoing request.
+func SetBodyLimit(req *http.Request, limit *BodyLimit) {
+	if current, ok := req.Context().Value(bodyLimitKey).(*BodyLimit); ok && limit != nil {
+		*current = *limit
+	}
+}
+
+func withBodyLimit(ctx context.Context, limit *BodyLimit) context.Context {
+	current := &BodyLimit{}
+	if limit != nil {
+		*current = *limit
+	}
+
+	return context.WithValue(ctx, bodyLimitKey, current)
+}
+
+func getBodyLimit(ctx context.Context) *BodyLimit {
+	if limit, ok := ctx.Value(bodyLimitKey).(*BodyLimit); ok {
+		return limit
+	}
+
+	return &BodyLimit{}
+}
+
+// limitRequestBody rejects requests larger than the limit by Content-Length,
+// others are limited while the transport reads them, see isRequestBodyTooLarge.
+func limitRequestBody(rw http.ResponseWriter, req *http.Request, limit *BodyLimit) error {
+	if limit.MaxRequestBodySize <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+
+	if req.ContentLength > limit.MaxRequestBodySize {
+		return requestEntityTooLarge(limit.MaxRequestBodySize)
+	}
+
+	// MaxBytesReader also tells the server to close the connection, the rest of the body is not read
+	req.Body = http.MaxBytesReader(rw, req.Body, limit.MaxRequestBodySize)
+	return nil
+}
+
+// isRequestBodyTooLarge returns true if the transport failed reading a request body
+// limited by limitRequestBody.
+func isRequestBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// limitResponseBody limits the response body, it returns an error if the response
+// must be aborted before the headers are sent.
+func limitResponseBody(res *http.Response, req *http.Request, limit *BodyLimit) error {
+	max := limit.MaxResponseBodySize
+	if max <= 0 || !hasResponseBody(res) {
+		return nil
+	}
+
+	truncate := limit.truncates(res)
+
+	if res.ContentLength > max {
+		if !truncate {
+			return &HTTPError{http.StatusBadGateway, fmt.Sprintf("upstream response body too large: %d bytes, max %d bytes", res.ContentLength, max)}
+		}
+
+		// logged by limitedResponseBody, when the limit is reached
+		res.ContentLength = max
+		res.Header.Set(headers.ContentLength, strconv.FormatInt(max, 10))
+	}
+
+	res.Body = &limitedResponseBody{
+		ReadCloser: res.Body,
+		remaining:  max,
+		max:        max,
+		truncate:   truncate,
+		req:        req,
+	}
+	return nil
+}
+
+// truncates returns true if the larger body of res is truncated instead of aborted,
+// a truncated encoded body can't be decoded, so it is always aborted.
+func (l *BodyLimit) truncates(res *http.Response) bool {
+	return l.TruncateResponseBody && contentcoding.IsIdentity(res.Header.Get(headers.ContentEncoding))
+}
+
+// errResponseBodyTooLarge aborts the copy of a streamed response larger than the limit.
+var errResponseBodyTooLarge = errors.New("upstream response body too large")
+
+type limitedResponseBody struct {
+	io.ReadCloser
+	remaining int64
+	max       int64
+	truncate  bool
+	req       *http.Request
+	exceeded  bool
+}
+
+func (b *limitedResponseBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, b.exceededErr()
+	}
+
+	if b.remaining == 0 {
+		// the limit is reached, the body is too large only if there is more
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n == 0 {
+			return 0, err
+		}
+
+		b.exceeded = true
+		if b.truncate {
+			log.Printf("truncate upstream response body: max %d bytes (%s %s)\n", b.max, b.req.Method, b.req.URL.String())
+		} else {
+			log.Printf("abort upstream response body: max %d bytes (%s %s)\n", b.max, b.req.Method, b.req.URL.String())
+		}
+		return 0, b.exceededErr()
+	}
+
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+func (b *limitedResponseBody) exceededErr() error {
+	if b.truncate {
+		return io.EOF
+	}
+
+	return fmt.Errorf("%w: max %d bytes", errResponseBodyTooLarge, b.max)
+}
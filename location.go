@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/rewriter"
+)
+
+// locationHeaders are the response headers pointing at a url.
+var locationHeaders = []string{
+	headers.Location,
+	headers.ContentLocation,
+}
+
+// rewriteLocationHeaders rewrites Location, Content-Location and Refresh headers
+// pointing at the upstream origin back to the client-facing origin,
+// like nginx proxy_redirect default.
+//
+//	reverse rewrites the path back, see rewriter.Rewriters.Reverse.
+func rewriteLocationHeaders(h http.Header, upstream *url.URL, inReq *http.Request, reverse rewriter.Rewriters) {
+	client := requestURL(inReq)
+
+	// every value, there may be more than one
+	for _, key := range locationHeaders {
+		for i, value := range h.Values(key) {
+			h[http.CanonicalHeaderKey(key)][i] = rewriteLocation(value, upstream, client, reverse)
+		}
+	}
+
+	for i, value := range h.Values("Refresh") {
+		h["Refresh"][i] = rewriteRefresh(value, upstream, client, reverse)
+	}
+}
+
+// rewriteRefresh rewrites the url of a Refresh value, like 5; url="https://upstream/path",
+// the quotes around the url are kept.
+func rewriteRefresh(refresh string, upstream, client *url.URL, reverse rewriter.Rewriters) string {
+	index := strings.Index(strings.ToLower(refresh), "url=")
+	if index == -1 {
+		return refresh
+	}
+
+	prefix, value := refresh[:index+4], strings.TrimSpace(refresh[index+4:])
+	quote := ""
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		quote, value = value[:1], value[1:len(value)-1]
+	}
+
+	return prefix + quote + rewriteLocation(value, upstream, client, reverse) + quote
+}
+
+func rewriteLocation(location string, upstream, client *url.URL, reverse rewriter.Rewriters) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+
+	if u.IsAbs() || u.Host != "" {
+		if !isSameOrigin(u, upstream) {
+			return location
+		}
+
+		u.Scheme = client.Scheme
+		u.Host = client.Host
+	} else if !strings.HasPrefix(u.Path, "/") {
+		// relative to the current path, nothing to do
+		return location
+	}
+
+	if len(reverse) != 0 {
+		u.Path = reverse.Rewrite(u.Path)
+		u.RawPath = ""
+	}
+
+	return u.String()
+}
+
+// isSameOrigin reports whether u is on the upstream origin, u without scheme means the same scheme.
+func isSameOrigin(u, upstream *url.URL) bool {
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = upstream.Scheme
+	}
+
+	if !strings.EqualFold(scheme, upstream.Scheme) || !strings.EqualFold(u.Hostname(), upstream.Hostname()) {
+		return false
+	}
+
+	return originPort(u.Port(), scheme) == originPort(upstream.Port(), upstream.Scheme)
+}
+
+func originPort(port, scheme string) string {
+	if port != "" {
+		return port
+	}
+
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+
+	return "80"
+}
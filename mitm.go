@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/proxy/utils/hostport"
+	"github.com/go-zoox/proxy/utils/matcher"
+	"golang.org/x/sync/singleflight"
+)
+
+// MITMConfig is the configuration for intercepting CONNECT tunnels of the forward proxy.
+//
+// TLS is terminated with a leaf certificate generated for the CONNECT host
+// and signed by CA, the decrypted requests go through OnRequest and OnResponse,
+// then they are sent to the real destination with TLS again.
+// Clients must trust CA, it is meant for debugging and test environments.
+type MITMConfig struct {
+	// CA is the certificate authority signing the leaf certificates,
+	//	like the result of tls.LoadX509KeyPair, its private key must be a crypto.Signer.
+	CA *tls.Certificate
+
+	// Bypass are the hosts tunneled untouched, like hosts with pinned certificates,
+	//	patterns like the routes of MultiHosts, see utils/matcher.
+	Bypass []string
+
+	// Validity is the validity of the leaf certificates, bounded by the validity of CA.
+	//	Default is 24h.
+	Validity time.Duration
+
+	// CacheSize is the max number of leaf certificates kept, the least recently used go first.
+	//	Default is 1000.
+	CacheSize int
+
+	// HandshakeTimeout is the timeout of the TLS handshake with the client.
+	//	Default is 30s.
+	HandshakeTimeout time.Duration
+}
+
+type mitm struct {
+	ca       *x509.Certificate
+	caKey    crypto.Signer
+	caChain  [][]byte
+	key      *ecdsa.PrivateKey
+	bypass   *matcher.Matcher
+	validity time.Duration
+	// handshakeTimeout is the timeout of the TLS handshake with the client
+	handshakeTimeout time.Duration
+
+	// generating concurrently for the same host, once
+	group singleflight.Group
+
+	sync.Mutex
+	// certs is the LRU cache of the leaf certificates, most recent first
+	certs       *list.List
+	certsByName map[string]*list.Element
+	cacheSize   int
+}
+
+type mitmCert struct {
+	name string
+	cert *tls.Certificate
+}
+
+func newMITM(cfg *MITMConfig) (*mitm, error) {
+	if cfg.CA == nil || len(cfg.CA.Certificate) == 0 {
+		return nil, errors.New("mitm: CA is required")
+	}
+
+	ca := cfg.CA.Leaf
+	if ca == nil {
+		var err error
+		if ca, err = x509.ParseCertificate(cfg.CA.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("mitm: invalid CA certificate: %v", err)
+		}
+	}
+
+	caKey, ok := cfg.CA.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("mitm: CA private key %T is not a crypto.Signer", cfg.CA.PrivateKey)
+	}
+
+	bypass, err := matcher.New(cfg.Bypass...)
+	if err != nil {
+		return nil, fmt.Errorf("mitm: bypass: %v", err)
+	}
+
+	// one key for all the leaf certificates, generating keys is the slow part
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	validity := cfg.Validity
+	if validity == 0 {
+		validity = 24 * time.Hour
+	}
+
+	handshakeTimeout := cfg.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = 30 * time.Second
+	}
+
+	cacheSize := cfg.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = 1000
+	}
+
+	return &mitm{
+		ca:               ca,
+		caKey:            caKey,
+		caChain:          cfg.CA.Certificate,
+		key:              key,
+		bypass:           bypass,
+		validity:         validity,
+		handshakeTimeout: handshakeTimeout,
+		certs:            list.New(),
+		certsByName:      map[string]*list.Element{},
+		cacheSize:        cacheSize,
+	}, nil
+}
+
+// isBypassed returns true if the tunnel to host must not be intercepted,
+// host is normalized like the hosts of ForwardPolicy.
+func (m *mitm) isBypassed(host string) bool {
+	_, ok := m.bypass.Match(normalizePolicyHost(host))
+	return ok
+}
+
+// tlsConfig returns the server config for the tunnel to host,
+// the certificate is for host, whatever the SNI server name, which is where requests go,
+// so clients can't have certificates minted for arbitrary names.
+func (m *mitm) tlsConfig(host string) *tls.Config {
+	name := hostport.Normalize(host)
+
+	return &tls.Config{
+		// the decrypted requests are served by net/http, which speaks http/1.1 here
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.certificate(name)
+		},
+	}
+}
+
+// certificate returns the cached leaf certificate for name, generated if missing or expiring,
+// out of the lock, so handshakes for other names are not blocked.
+func (m *mitm) certificate(name string) (*tls.Certificate, error) {
+	if cert := m.cached(name); cert != nil {
+		return cert, nil
+	}
+
+	v, err, _ := m.group.Do(name, func() (interface{}, error) {
+		if cert := m.cached(name); cert != nil {
+			return cert, nil
+		}
+
+		cert, err := m.generate(name)
+		if err != nil {
+			return nil, err
+		}
+
+		m.store(name, cert)
+		return cert, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return v.(*tls.Certificate), nil
+}
+
+// cached returns the certificate for name, nil if missing or expiring.
+func (m *mitm) cached(name string) *tls.Certificate {
+	m.Lock()
+	defer m.Unlock()
+
+	element, ok := m.certsByName[name]
+	if !ok {
+		return nil
+	}
+
+	cert := element.Value.(*mitmCert).cert
+	if !time.Now().Add(time.Hour).Before(cert.Leaf.NotAfter) {
+		return nil
+	}
+
+	m.certs.MoveToFront(element)
+	return cert
+}
+
+// store caches the certificate for name, evicting the least recently used ones.
+func (m *mitm) store(name string, cert *tls.Certificate) {
+	m.Lock()
+	defer m.Unlock()
+
+	if element, ok := m.certsByName[name]; ok {
+		element.Value.(*mitmCert).cert = cert
+		m.certs.MoveToFront(element)
+		return
+	}
+
+	m.certsByName[name] = m.certs.PushFront(&mitmCert{name, cert})
+	for m.certs.Len() > m.cacheSize {
+		oldest := m.certs.Back()
+		m.certs.Remove(oldest)
+		delete(m.certsByName, oldest.Value.(*mitmCert).name)
+	}
+}
+
+func (m *mitm) generate(name string) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	notAfter := now.Add(m.validity)
+	if notAfter.After(m.ca.NotAfter) {
+		notAfter = m.ca.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		// clock skew between the proxy and the clients
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    notAfter,
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{name}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, m.ca, &m.key.PublicKey, m.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("mitm: failed to generate certificate for %s: %v", name, err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: append([][]byte{der}, m.caChain...),
+		PrivateKey:  m.key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// serveMITM terminates TLS on the tunnel to addr, host:port, and serves the
+// decrypted requests, the connection is owned by the server from now on.
+func (r *Proxy) serveMITM(conn net.Conn, addr string) {
+	host, _, _ := net.SplitHostPort(addr)
+
+	tlsConn := tls.Server(conn, r.forward.mitm.tlsConfig(host))
+	conn.SetDeadline(time.Now().Add(r.forward.mitm.handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("mitm handshake with %s for %s failed: %v", conn.RemoteAddr(), addr, err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	r.serveTunnelHTTP(tlsConn, "https", addr)
+}
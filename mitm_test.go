@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestCA(t *testing.T) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "go-zoox proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour * 24),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMITM(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	ca := newTestCA(t)
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	for _, bypass := range []bool{false, true} {
+		mitmCfg := &MITMConfig{CA: ca}
+		if bypass {
+			mitmCfg.Bypass = []string{`^127\.0\.0\.1$`}
+		}
+
+		p := New(&Config{
+			Forward: &ForwardConfig{MITM: mitmCfg},
+			OnRequest: func(req, inReq *http.Request) error {
+				req.URL.Path = "/intercepted" + req.URL.Path
+				return nil
+			},
+			OnResponse: func(res *http.Response, inReq *http.Request) error {
+				res.Header.Set("X-Intercepted", "true")
+				return nil
+			},
+		})
+		// the backend certificate is self-signed
+		p.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		proxyServer := httptest.NewServer(p)
+		defer proxyServer.Close()
+		proxyURL, _ := url.Parse(proxyServer.URL)
+
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if bypass {
+			tlsConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		client := &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyURL(proxyURL),
+				TLSClientConfig: tlsConfig,
+			},
+		}
+
+		for i := 0; i < 2; i++ {
+			res, err := client.Get(backend.URL + "/foo")
+			if err != nil {
+				t.Fatalf("bypass %v: %v", bypass, err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+
+			expected := "hello /intercepted/foo"
+			if bypass {
+				expected = "hello /foo"
+			}
+			if string(body) != expected {
+				t.Errorf("bypass %v: got %q; expected %q", bypass, body, expected)
+			}
+
+			if intercepted := res.Header.Get("X-Intercepted") == "true"; intercepted == bypass {
+				t.Errorf("bypass %v: got intercepted %v", bypass, intercepted)
+			}
+
+			peer := res.TLS.PeerCertificates[0]
+			if bypass != peer.Equal(backend.Certificate()) {
+				t.Errorf("bypass %v: got certificate of %q", bypass, peer.Subject.CommonName)
+			}
+			if !bypass && peer.VerifyHostname(backendURL.Hostname()) != nil {
+				t.Errorf("expected the generated certificate to be valid for %s", backendURL.Hostname())
+			}
+		}
+
+		if !bypass && p.forward.mitm.certs.Len() != 1 {
+			t.Errorf("got %d cached certificates; expected 1", p.forward.mitm.certs.Len())
+		}
+	}
+}
+
+func TestMITMCertificates(t *testing.T) {
+	m, err := newMITM(&MITMConfig{CA: newTestCA(t), CacheSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate is for the CONNECT host, whatever the server name
+	cert, err := m.tlsConfig("Example.com").GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := cert.Leaf.DNSNames; len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("got names %v; expected example.com", names)
+	}
+
+	// least recently used first out
+	for _, name := range []string{"a.example.com", "example.com", "b.example.com"} {
+		if _, err := m.certificate(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := m.certsByName["a.example.com"]; ok || m.certs.Len() != 2 {
+		t.Errorf("got %d cached certificates, with a.example.com %v; expected 2 without it", m.certs.Len(), ok)
+	}
+	if again, _ := m.certificate("example.com"); again != cert {
+		t.Errorf("expected the cached certificate")
+	}
+}
+
+func TestMITMBypass(t *testing.T) {
+	m, err := newMITM(&MITMConfig{CA: newTestCA(t), Bypass: []string{`^pinned\.example\.com$`, `^::1$`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"pinned.example.com", "PINNED.example.com", "pinned.example.com.", "[::1]", "0:0::1"} {
+		if !m.isBypassed(host) {
+			t.Errorf("expected %s to be bypassed", host)
+		}
+	}
+	if m.isBypassed("other.example.com") {
+		t.Errorf("expected other.example.com to be intercepted")
+	}
+}
+
+func TestMITMHandshakeTimeout(t *testing.T) {
+	p := NewForward(&ForwardConfig{MITM: &MITMConfig{CA: newTestCA(t), HandshakeTimeout: 50 * time.Millisecond}})
+	proxyServer := httptest.NewServer(p)
+	defer proxyServer.Close()
+
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d; expected %d", res.StatusCode, http.StatusOK)
+	}
+
+	// silent clients are disconnected
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Errorf("expected the proxy to close the connection, got %v", err)
+	}
+}
+
+func TestMITMInvalidCA(t *testing.T) {
+	p := NewForward(&ForwardConfig{MITM: &MITMConfig{}})
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		t.Errorf("expected requests to fail with an invalid CA")
+	}
+}
@@ -2,20 +2,27 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"strings"
+	"net/url"
+	"strconv"
 
 	"github.com/go-zoox/cache"
-	"github.com/go-zoox/core-utils/regexp"
 	"github.com/go-zoox/headers"
 	"github.com/go-zoox/logger"
+	"github.com/go-zoox/proxy/utils/hostport"
+	"github.com/go-zoox/proxy/utils/matcher"
 	"github.com/go-zoox/proxy/utils/rewriter"
 )
 
 // MultiHostsConfig ...
 type MultiHostsConfig struct {
 	Routes []MultiHostsRoute `json:"routes"`
+	// Forwarded resolves the client IP behind trusted proxies, see ForwardedConfig.
+	//	Default is nil, which trusts the X-Forwarded-* of all the clients, see Config.Forwarded.
+	Forwarded *ForwardedConfig `json:"forwarded"`
 }
 
 // MultiHostsRoute ...
@@ -31,48 +38,80 @@ type MultiHostsRouteBackend struct {
 	ServicePort     int64  `json:"service_port"`
 	// Request
 	Rewriters rewriter.Rewriters `json:"rewriters"`
+	Redirects rewriter.Redirects `json:"redirects"`
 	Headers   http.Header        `json:"headers"`
 	//
 	ResponseHeaders http.Header `json:"response_headers"`
+	// RewriteLocation rewrites Location, Content-Location and Refresh headers
+	// pointing at the backend back to the route host, like nginx proxy_redirect default.
+	RewriteLocation bool `json:"rewrite_location"`
+	// CookieRewrite rewrites Set-Cookie headers from the backend.
+	CookieRewrite *CookieRewrite `json:"cookie_rewrite"`
+	// BodyLimit limits the request and response body sizes of the route.
+	BodyLimit *BodyLimit `json:"body_limit"`
+	// UpstreamProtocol is the protocol to the backend, http1, h2 or h2c,
+	// see Config.UpstreamProtocol.
+	UpstreamProtocol string `json:"upstream_protocol"`
+	// GRPC enables the gRPC mode for the route, see Config.GRPC.
+	GRPC bool `json:"grpc"`
+	// Transcode transcodes REST/JSON requests to gRPC calls for the route, see TranscodeConfig.
+	Transcode *TranscodeConfig `json:"transcode"`
+
+	transcoder        *Transcoder
+	reversedRewriters rewriter.Rewriters
 }
 
 // NewMultiHosts ...
+//
+// Route hosts and backend rewriters are compiled once here, see Proxy.Err for the errors.
+// A route with an invalid host never matches, and the requests of a route with an invalid backend
+// fail with the compile error, the other routes keep serving.
 func NewMultiHosts(cfg *MultiHostsConfig) *Proxy {
-	return New(&Config{
+	routes, compileErr := compileRoutes(cfg)
+
+	p := New(&Config{
 		IsAnonymouse: false,
+		Forwarded:    cfg.Forwarded,
 		OnContext: func(ctx context.Context) (context.Context, error) {
 			return context.WithValue(ctx, stateKey, cache.New()), nil
 		},
 		OnRequest: func(req, originReq *http.Request) error {
 			state := req.Context().Value(stateKey).(cache.Cache)
 			hostname := getHostname(originReq)
-			route, err := getRoute(cfg, hostname)
+			index, err := getRoute(routes, hostname)
 			if err != nil {
 				return err
 			}
-			if err := state.Set("route", route); err != nil {
+			if err := state.Set("route", &index); err != nil {
 				return err
 			}
+			route := &cfg.Routes[index]
 
-			req.URL.Scheme = route.Backend.ServiceProtocol
-			if req.URL.Scheme == "" {
-				req.URL.Scheme = "http"
+			if err := redirect(route.Backend.Redirects, originReq); err != nil {
+				return err
 			}
 
-			req.URL.Host = fmt.Sprintf("%s:%d", route.Backend.ServiceName, route.Backend.ServicePort)
+			SetBodyLimit(req, route.Backend.BodyLimit)
+			SetUpstreamProtocol(req, route.Backend.UpstreamProtocol)
+			SetGRPC(req, route.Backend.GRPC)
+			SetTranscoder(req, route.Backend.transcoder)
+			SetUpgradeRoute(req, route.Host)
+
+			backend := route.Backend.url()
+			req.URL.Scheme = backend.Scheme
+			req.URL.Host = backend.Host
 			req.URL.Path = route.Backend.Rewriters.Rewrite(req.URL.Path)
 
-			logger.Infof("[%s][%s => %s://%s] %s %s", req.RemoteAddr, hostname, req.URL.Scheme, req.URL.Host, req.Method, req.URL.Path)
+			logger.Infof("[%s][%s => %s://%s] %s %s", ClientIP(req), hostname, req.URL.Scheme, req.URL.Host, req.Method, req.URL.Path)
 
 			for k, v := range route.Backend.Headers {
 				req.Header.Set(k, v[0])
 			}
 
-			// origin
-			switch route.Backend.ServicePort {
-			case 80, 443:
-				req.Header.Set(headers.Host, route.Backend.ServiceName)
-			default:
+			// origin, without the default port of the scheme
+			if host, port := ParseHostPort(backend.Host, backend.Scheme); port == hostport.DefaultPort(backend.Scheme) {
+				req.Header.Set(headers.Host, hostport.Join(host, ""))
+			} else {
 				req.Header.Set(headers.Host, req.URL.Host)
 			}
 
@@ -80,10 +119,19 @@ func NewMultiHosts(cfg *MultiHostsConfig) *Proxy {
 		},
 		OnResponse: func(res *http.Response, originReq *http.Request) error {
 			state := res.Request.Context().Value(stateKey).(cache.Cache)
-			route := &MultiHostsRoute{}
-			if err := state.Get("route", route); err != nil {
+			var index int
+			if err := state.Get("route", &index); err != nil {
 				return err
 			}
+			route := &cfg.Routes[index]
+
+			if route.Backend.RewriteLocation {
+				rewriteLocationHeaders(res.Header, route.Backend.url(), originReq, route.Backend.reversedRewriters)
+			}
+
+			if route.Backend.CookieRewrite != nil {
+				route.Backend.CookieRewrite.Rewrite(res.Header)
+			}
 
 			for k, v := range route.Backend.ResponseHeaders {
 				res.Header.Set(k, v[0])
@@ -92,54 +140,123 @@ func NewMultiHosts(cfg *MultiHostsConfig) *Proxy {
 			return nil
 		},
 	})
-}
 
-func getRoute(cfg *MultiHostsConfig, hostname string) (*MultiHostsRoute, error) {
-	for _, route := range cfg.Routes {
-		if ok := regexp.Match(route.Host, hostname); ok {
-			return &route, nil
-		}
+	// only fails the requests of the invalid routes
+	if compileErr != nil {
+		log.Printf("error: %s\n", compileErr)
+		p.routesErr = compileErr
 	}
 
-	return nil, fmt.Errorf("route(%s) not found", hostname)
+	return p
 }
 
-func getHostname(req *http.Request) string {
-	host, _ := splitHostPort(req.Host)
-	return host
+// url returns the backend origin.
+func (b *MultiHostsRouteBackend) url() *url.URL {
+	scheme := b.ServiceProtocol
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	port := ""
+	if b.ServicePort != 0 {
+		port = strconv.FormatInt(b.ServicePort, 10)
+	}
+
+	return &url.URL{
+		Scheme: scheme,
+		Host:   hostport.Join(b.ServiceName, port),
+	}
 }
 
-// splitHostPort separates host and port. If the port is not valid, it returns
-// the entire input as host, and it doesn't check the validity of the host.
-// Unlike net.SplitHostPort, but per RFC 3986, it requires ports to be numeric.
-func splitHostPort(hostPort string) (host, port string) {
-	host = hostPort
+func (b *MultiHostsRouteBackend) compile() error {
+	if err := checkUpstreamProtocol(b.UpstreamProtocol); err != nil {
+		return err
+	}
+
+	if b.Transcode != nil {
+		transcoder, err := NewTranscoder(b.Transcode)
+		if err != nil {
+			return err
+		}
+		b.transcoder = transcoder
+	}
+
+	if err := b.Rewriters.Compile(); err != nil {
+		return err
+	}
+	b.reversedRewriters = b.Rewriters.Reverse()
 
-	colon := strings.LastIndexByte(host, ':')
-	if colon != -1 && validOptionalPort(host[colon:]) {
-		host, port = host[:colon], host[colon+1:]
+	if err := b.Redirects.Compile(); err != nil {
+		return err
 	}
 
-	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
-		host = host[1 : len(host)-1]
+	if b.CookieRewrite != nil {
+		if err := b.CookieRewrite.Compile(); err != nil {
+			return err
+		}
 	}
 
-	return
+	return nil
+}
+
+// multiHostsRoutes is the compiled route table.
+type multiHostsRoutes struct {
+	matcher *matcher.Matcher
+	// indexes maps the matched patterns to the routes, invalid hosts are left out
+	indexes []int
+	// errs are the backend compile errors, by route
+	errs []error
 }
 
-// validOptionalPort reports whether port is either an empty string
-// or matches /^:\d*$/
-func validOptionalPort(port string) bool {
-	if port == "" {
-		return true
+func compileRoutes(cfg *MultiHostsConfig) (*multiHostsRoutes, error) {
+	routes := &multiHostsRoutes{
+		errs: make([]error, len(cfg.Routes)),
+	}
+
+	var hosts []string
+	var errs []error
+	for i := range cfg.Routes {
+		host := cfg.Routes[i].Host
+		if _, err := matcher.New(host); err != nil {
+			errs = append(errs, fmt.Errorf("route(%s): %v", host, err))
+			continue
+		}
+
+		hosts = append(hosts, host)
+		routes.indexes = append(routes.indexes, i)
+
+		if err := cfg.Routes[i].Backend.compile(); err != nil {
+			routes.errs[i] = fmt.Errorf("route(%s): %v", host, err)
+			errs = append(errs, routes.errs[i])
+		}
 	}
-	if port[0] != ':' {
-		return false
+
+	m, err := matcher.New(hosts...)
+	if err != nil {
+		return nil, err
 	}
-	for _, b := range port[1:] {
-		if b < '0' || b > '9' {
-			return false
+	routes.matcher = m
+
+	return routes, errors.Join(errs...)
+}
+
+// getRoute returns the index of the route of hostname.
+func getRoute(routes *multiHostsRoutes, hostname string) (int, error) {
+	if index, ok := routes.matcher.Match(hostname); ok {
+		index = routes.indexes[index]
+		if err := routes.errs[index]; err != nil {
+			return -1, err
 		}
+
+		return index, nil
 	}
-	return true
+
+	return -1, fmt.Errorf("route(%s) not found", hostname)
+}
+
+// getHostname returns the normalized hostname of the request to match the routes,
+// IDNA hostnames are in their ASCII form, see hostport.Normalize.
+func getHostname(req *http.Request) string {
+	host, _ := hostport.Split(req.Host)
+	return hostport.Normalize(host)
 }
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/go-zoox/proxy/utils/proxyprotocol"
+)
+
+const clientAddrKey key = "client_addr"
+
+// withUpstreamProxyProtocol returns a transport sending a PROXY header of version
+// on the upstream connections, with the client address of the request.
+//
+// The connections carry the address of one client, so they are not reused,
+// keep-alive to the upstreams is disabled.
+func withUpstreamProxyProtocol(rt http.RoundTripper, version int) (http.RoundTripper, error) {
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("upstream proxy protocol: unsupported version %d", version)
+	}
+
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	transport, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("upstream proxy protocol: unsupported transport %T", rt)
+	}
+
+	transport = transport.Clone()
+	transport.DisableKeepAlives = true
+
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		header := &proxyprotocol.Header{Version: version}
+		if clientAddr, ok := ctx.Value(clientAddrKey).(string); ok {
+			header.Source = parseTCPAddr(clientAddr)
+		}
+		if localAddr, ok := ctx.Value(http.LocalAddrContextKey).(net.Addr); ok {
+			header.Destination = parseTCPAddr(localAddr.String())
+		}
+
+		if _, err := header.WriteTo(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return conn, nil
+	}
+
+	return transport, nil
+}
+
+// parseTCPAddr parses addr, ip:port, nil if invalid.
+func parseTCPAddr(addr string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// writeProxyProtocol writes the PROXY header of version for conn to upstream,
+// version 0 writes nothing.
+func writeProxyProtocol(upstream net.Conn, conn net.Conn, version int) error {
+	if version == 0 {
+		return nil
+	}
+
+	header := &proxyprotocol.Header{
+		Version:     version,
+		Source:      conn.RemoteAddr(),
+		Destination: conn.LocalAddr(),
+	}
+	if _, err := header.WriteTo(upstream); err != nil {
+		log.Printf("stream proxy protocol to %s failed: %v", upstream.RemoteAddr(), err)
+		return err
+	}
+
+	return nil
+}
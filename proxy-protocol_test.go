@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-zoox/proxy/utils/proxyprotocol"
+)
+
+func TestProxyProtocol(t *testing.T) {
+	// the upstream accepts PROXY headers from the proxy
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		w.Write([]byte(host + " " + r.Header.Get("X-Forwarded-For")))
+	}))
+	l, err := proxyprotocol.NewListener(backend.Listener, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Listener = l
+	backend.Start()
+	defer backend.Close()
+
+	for _, version := range []int{1, 2} {
+		// the proxy is behind a balancer sending PROXY headers
+		front := httptest.NewUnstartedServer(NewSingleHost(backend.URL, &SingleHostConfig{
+			UpstreamProxyProtocol: version,
+		}))
+		l, _ := proxyprotocol.NewListener(front.Listener, "127.0.0.0/8")
+		front.Listener = l
+		front.Start()
+
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 51234 80\r\n"))
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		conn.Close()
+		front.Close()
+
+		if expected := "203.0.113.7 203.0.113.7"; string(body) != expected {
+			t.Errorf("version %d: got %q; expected %q", version, body, expected)
+		}
+	}
+
+	p := New(&Config{UpstreamProxyProtocol: 3})
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got status %d; expected %d for an invalid version", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestStreamProxyProtocol(t *testing.T) {
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	pl, _ := proxyprotocol.NewListener(upstream, "127.0.0.1")
+	go func() {
+		conn, err := pl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(conn.RemoteAddr().String()))
+	}()
+
+	s := NewStream(&StreamConfig{
+		Upstreams:             []string{upstream.Addr().String()},
+		UpstreamProxyProtocol: 2,
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.ServeTCP(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	got, _ := io.ReadAll(conn)
+	if string(got) != conn.LocalAddr().String() {
+		t.Errorf("got %q; expected the client address %s", got, conn.LocalAddr())
+	}
+}
@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -26,6 +27,21 @@ type Proxy struct {
 	OnRequest  func(req, originReq *http.Request) error
 	OnResponse func(res *http.Response, originReq *http.Request) error
 	OnError    func(err error, rw http.ResponseWriter, req *http.Request)
+	// OnWebSocketMessage is called with the messages of WebSocket connections, see Config.OnWebSocketMessage.
+	OnWebSocketMessage func(msg *WebSocketMessage, conn *WebSocketConn) error
+
+	// FlushInterval specifies the flush interval
+	// to flush to the client while copying the
+	// response body.
+	// If zero, no periodic flushing is done.
+	// A negative value means to flush immediately
+	// after each write to the client.
+	// The FlushInterval is ignored when Proxy
+	// recognizes a response as a streaming response, or
+	// if its ContentLength is -1; for such responses, writes
+	// are flushed to the client immediately.
+	// See Config.Streaming to tune it per content type.
+	FlushInterval time.Duration
 
 	// IsAnonymouse is a flag to indicate whether the proxy is anonymouse.
 	//	which means the proxy will not add headers:
@@ -41,6 +57,25 @@ type Proxy struct {
 
 	bufferPool   BufferPool
 	isAnonymouse bool
+	compression  *CompressionConfig
+	bodyLimit    *BodyLimit
+	forward      *forwardProxy
+	forwarded    *forwardedResolver
+	// err is the config error, returned on every request
+	err error
+	// routesErr is the compile error of the routes of NewMultiHosts, only their requests fail
+	routesErr error
+	// upstreamProxyProtocol is the PROXY protocol version sent to the upstreams, 0 for none
+	upstreamProxyProtocol int
+	upstreamProtocol      string
+	protocolTransports    upstreamTransports
+	grpc                  bool
+	grpcWeb               *GRPCWebConfig
+	transcoder            *Transcoder
+	webSocket             *WebSocketConfig
+	upgrades              *upgradeRegistry
+	sse                   *SSEConfig
+	streaming             []StreamingRule
 }
 
 // Config is the configuration for the Proxy.
@@ -65,6 +100,95 @@ type Config struct {
 
 	// OnError is a function that will be called when an error occurs.
 	OnError func(err error, rw http.ResponseWriter, req *http.Request)
+
+	// OnWebSocketMessage is called with every message of WebSocket connections, in both directions,
+	// it can modify the message, drop it with ErrDropWebSocketMessage, inject messages
+	// with the conn, or close it with a WebSocketCloseError.
+	// It is called concurrently for both directions.
+	// Setting it enables the WebSocket-aware mode, see WebSocketConfig.
+	OnWebSocketMessage func(msg *WebSocketMessage, conn *WebSocketConn) error
+
+	// WebSocket enables the WebSocket-aware mode, with limits, see WebSocketConfig.
+	// Default is nil, which means upgraded connections are copied as is,
+	// unless OnWebSocketMessage is set.
+	WebSocket *WebSocketConfig
+
+	// Upgrade configures the hooks and timeouts of upgraded connections, like WebSockets,
+	// see UpgradeConfig. They are tracked whatever the config, see Proxy.UpgradedConns.
+	// Default is nil, which means no hooks and no timeouts.
+	Upgrade *UpgradeConfig
+
+	// SSE enables the Server-Sent Events mode, with event hooks, heartbeats
+	// and reconnections to the upstream, see SSEConfig.
+	// Default is nil, which means event streams are copied as is, flushed immediately.
+	SSE *SSEConfig
+
+	// FlushInterval is the flush interval while copying response bodies, see Proxy.FlushInterval.
+	// Default is 0, which means no periodic flushing, streams are flushed immediately.
+	FlushInterval time.Duration
+
+	// Streaming is how responses are streamed or buffered, by content type,
+	// the first matching rule applies, see StreamingRule.
+	// gRPC and event streams are never buffered, and always flushed immediately.
+	// Default is nil, which means FlushInterval for all the responses.
+	Streaming []StreamingRule
+
+	// BufferResponses buffers the responses not matching Streaming,
+	// so OnResponse sees complete bodies, like a */* rule with Buffer,
+	// up to DefaultMaxBufferSize, larger bodies are streamed.
+	// Default is false.
+	BufferResponses bool
+
+	// Compression enables compressing responses at the proxy, see CompressionConfig.
+	// Default is nil, which means responses are passed through as is.
+	Compression *CompressionConfig
+
+	// BodyLimit limits the request and response body sizes, see BodyLimit,
+	// it can be overridden per request in OnRequest with SetBodyLimit.
+	// Default is nil, which means no limit.
+	BodyLimit *BodyLimit
+
+	// Forwarded configures the client address behind trusted proxies,
+	// and the Forwarded header, see ForwardedConfig.
+	// Default is nil, which means X-Forwarded-* of all the clients are trusted:
+	// WARNING, without it, clients can spoof X-Forwarded-For and X-Real-IP, set it
+	// with empty TrustedProxies to strip these headers when the proxy faces the clients.
+	Forwarded *ForwardedConfig
+
+	// Forward enables the forward proxy mode, see ForwardConfig.
+	// Default is nil, which means reverse proxy only.
+	Forward *ForwardConfig
+
+	// GRPC enables the gRPC mode for requests with Content-Type application/grpc:
+	// HTTP/2 to the upstreams, h2c without TLS if UpstreamProtocol is empty,
+	// TE: trailers, no buffering, deadlines from grpc-timeout, and errors answered
+	// as grpc-status and grpc-message instead of OnError.
+	// It can be enabled per request in OnRequest with SetGRPC.
+	// Default is false.
+	GRPC bool
+
+	// GRPCWeb translates gRPC-Web requests of browsers to gRPC, see GRPCWebConfig.
+	// Default is nil, which means gRPC-Web is proxied as is.
+	GRPCWeb *GRPCWebConfig
+
+	// Transcode transcodes REST/JSON requests to gRPC calls, with the google.api.http rules
+	// of the descriptors, see TranscodeConfig,
+	// it can be overridden per request in OnRequest with SetTranscoder.
+	// Default is nil, which means no transcoding.
+	Transcode *TranscodeConfig
+
+	// UpstreamProtocol is the protocol to the upstreams, http1, h2 for HTTP/2 over TLS,
+	// or h2c for HTTP/2 over cleartext TCP, like for gRPC services without TLS,
+	// it can be overridden per request in OnRequest with SetUpstreamProtocol.
+	// Default is empty, which means Transport, HTTP/2 if negotiated with TLS upstreams.
+	UpstreamProtocol string
+
+	// UpstreamProxyProtocol sends a PROXY protocol header of this version, 1 or 2,
+	// on the upstream connections, for upstreams behind the proxy expecting it,
+	// the source is the client address, see utils/proxyprotocol to accept it.
+	// Keep-alive to the upstreams is disabled, connections are per client.
+	// Default is 0, which means no header.
+	UpstreamProxyProtocol int
 }
 
 // New creates a new Proxy.
@@ -75,28 +199,125 @@ func New(cfg *Config) *Proxy {
 		OnResponse:   cfg.OnResponse,
 		OnError:      cfg.OnError,
 		isAnonymouse: cfg.IsAnonymouse,
+		compression:  cfg.Compression,
+		bodyLimit:    cfg.BodyLimit,
+		forwarded:    newForwardedResolver(cfg.Forwarded),
+
+		upstreamProtocol: cfg.UpstreamProtocol,
+		grpc:             cfg.GRPC,
+		grpcWeb:          cfg.GRPCWeb,
+		webSocket:        cfg.WebSocket,
+		upgrades:         newUpgradeRegistry(cfg.Upgrade),
+		sse:              cfg.SSE,
+		streaming:        cfg.Streaming,
+
+		OnWebSocketMessage: cfg.OnWebSocketMessage,
+		FlushInterval:      cfg.FlushInterval,
+	}
+
+	if cfg.BufferResponses {
+		p.streaming = append(append([]StreamingRule{}, cfg.Streaming...), StreamingRule{ContentType: "*/*", Buffer: true, MaxBufferSize: DefaultMaxBufferSize})
 	}
 
 	if p.OnError == nil {
 		p.OnError = defaultOnError
 	}
 
+	if cfg.Forward != nil {
+		p.forward = newForwardProxy(cfg.Forward)
+		p.Transport = p.forward.transport()
+	}
+
+	if p.forwarded.err != nil {
+		log.Printf("error: %s\n", p.forwarded.err)
+		p.err = p.forwarded.err
+	}
+
+	if err := checkUpstreamProtocol(cfg.UpstreamProtocol); err != nil {
+		log.Printf("error: %s\n", err)
+		p.err = err
+	}
+
+	if cfg.Transcode != nil {
+		transcoder, err := NewTranscoder(cfg.Transcode)
+		if err != nil {
+			log.Printf("error: %s\n", err)
+			p.err = err
+		}
+		p.transcoder = transcoder
+	}
+
+	if cfg.UpstreamProxyProtocol != 0 {
+		transport, err := withUpstreamProxyProtocol(p.Transport, cfg.UpstreamProxyProtocol)
+		if err != nil {
+			log.Printf("error: %s\n", err)
+			p.err = err
+		} else {
+			p.Transport = transport
+			p.upstreamProxyProtocol = cfg.UpstreamProxyProtocol
+		}
+	}
+
 	return p
 }
 
+// Err returns the config errors found when the proxy was created, nil if there is none.
+//
+// The errors are also logged, see NewSingleHost and NewMultiHosts for how the requests fail.
+func (r *Proxy) Err() error {
+	return errors.Join(r.err, r.routesErr)
+}
+
 // ServeHTTP is the entry point for the proxy.
 func (r *Proxy) ServeHTTP(rw http.ResponseWriter, inReq *http.Request) {
+	if r.forward != nil && !r.handleForward(rw, inReq) {
+		return
+	}
+
+	if r.grpcWeb != nil && isGRPCWebRequest(inReq) {
+		r.serveGRPCWeb(rw, inReq)
+		return
+	}
+
+	r.serve(rw, inReq)
+}
+
+// serve proxies the request through the hooks.
+func (r *Proxy) serve(rw http.ResponseWriter, inReq *http.Request) {
 	ctx := inReq.Context()
+	// translated gRPC-Web is gRPC
+	_, grpcWeb := ctx.Value(grpcWebKey).(bool)
+	ctx = withGRPC(ctx, r.grpc || grpcWeb)
+
+	if r.err != nil {
+		r.onError(ctx, r.err, rw, inReq)
+		return
+	}
+
+	ctx = context.WithValue(ctx, clientIPKey, r.forwarded.clientIP(inReq))
+	ctx = context.WithValue(ctx, schemeKey, r.forwarded.scheme(inReq))
+	// the hooks see the resolved client IP and scheme of inReq too
+	inReq = inReq.WithContext(ctx)
+	ctx = withUpstreamProtocol(ctx, r.upstreamProtocol)
+	if r.upstreamProxyProtocol != 0 {
+		ctx = context.WithValue(ctx, clientAddrKey, inReq.RemoteAddr)
+	}
 
 	if r.OnContext != nil {
 		var err error
 		ctx, err = r.OnContext(ctx)
 		if err != nil {
-			r.OnError(err, rw, inReq)
+			r.onError(ctx, err, rw, inReq)
 			return
 		}
 	}
 
+	// per request, so OnRequest can override it
+	ctx = withBodyLimit(ctx, r.bodyLimit)
+	bodyLimit := getBodyLimit(ctx)
+	ctx = withTranscoder(ctx, r.transcoder)
+	ctx = withUpgradeRoute(ctx)
+
 	if cn, ok := rw.(http.CloseNotifier); ok {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithCancel(ctx)
@@ -115,7 +336,37 @@ func (r *Proxy) ServeHTTP(rw http.ResponseWriter, inReq *http.Request) {
 	// create outReq by origin outReq
 	outReq, err := r.createRequest(ctx, rw, inReq)
 	if err != nil {
-		r.OnError(err, rw, inReq)
+		// answer redirects directly, without contacting the upstream
+		if redirect, ok := err.(*RedirectError); ok {
+			writeRedirect(rw, inReq, redirect)
+			return
+		}
+
+		r.onError(ctx, err, rw, inReq)
+		return
+	}
+	// REST requests matching the rules become gRPC calls
+	if err := transcodeRequest(outReq, bodyLimit.MaxRequestBodySize); err != nil {
+		r.onError(ctx, err, rw, inReq)
+		return
+	}
+	transcoded := getTranscodeState(ctx)
+	grpc := isGRPC(ctx, outReq)
+	if grpc {
+		var cancel context.CancelFunc
+		if outReq, cancel, err = prepareGRPCRequest(outReq, inReq); err != nil {
+			r.onError(ctx, err, rw, inReq)
+			return
+		}
+		defer cancel()
+	}
+	if err := limitRequestBody(rw, outReq, bodyLimit); err != nil {
+		r.onError(ctx, err, rw, inReq)
+		return
+	}
+	r.prepareWebSocketRequest(outReq)
+	if upgradeType(outReq.Header) != "" && r.upgrades.isDraining(getUpgradeRoute(ctx)) {
+		r.onError(ctx, NewHTTPError(http.StatusServiceUnavailable, "upgraded connections are draining"), rw, inReq)
 		return
 	}
 	if outReq.Body != nil {
@@ -131,10 +382,29 @@ func (r *Proxy) ServeHTTP(rw http.ResponseWriter, inReq *http.Request) {
 	// create outRes by execute request
 	outRes, err := r.createResponse(rw, outReq)
 	if err != nil {
-		r.OnError(err, rw, outReq)
+		if isRequestBodyTooLarge(err) {
+			err = requestEntityTooLarge(bodyLimit.MaxRequestBodySize)
+		}
+
+		r.onError(ctx, err, rw, outReq)
+		return
+	}
+
+	// gRPC answers with 200, other statuses are from proxies or non-gRPC servers
+	if grpc && outRes.StatusCode != http.StatusOK {
+		outRes.Body.Close()
+		r.onError(ctx, NewHTTPError(outRes.StatusCode, fmt.Sprintf("upstream answered %s", outRes.Status)), rw, outReq)
 		return
 	}
 
+	// back to JSON, before OnResponse
+	if transcoded != nil {
+		if err := transcoded.transcodeResponse(outRes, bodyLimit.MaxResponseBodySize); err != nil {
+			r.onError(ctx, err, rw, outReq)
+			return
+		}
+	}
+
 	// Deal with 101 Switchoing Protocols response: WebSocket, h2c, etc
 	if outRes.StatusCode == http.StatusSwitchingProtocols {
 		if !r.modifyResponse(rw, outRes, outReq, inReq) {
@@ -161,11 +431,40 @@ func (r *Proxy) ServeHTTP(rw http.ResponseWriter, inReq *http.Request) {
 	//	1. clean
 	cleanResponseHeaders(outRes.Header)
 
+	// buffer before OnResponse, so it sees the complete body
+	if err := r.bufferResponse(outRes, outReq, bodyLimit); err != nil {
+		outRes.Body.Close()
+		r.onError(ctx, err, rw, outReq)
+		return
+	}
+
 	// modify response
 	if !r.modifyResponse(rw, outRes, outReq, inReq) {
 		return
 	}
 
+	// limit after OnResponse, which may replace the body
+	if err := limitResponseBody(outRes, outReq, bodyLimit); err != nil {
+		outRes.Body.Close()
+		r.onError(ctx, err, rw, outReq)
+		return
+	}
+
+	// decide flushing before compressing, which drops Content-Length
+	flushInterval := r.flushInterval(outRes)
+
+	// compress
+	var cw *compressWriter
+	if encoding := r.compressResponse(outRes, inReq); encoding != "" {
+		if cw, err = newCompressWriter(rw, encoding); err != nil {
+			outRes.Body.Close()
+			r.onError(ctx, err, rw, outReq)
+			return
+		}
+		// release the encoder on copy errors too
+		defer cw.Close()
+	}
+
 	//  2. copy
 	copyHeader(rw.Header(), outRes.Header)
 
@@ -185,9 +484,27 @@ func (r *Proxy) ServeHTTP(rw http.ResponseWriter, inReq *http.Request) {
 	rw.WriteHeader(outRes.StatusCode)
 
 	// copy buffer
-	if err := r.copyResponse(rw, outRes.Body, r.flushInterval(outRes)); err != nil {
+	var dst io.Writer = rw
+	if cw != nil {
+		dst = cw
+	}
+	if r.sse != nil && isEventStream(outRes) {
+		err = r.copySSE(dst, rw, outRes, outReq, inReq)
+	} else {
+		err = r.copyResponse(dst, outRes.Body, flushInterval)
+	}
+	if err != nil {
 		defer outRes.Body.Close()
 
+		// gRPC clients are told why in trailers, like the deadline exceeded
+		if grpc && transcoded == nil {
+			if ctxErr := outReq.Context().Err(); ctxErr != nil {
+				err = ctxErr
+			}
+			setGRPCErrorTrailers(rw, err)
+			return
+		}
+
 		// Since we're streaming the response, if we run into an error all we can do
 		// is abort the request. Issue 23643: Proxy should use ErrAbortHandler
 		// on read error while copying body.
@@ -200,6 +517,13 @@ func (r *Proxy) ServeHTTP(rw http.ResponseWriter, inReq *http.Request) {
 		panic(http.ErrAbortHandler)
 	}
 
+	if cw != nil {
+		// write the pending compressed data
+		if err := cw.Close(); err != nil {
+			log.Printf("compress response error: %v", err)
+		}
+	}
+
 	outRes.Body.Close() // close now, instead of defer, to populate res.Trailer
 	if len(outRes.Trailer) > 0 {
 		// Force chunking if we saw a response trailer
@@ -211,6 +535,24 @@ func (r *Proxy) ServeHTTP(rw http.ResponseWriter, inReq *http.Request) {
 	updateResponseTrailerHeaders(rw, outRes, announcedTrailers)
 }
 
+// onError answers the error, as JSON for transcoded requests, see Config.Transcode,
+// as a gRPC status for gRPC requests, see Config.GRPC, or with OnError.
+func (r *Proxy) onError(ctx context.Context, err error, rw http.ResponseWriter, req *http.Request) {
+	if getTranscodeState(ctx) != nil {
+		log.Printf("transcode error: %v (%s %s)", err, req.Method, req.URL)
+		writeTranscodeError(rw, err)
+		return
+	}
+
+	if isGRPC(ctx, req) {
+		log.Printf("grpc error: %v (%s %s)", err, req.Method, req.URL)
+		writeGRPCError(rw, err)
+		return
+	}
+
+	r.OnError(err, rw, req)
+}
+
 func (r *Proxy) modifyResponse(rw http.ResponseWriter, res *http.Response, req, originReq *http.Request) bool {
 	if r.OnResponse == nil {
 		return true
@@ -218,7 +560,7 @@ func (r *Proxy) modifyResponse(rw http.ResponseWriter, res *http.Response, req,
 
 	if err := r.OnResponse(res, originReq); err != nil {
 		res.Body.Close()
-		r.OnError(err, rw, req)
+		r.onError(req.Context(), err, rw, req)
 		return false
 	}
 
@@ -227,9 +569,10 @@ func (r *Proxy) modifyResponse(rw http.ResponseWriter, res *http.Response, req,
 
 func (r *Proxy) copyResponse(dst io.Writer, src io.Reader, flushInterval time.Duration) error {
 	if flushInterval != 0 {
-		if wf, ok := dst.(writeFlusher); ok {
+		if flush := flusherOf(dst); flush != nil {
 			mlw := &maxLatencyWriter{
-				dst:     wf,
+				dst:     dst,
+				flush:   flush,
 				latency: flushInterval,
 			}
 			defer mlw.stop()
@@ -254,19 +597,32 @@ func (r *Proxy) copyResponse(dst io.Writer, src io.Reader, flushInterval time.Du
 func (r *Proxy) flushInterval(res *http.Response) time.Duration {
 	resCT := res.Header.Get(headers.ContentType)
 
+	// gRPC streams messages, flush immediately,
+	// but trailers-only responses, their headers must end the stream
+	if isGRPCContentType(resCT) {
+		if res.Header.Get("Grpc-Status") != "" {
+			return 0
+		}
+
+		return -1
+	}
+
 	// For Server-Sent Events response, flush immediately
 	// The MIME type is defined in https://www.w3.org/TR/eventsource/#text-event-stream
 	if baseCT, _, _ := mime.ParseMediaType(resCT); baseCT == "text/event-stream" {
 		return -1 // negative means immediately
 	}
 
+	if rule := r.streamingRule(res); rule != nil && rule.FlushInterval != 0 {
+		return rule.FlushInterval
+	}
+
 	// We might have the case of streaming for which Content-Length might be unset.
 	if res.ContentLength == -1 {
 		return -1
 	}
 
-	// return r.FlushInterval
-	return 0
+	return r.FlushInterval
 }
 
 func (r *Proxy) handleUpgrade(rw http.ResponseWriter, req *http.Request, res *http.Response) {
@@ -304,6 +660,12 @@ func (r *Proxy) handleUpgrade(rw http.ResponseWriter, req *http.Request, res *ht
 
 	defer close(backConnCloseCh)
 
+	// checked again, the route may have started draining while the upstream answered
+	if r.upgrades.isDraining(getUpgradeRoute(req.Context())) {
+		r.OnError(NewHTTPError(http.StatusServiceUnavailable, "upgraded connections are draining"), rw, req)
+		return
+	}
+
 	conn, brw, err := hj.Hijack()
 	if err != nil {
 		r.OnError(fmt.Errorf("hijack failed on protocol switch: %v", err), rw, req)
@@ -323,9 +685,26 @@ func (r *Proxy) handleUpgrade(rw http.ResponseWriter, req *http.Request, res *ht
 		r.OnError(fmt.Errorf("response flush: %v", err), rw, req)
 		return
 	}
+
+	uc := r.upgrades.open(req, resUpType, conn, backConn)
+	if uc == nil {
+		// the route started draining while the upstream answered
+		return
+	}
+	userReader := uc.reader(brw.Reader, &uc.fromClient)
+	backReader := uc.reader(backConn, &uc.fromUpstream)
+
+	if r.isWebSocketAware() && ascii.EqualFold(resUpType, "websocket") {
+		r.upgrades.finish(uc, r.serveWebSocket(req, uc, conn, userReader, backConn, backReader))
+		return
+	}
+
 	errc := make(chan error, 1)
-	spc := switchProtocolCopier{user: conn, backend: backConn}
+	spc := switchProtocolCopier{
+		user:    readWriter{userReader, conn},
+		backend: readWriter{backReader, backConn},
+	}
 	go spc.copyToBackend(errc)
 	go spc.copyFromBackend(errc)
-	<-errc
+	r.upgrades.finish(uc, <-errc)
 }
@@ -1,12 +1,18 @@
 package proxy
 
 import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/go-zoox/proxy/utils/contentcoding"
 )
 
 const fakeHopHeader = "X-Fake-Hop-Header-For-Test"
@@ -145,3 +151,157 @@ func TestProxy(t *testing.T) {
 		t.Errorf("request to bad proxy = %v; want 502 StatusBadGateway", res.Status)
 	}
 }
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat(`{"hello":"world"}`, 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		switch r.URL.Path {
+		case "/small":
+			w.Write([]byte(`{}`))
+		case "/no-transform":
+			w.Header().Set("Cache-Control", "no-transform")
+			w.Write([]byte(large))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte(large))
+		case "/vary":
+			w.Header().Set("Vary", "Origin, accept-encoding")
+			w.Write([]byte(large))
+		default:
+			w.Write([]byte(large))
+		}
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	frontend := httptest.NewServer(New(&Config{
+		OnRequest: func(outReq, inReq *http.Request) error {
+			outReq.URL.Scheme = backendURL.Scheme
+			outReq.URL.Host = backendURL.Host
+			return nil
+		},
+		Compression: &CompressionConfig{},
+	}))
+	defer frontend.Close()
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	cases := []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"/", "gzip, deflate, br;q=0.9", "gzip"},
+		{"/", "gzip;q=0.5, zstd", "zstd"},
+		{"/", "*", "br"},
+		{"/", "identity", ""},
+		{"/", "", ""},
+		{"/small", "gzip", ""},
+		{"/no-transform", "gzip", ""},
+		{"/image", "gzip", ""},
+		{"/vary", "gzip", "gzip"},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", frontend.URL+c.path, nil)
+		req.Header.Set("Accept-Encoding", c.acceptEncoding)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if g := res.Header.Get("Content-Encoding"); g != c.encoding {
+			t.Errorf("%s (%s): got Content-Encoding %q; expected %q", c.path, c.acceptEncoding, g, c.encoding)
+		}
+
+		body, _ := contentcoding.NewReader(res.Body, res.Header.Get("Content-Encoding"))
+		bodyBytes, _ := io.ReadAll(body)
+		res.Body.Close()
+		if c.path == "/" && string(bodyBytes) != large {
+			t.Errorf("%s (%s): got body %q", c.path, c.acceptEncoding, bodyBytes)
+		}
+
+		if c.encoding != "" {
+			vary := "Accept-Encoding"
+			if c.path == "/vary" {
+				vary = "Origin, accept-encoding"
+			}
+			if g := res.Header.Values("Vary"); len(g) != 1 || g[0] != vary {
+				t.Errorf("got Vary %q; expected %q", g, vary)
+			}
+			if g, e := res.Header.Get("ETag"), `W/"v1"`; g != e {
+				t.Errorf("got ETag %q; expected %q", g, e)
+			}
+		}
+	}
+}
+
+func TestCompressionMinSize(t *testing.T) {
+	for minSize, expected := range map[int64]int64{0: 1024, -1: 0, 10: 10} {
+		if g := (&CompressionConfig{MinSize: minSize}).minSize(); g != expected {
+			t.Errorf("MinSize %d: got %d; expected %d", minSize, g, expected)
+		}
+	}
+}
+
+func TestCompressionServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+		<-next
+		w.Write([]byte("data: second\n\n"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+
+	frontend := httptest.NewServer(New(&Config{
+		OnRequest: func(outReq, inReq *http.Request) error {
+			outReq.URL.Scheme = backendURL.Scheme
+			outReq.URL.Host = backendURL.Host
+			return nil
+		},
+		Compression: &CompressionConfig{},
+	}))
+	defer frontend.Close()
+
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := (&http.Client{Transport: &http.Transport{DisableCompression: true}}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if g, e := res.Header.Get("Content-Encoding"), "gzip"; g != e {
+		t.Fatalf("got Content-Encoding %q; expected %q", g, e)
+	}
+
+	gr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(gr)
+
+	// the first event must arrive before the upstream sends the second one
+	if line, err := br.ReadString('\n'); err != nil || line != "data: first\n" {
+		t.Fatalf("got %q, %v; expected the first event", line, err)
+	}
+	close(next)
+
+	rest, _ := io.ReadAll(br)
+	if g, e := string(rest), "\ndata: second\n\n"; g != e {
+		t.Errorf("got %q; expected %q", g, e)
+	}
+}
+
+func TestDefaultOnErrorWrapped(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := fmt.Errorf("wrapped: %w", NewHTTPError(http.StatusForbidden, "forbidden"))
+	defaultOnError(err, w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d; expected %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/go-zoox/proxy/utils/rewriter"
+)
+
+// redirect returns a RedirectError if any rule matches the incoming request.
+func redirect(rules rewriter.Redirects, inReq *http.Request) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	location, status, ok := rules.Redirect(requestURL(inReq))
+	if !ok {
+		return nil
+	}
+
+	return NewRedirectError(status, location)
+}
+
+// requestURL returns the full url the client requested,
+// with the scheme resolved through the trusted proxies, see requestScheme.
+func requestURL(req *http.Request) *url.URL {
+	u := *req.URL
+	u.Scheme = requestScheme(req)
+	u.Host = req.Host
+
+	return &u
+}
+
+func writeRedirect(rw http.ResponseWriter, req *http.Request, err *RedirectError) {
+	http.Redirect(rw, req, err.Location(), err.Status())
+}
@@ -0,0 +1,265 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/contentcoding"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// DefaultMaxRequestBodySize is the max request body size used when maxSize is 0.
+const DefaultMaxRequestBodySize int64 = 10 << 20
+
+// The request body helpers are meant to be called in OnRequest, with the outgoing request.
+// Compressed bodies are decoded before and encoded back after, the body is re-set
+// with a known Content-Length, so chunked requests are sent with a length.
+//
+// Errors are HTTPError, so they are answered by the default OnError:
+//
+//	400 if the body cannot be read or parsed, or is rejected by a validator,
+//	413 if the body, encoded or decoded, is larger than maxSize,
+//	415 if the Content-Encoding is not supported.
+
+// ReadRequestBody reads the decoded request body, at most maxSize bytes,
+// the body is put back, so the request can still be sent.
+//
+//	maxSize is the max body size, 0 means DefaultMaxRequestBodySize.
+func ReadRequestBody(req *http.Request, maxSize int64) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	raw, err := readRawRequestBody(req, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	setRequestBody(req, raw)
+
+	return decodeRequestBody(req, raw, maxSize)
+}
+
+// ValidateRequestBody calls fn with the decoded request body, a non-nil error rejects the request,
+// with 400 or the status of the HTTPError returned by fn.
+//
+//	maxSize is the max body size, 0 means DefaultMaxRequestBodySize.
+func ValidateRequestBody(req *http.Request, maxSize int64, fn func(body []byte) error) error {
+	b, err := ReadRequestBody(req, maxSize)
+	if err != nil {
+		return err
+	}
+
+	return badRequest(fn(b))
+}
+
+// RewriteRequestBody replaces the request body by the result of fn, called with the decoded body,
+// a non-nil error rejects the request, with 400 or the status of the HTTPError returned by fn.
+//
+//	maxSize is the max body size, 0 means DefaultMaxRequestBodySize.
+func RewriteRequestBody(req *http.Request, maxSize int64, fn func(body []byte) ([]byte, error)) error {
+	raw, err := readRawRequestBody(req, maxSize)
+	if err != nil {
+		return err
+	}
+
+	b, err := decodeRequestBody(req, raw, maxSize)
+	if err != nil {
+		return err
+	}
+
+	b, err = fn(b)
+	if err != nil {
+		return badRequest(err)
+	}
+
+	encoded, err := encodeRequestBody(req, b)
+	if err != nil {
+		return err
+	}
+
+	setRequestBody(req, encoded)
+	return nil
+}
+
+// SetRequestJSONFields sets the fields of json request bodies, keys are gjson paths,
+// like user.id, an empty body is treated as {}. Bodies of other content types are untouched.
+//
+//	maxSize is the max body size, 0 means DefaultMaxRequestBodySize.
+func SetRequestJSONFields(req *http.Request, maxSize int64, fields map[string]interface{}) error {
+	if !isJSONContentType(req.Header.Get(headers.ContentType)) {
+		return nil
+	}
+
+	// sorted, so nested paths are applied in a stable order
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	return RewriteRequestBody(req, maxSize, func(body []byte) ([]byte, error) {
+		if len(bytes.TrimSpace(body)) == 0 {
+			body = []byte("{}")
+		}
+
+		if !gjson.ValidBytes(body) {
+			return nil, NewHTTPError(http.StatusBadRequest, "invalid json request body")
+		}
+
+		var err error
+		for _, path := range paths {
+			if body, err = sjson.SetBytes(body, path, fields[path]); err != nil {
+				return nil, err
+			}
+		}
+
+		return body, nil
+	})
+}
+
+// RewriteRequestForm rewrites application/x-www-form-urlencoded request bodies,
+// fn updates the values in place. Bodies of other content types are untouched.
+//
+//	maxSize is the max body size, 0 means DefaultMaxRequestBodySize.
+func RewriteRequestForm(req *http.Request, maxSize int64, fn func(values url.Values) error) error {
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get(headers.ContentType))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return nil
+	}
+
+	return RewriteRequestBody(req, maxSize, func(body []byte) ([]byte, error) {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid form request body: %s", err))
+		}
+
+		if err := fn(values); err != nil {
+			return nil, err
+		}
+
+		return []byte(values.Encode()), nil
+	})
+}
+
+// readRawRequestBody reads the body as sent, createRequest drops empty bodies,
+// so a nil body is an empty one.
+func readRawRequestBody(req *http.Request, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxRequestBodySize
+	}
+
+	if req.ContentLength > maxSize {
+		return nil, requestEntityTooLarge(maxSize)
+	}
+
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(req.Body, maxSize+1))
+	if err != nil {
+		return nil, NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to read request body: %s", err))
+	}
+
+	if int64(len(b)) > maxSize {
+		return nil, requestEntityTooLarge(maxSize)
+	}
+
+	return b, nil
+}
+
+func decodeRequestBody(req *http.Request, raw []byte, maxSize int64) ([]byte, error) {
+	contentEncoding := req.Header.Get(headers.ContentEncoding)
+	if contentcoding.IsIdentity(contentEncoding) || len(raw) == 0 {
+		return raw, nil
+	}
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxRequestBodySize
+	}
+
+	decoder, err := contentcoding.NewReader(bytes.NewReader(raw), contentEncoding)
+	if err != nil {
+		return nil, requestEncodingError(err)
+	}
+	defer decoder.Close()
+
+	// limited, so small compressed bodies cannot expand without bound
+	b, err := io.ReadAll(io.LimitReader(decoder, maxSize+1))
+	if err != nil {
+		return nil, NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to decode request body: %s", err))
+	}
+
+	if int64(len(b)) > maxSize {
+		return nil, requestEntityTooLarge(maxSize)
+	}
+
+	return b, nil
+}
+
+func encodeRequestBody(req *http.Request, b []byte) ([]byte, error) {
+	contentEncoding := req.Header.Get(headers.ContentEncoding)
+	if contentcoding.IsIdentity(contentEncoding) {
+		return b, nil
+	}
+
+	var encoded bytes.Buffer
+	encoder, err := contentcoding.NewWriter(&encoded, contentEncoding)
+	if err != nil {
+		return nil, requestEncodingError(err)
+	}
+	if _, err := encoder.Write(b); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return encoded.Bytes(), nil
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// badRequest keeps HTTPError as it is, other errors are 400.
+func badRequest(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr
+	}
+
+	return NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+func requestEntityTooLarge(maxSize int64) error {
+	return NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body too large, max %d bytes", maxSize))
+}
+
+func requestEncodingError(err error) error {
+	var unsupported *contentcoding.UnsupportedError
+	if errors.As(err, &unsupported) {
+		return NewHTTPError(http.StatusUnsupportedMediaType, err.Error())
+	}
+
+	return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("failed to decode request body: %s", err))
+}
@@ -24,6 +24,9 @@ func (r *Proxy) createRequest(ctx context.Context, rw http.ResponseWriter, inReq
 		outReq.Header = make(http.Header)
 	}
 
+	// spoofed by clients which are not trusted proxies
+	r.forwarded.strip(outReq.Header, inReq)
+
 	if r.OnRequest != nil {
 		if err := r.OnRequest(outReq, inReq); err != nil {
 			return nil, err
@@ -46,11 +49,13 @@ func (r *Proxy) createRequest(ctx context.Context, rw http.ResponseWriter, inReq
 	// clean headers
 	cleanRequestHeaders(outReq.Header, inReq)
 	// add headers
-	addRequestHeaders(outReq.Header, inReq, r.isAnonymouse)
+	addRequestHeaders(outReq.Header, inReq, ClientIP(outReq), r.isAnonymouse)
 	// upgrade header
 	updateRequestUpgradeHeaders(outReq.Header, upgrade)
 	// X-Forwarded-For
 	updateRequestXForwardedForHeader(outReq.Header, outReq, r.isAnonymouse)
+	// Forwarded
+	r.forwarded.update(outReq.Header, inReq, r.isAnonymouse)
 
 	//
 	if _, ok := outReq.Header[headers.UserAgent]; !ok {
@@ -2,15 +2,18 @@ package proxy
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
 
-	"github.com/go-zoox/compress/flate"
-	"github.com/go-zoox/compress/gzip"
 	"github.com/go-zoox/headers"
+	"github.com/go-zoox/logger"
+	"github.com/go-zoox/proxy/utils/contentcoding"
+	"github.com/go-zoox/proxy/utils/htmlrewriter"
 )
 
 func (r *Proxy) createResponse(rw http.ResponseWriter, req *http.Request) (*http.Response, error) {
@@ -19,6 +22,18 @@ func (r *Proxy) createResponse(rw http.ResponseWriter, req *http.Request) (*http
 		transport = http.DefaultTransport
 	}
 
+	if protocol := getUpstreamProtocol(req.Context()); protocol != "" {
+		// HTTP/2 connections are shared by the clients, a PROXY header tells only one
+		if r.upstreamProxyProtocol != 0 && protocol != UpstreamProtocolHTTP1 {
+			return nil, fmt.Errorf("upstream protocol %s does not support the upstream proxy protocol", protocol)
+		}
+
+		var err error
+		if transport, err = r.protocolTransports.get(protocol, r.Transport); err != nil {
+			return nil, err
+		}
+	}
+
 	// execute request
 	res, err := transport.RoundTrip(req)
 	if err != nil {
@@ -28,71 +43,46 @@ func (r *Proxy) createResponse(rw http.ResponseWriter, req *http.Request) (*http
 	return res, nil
 }
 
-func rewriteHTMLResponse(resp *http.Response, onRewrite func([]byte) ([]byte, error)) error {
-	contentEncoding := resp.Header.Get(headers.ContentEncoding)
-	if contentEncoding == "" {
-		//
-	} else if contentEncoding == "gzip" {
-		//
-	} else if contentEncoding == "deflate" {
-		//
-	} else {
-		fmt.Printf("unsupport content encoding: %s, ignore rewrite body\n", contentEncoding)
+// UnsupportedEncodingPolicy is the policy for rewriting bodies with unsupported Content-Encoding.
+type UnsupportedEncodingPolicy int
+
+const (
+	// UnsupportedEncodingSkip leaves the body as is and logs a warning, the default.
+	UnsupportedEncodingSkip UnsupportedEncodingPolicy = iota
+	// UnsupportedEncodingError returns the *contentcoding.UnsupportedError, which fails the response.
+	UnsupportedEncodingError
+)
+
+// handle applies the policy to the rewrite error.
+func (p UnsupportedEncodingPolicy) handle(err error, res *http.Response) error {
+	var unsupported *contentcoding.UnsupportedError
+	if p == UnsupportedEncodingSkip && errors.As(err, &unsupported) {
+		logger.Warnf("[proxy] %s, ignore rewrite body", err)
 		return nil
 	}
 
-	b, err := ioutil.ReadAll(resp.Body) //Read html
-	if err != nil {
-		return err
-	}
-	err = resp.Body.Close()
-	if err != nil {
-		return err
-	}
+	return err
+}
 
-	if resp.Header.Get(headers.ContentEncoding) == "" {
-		// replace html
-		// like nginx sub_filter
-		// example: b = bytes.Replace(b, []byte("</body>"), []byte(`<div>custom</div></body>`), -1)
-		b, err = onRewrite(b)
-		if err != nil {
-			return err
-		}
-	} else {
-		if contentEncoding == "gzip" {
-			g := gzip.New()
-			decodedB, err := g.Decompress(b)
-			if err != nil {
-				return err
-			}
+func getUnsupportedEncodingPolicy(policy []UnsupportedEncodingPolicy) UnsupportedEncodingPolicy {
+	if len(policy) != 0 {
+		return policy[0]
+	}
 
-			// replace html
-			// like nginx sub_filter
-			// example: b = bytes.Replace(decodedB, []byte("</body>"), []byte(`<div>custom</div></body>`), -1) // replace html
-			b, err = onRewrite(decodedB)
-			if err != nil {
-				return err
-			}
-			b = g.Compress(b)
-		} else if contentEncoding == "deflate" {
-			d := flate.New()
-			decodedB, err := d.Decompress(b)
-			if err != nil {
-				return err
-			}
+	return UnsupportedEncodingSkip
+}
 
-			// replace html
-			// like nginx sub_filter
-			// example: b = bytes.Replace(decodedB, []byte("</body>"), []byte(`<div>custom</div></body>`), -1) // replace html
-			b, err = onRewrite(decodedB)
-			if err != nil {
-				return err
-			}
+func rewriteHTMLResponse(resp *http.Response, onRewrite func([]byte) ([]byte, error)) error {
+	if !hasResponseBody(resp) {
+		return nil
+	}
 
-			b = d.Compress(b)
-		} else {
-			return fmt.Errorf("unsupport content encoding: %s", contentEncoding)
-		}
+	// replace html
+	// like nginx sub_filter
+	// example: b = bytes.Replace(b, []byte("</body>"), []byte(`<div>custom</div></body>`), -1)
+	b, err := transformBody(resp.Header, resp.Body, transformMaxSize(resp), onRewrite)
+	if err != nil {
+		return err
 	}
 
 	body := ioutil.NopCloser(bytes.NewReader(b))
@@ -102,14 +92,81 @@ func rewriteHTMLResponse(resp *http.Response, onRewrite func([]byte) ([]byte, er
 	return nil
 }
 
+// DefaultMaxTransformBodySize is the max decoded size of the response bodies rewritten in memory,
+// like by CreateOnHTMLRewriteResponse, when BodyLimit.MaxResponseBodySize is 0.
+const DefaultMaxTransformBodySize int64 = 32 << 20
+
+// transformMaxSize returns the max decoded size of the body of res rewritten in memory.
+func transformMaxSize(res *http.Response) int64 {
+	if res.Request != nil {
+		if max := getBodyLimit(res.Request.Context()).MaxResponseBodySize; max > 0 {
+			return max
+		}
+	}
+
+	return DefaultMaxTransformBodySize
+}
+
+// transformBody reads the body, decoded by the Content-Encoding of h,
+// transforms it with fn, and encodes the result back with the same encoding.
+// Bodies larger than maxSize once decoded fail with 502.
+func transformBody(h http.Header, body io.ReadCloser, maxSize int64, fn func([]byte) ([]byte, error)) ([]byte, error) {
+	// the body is left untouched, so it can still be passed through
+	contentEncoding := h.Get(headers.ContentEncoding)
+	if !contentcoding.IsSupported(contentEncoding) {
+		return nil, &contentcoding.UnsupportedError{Encoding: contentEncoding}
+	}
+	defer body.Close()
+
+	decoder, err := contentcoding.NewReader(body, contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	// limited, so small compressed bodies cannot expand without bound
+	b, err := ioutil.ReadAll(io.LimitReader(decoder, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Close(); err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > maxSize {
+		return nil, NewHTTPError(http.StatusBadGateway, fmt.Sprintf("upstream response body too large to rewrite, max %d bytes", maxSize))
+	}
+
+	b, err = fn(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var encoded bytes.Buffer
+	encoder, err := contentcoding.NewWriter(&encoded, contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := encoder.Write(b); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return encoded.Bytes(), nil
+}
+
 // CreateOnHTMLRewriteResponse create a function to rewrite html response
-func CreateOnHTMLRewriteResponse(fn func(origin []byte, res *http.Response) ([]byte, error)) func(*http.Response) error {
+//
+//	policy is the UnsupportedEncodingPolicy, default is UnsupportedEncodingSkip.
+func CreateOnHTMLRewriteResponse(fn func(origin []byte, res *http.Response) ([]byte, error), policy ...UnsupportedEncodingPolicy) func(*http.Response) error {
+	policyX := getUnsupportedEncodingPolicy(policy)
+
 	return func(res *http.Response) error {
 		if strings.Contains(res.Header.Get(headers.ContentType), "text/html") {
 			if err := rewriteHTMLResponse(res, func(b []byte) ([]byte, error) {
 				return fn(b, res)
 			}); err != nil {
-				return err
+				return policyX.handle(err, res)
 			}
 		}
 
@@ -128,3 +185,114 @@ func CreateOnInjectScriptsResponse(fn func(origin []byte, res *http.Response) st
 		return bytes.Replace(b, []byte("</body>"), []byte(fmt.Sprintf(`%s</body>`, scripts)), -1), nil
 	})
 }
+
+// CreateOnHTMLStreamRewriteResponse create a function to rewrite html response in a streaming way,
+// the body is rewritten as it arrives instead of being buffered, see htmlrewriter.
+//
+//	policy is the UnsupportedEncodingPolicy, default is UnsupportedEncodingSkip.
+func CreateOnHTMLStreamRewriteResponse(hr *htmlrewriter.Rewriter, policy ...UnsupportedEncodingPolicy) func(*http.Response) error {
+	policyX := getUnsupportedEncodingPolicy(policy)
+
+	return func(res *http.Response) error {
+		if !strings.Contains(res.Header.Get(headers.ContentType), "text/html") {
+			return nil
+		}
+
+		if err := rewriteResponseBodyStream(res, hr.Reader); err != nil {
+			return policyX.handle(err, res)
+		}
+
+		return nil
+	}
+}
+
+// rewriteResponseBodyStream rewrites the body as it arrives, the body is decoded and
+// re-encoded with the same Content-Encoding, the response switches to chunked transfer.
+func rewriteResponseBodyStream(res *http.Response, rewrite func(io.Reader) io.Reader) error {
+	if !hasResponseBody(res) {
+		return nil
+	}
+
+	encoding := res.Header.Get(headers.ContentEncoding)
+	if !contentcoding.IsSupported(encoding) {
+		return &contentcoding.UnsupportedError{Encoding: encoding}
+	}
+
+	body := res.Body
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(streamResponseBody(pw, body, encoding, rewrite))
+		body.Close()
+	}()
+
+	res.Body = &pipeBody{pr, body}
+	res.ContentLength = -1
+	res.Header.Del(headers.ContentLength)
+	return nil
+}
+
+func streamResponseBody(dst io.Writer, src io.Reader, encoding string, rewrite func(io.Reader) io.Reader) error {
+	decoded, err := contentcoding.NewReader(src, encoding)
+	if err != nil {
+		// empty body
+		if err == io.EOF {
+			return nil
+		}
+
+		return err
+	}
+	defer decoded.Close()
+
+	encoder, err := contentcoding.NewWriter(dst, encoding)
+	if err != nil {
+		return err
+	}
+
+	rewritten := rewrite(decoded)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := rewritten.Read(buf)
+		if n > 0 {
+			if _, err := encoder.Write(buf[:n]); err != nil {
+				return err
+			}
+
+			// flush every chunk, so the response keeps streaming
+			if err := encoder.Flush(); err != nil {
+				return err
+			}
+		}
+
+		if rerr == io.EOF {
+			return encoder.Close()
+		}
+
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// hasResponseBody returns false for responses which must not have a body.
+func hasResponseBody(res *http.Response) bool {
+	if res.ContentLength == 0 || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified {
+		return false
+	}
+
+	if res.Request != nil && res.Request.Method == http.MethodHead {
+		return false
+	}
+
+	return true
+}
+
+// pipeBody closes both the pipe and the origin body, to stop the rewriting goroutine.
+type pipeBody struct {
+	*io.PipeReader
+	origin io.Closer
+}
+
+func (b *pipeBody) Close() error {
+	b.PipeReader.Close()
+	return b.origin.Close()
+}
@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"fmt"
+	"log"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/go-zoox/headers"
 	"github.com/go-zoox/proxy/utils/rewriter"
@@ -12,6 +14,7 @@ import (
 // SingleHostConfig is the configuration for SingleTarget.
 type SingleHostConfig struct {
 	Rewrites        rewriter.Rewriters
+	Redirects       rewriter.Redirects
 	Scheme          string
 	Query           url.Values
 	RequestHeaders  http.Header
@@ -22,6 +25,27 @@ type SingleHostConfig struct {
 	IsAnonymouse bool
 	ChangeOrigin bool
 	//
+	RewriteLocation bool
+	CookieRewrite   *CookieRewrite
+	//
+	BodyLimit *BodyLimit
+	//
+	GRPC                  bool
+	GRPCWeb               *GRPCWebConfig
+	Transcode             *TranscodeConfig
+	UpstreamProtocol      string
+	UpstreamProxyProtocol int
+	Forwarded             *ForwardedConfig
+	//
+	OnWebSocketMessage func(msg *WebSocketMessage, conn *WebSocketConn) error
+	WebSocket          *WebSocketConfig
+	Upgrade            *UpgradeConfig
+	SSE                *SSEConfig
+	//
+	FlushInterval   time.Duration
+	Streaming       []StreamingRule
+	BufferResponses bool
+	//
 	OnError func(err error, rw http.ResponseWriter, req *http.Request)
 }
 
@@ -29,6 +53,7 @@ type SingleHostConfig struct {
 // target is the URL of the host you wish to proxy to.
 // cfg is the configuration for the SingleHost.
 //   - Rewrites is the rewriters for the SingleHost.
+//   - Redirects is the redirect rules, answered without contacting target.
 //   - Scheme overrides the scheme of target.
 //   - Query is the query of the SingleHost.
 //   - RequestHeaders is the request headers of the SingleHost.
@@ -45,8 +70,35 @@ type SingleHostConfig struct {
 //   - ChangeOrigin is a flag to indicate whether the proxy will change the origin.
 //     which means the proxy will change the origin to target.
 //     Default is false.
+//   - RewriteLocation is a flag to indicate whether the proxy will rewrite
+//     Location, Content-Location and Refresh headers pointing at target
+//     back to the proxy, reversing Rewrites, like nginx proxy_redirect default.
+//     Default is false.
+//   - CookieRewrite is the rule to rewrite Set-Cookie headers from target,
+//     like nginx proxy_cookie_domain and proxy_cookie_path.
+//   - BodyLimit limits the request and response body sizes, see BodyLimit.
+//   - Forwarded resolves the client IP behind trusted proxies, and sends
+//     the Forwarded header, see ForwardedConfig.
+//     Default is nil, which trusts the X-Forwarded-* of all the clients, see Config.Forwarded.
+//   - GRPC enables the gRPC mode, see Config.GRPC.
+//   - GRPCWeb translates gRPC-Web to gRPC, see GRPCWebConfig.
+//   - Transcode transcodes REST/JSON requests to gRPC calls, see TranscodeConfig.
+//   - UpstreamProtocol is the protocol to target, http1, h2 or h2c,
+//     see Config.UpstreamProtocol.
+//   - UpstreamProxyProtocol sends a PROXY protocol header, version 1 or 2, to target,
+//     see Config.UpstreamProxyProtocol.
+//   - OnWebSocketMessage is the hook that is called with the messages of WebSocket connections,
+//     see Config.OnWebSocketMessage.
+//   - WebSocket enables the WebSocket-aware mode, see WebSocketConfig.
+//   - Upgrade is the hooks and timeouts of upgraded connections, see UpgradeConfig.
+//   - SSE enables the Server-Sent Events mode, see SSEConfig.
+//   - FlushInterval is the flush interval while copying response bodies, see Config.FlushInterval.
+//   - Streaming is how responses are streamed or buffered, by content type, see StreamingRule.
+//   - BufferResponses buffers the responses not matching Streaming, see Config.BufferResponses.
 //   - OnError is the hook that is called when an error occurs.
 //
+// Invalid Rewrites, Redirects or CookieRewrite fail every request, see Proxy.Err for the error.
+//
 // Example:
 //
 //	// All requests will be redirected to https://httpbin.org
@@ -106,6 +158,10 @@ func NewSingleHost(target string, cfg ...*SingleHostConfig) *Proxy {
 			cfgX.Rewrites = cfg[0].Rewrites
 		}
 
+		if cfg[0].Redirects != nil {
+			cfgX.Redirects = cfg[0].Redirects
+		}
+
 		if cfg[0].Query != nil {
 			cfgX.Query = cfg[0].Query
 		}
@@ -134,6 +190,70 @@ func NewSingleHost(target string, cfg ...*SingleHostConfig) *Proxy {
 			cfgX.ChangeOrigin = true
 		}
 
+		if cfg[0].RewriteLocation {
+			cfgX.RewriteLocation = true
+		}
+
+		if cfg[0].CookieRewrite != nil {
+			cfgX.CookieRewrite = cfg[0].CookieRewrite
+		}
+
+		if cfg[0].BodyLimit != nil {
+			cfgX.BodyLimit = cfg[0].BodyLimit
+		}
+
+		if cfg[0].Forwarded != nil {
+			cfgX.Forwarded = cfg[0].Forwarded
+		}
+
+		if cfg[0].GRPC {
+			cfgX.GRPC = true
+		}
+
+		if cfg[0].GRPCWeb != nil {
+			cfgX.GRPCWeb = cfg[0].GRPCWeb
+		}
+
+		if cfg[0].Transcode != nil {
+			cfgX.Transcode = cfg[0].Transcode
+		}
+
+		if cfg[0].UpstreamProtocol != "" {
+			cfgX.UpstreamProtocol = cfg[0].UpstreamProtocol
+		}
+
+		if cfg[0].UpstreamProxyProtocol != 0 {
+			cfgX.UpstreamProxyProtocol = cfg[0].UpstreamProxyProtocol
+		}
+
+		if cfg[0].OnWebSocketMessage != nil {
+			cfgX.OnWebSocketMessage = cfg[0].OnWebSocketMessage
+		}
+
+		if cfg[0].WebSocket != nil {
+			cfgX.WebSocket = cfg[0].WebSocket
+		}
+
+		if cfg[0].Upgrade != nil {
+			cfgX.Upgrade = cfg[0].Upgrade
+		}
+
+		if cfg[0].SSE != nil {
+			cfgX.SSE = cfg[0].SSE
+		}
+
+		if cfg[0].FlushInterval != 0 {
+			cfgX.FlushInterval = cfg[0].FlushInterval
+		}
+
+		if cfg[0].Streaming != nil {
+			cfgX.Streaming = cfg[0].Streaming
+		}
+
+		if cfg[0].BufferResponses {
+			cfgX.BufferResponses = true
+		}
+
 		if cfg[0].OnError != nil {
 			cfgX.OnError = cfg[0].OnError
 		}
@@ -156,6 +276,9 @@ func NewSingleHost(target string, cfg ...*SingleHostConfig) *Proxy {
 		cfgX.RequestHeaders.Set(headers.UserAgent, fmt.Sprintf("go-zoox_proxy/%s", Version))
 	}
 
+	// compile rules once, instead of on every request
+	compileErr := cfgX.compile()
+
 	isNeedRewrite := len(cfgX.Rewrites) != 0
 	if !isNeedRewrite {
 		if targetX.Path == "" || targetX.Path == "/" {
@@ -163,9 +286,18 @@ func NewSingleHost(target string, cfg ...*SingleHostConfig) *Proxy {
 		}
 	}
 
-	return New(&Config{
+	var reversedRewrites rewriter.Rewriters
+	if isNeedRewrite {
+		reversedRewrites = cfgX.Rewrites.Reverse()
+	}
+
+	p := New(&Config{
 		IsAnonymouse: cfgX.IsAnonymouse,
 		OnRequest: func(outReq, inReq *http.Request) error {
+			if err := redirect(cfgX.Redirects, inReq); err != nil {
+				return err
+			}
+
 			outReq.URL.Scheme = targetX.Scheme
 			outReq.URL.Host = targetX.Host
 
@@ -219,6 +351,14 @@ func NewSingleHost(target string, cfg ...*SingleHostConfig) *Proxy {
 			return nil
 		},
 		OnResponse: func(res *http.Response, originReq *http.Request) error {
+			if cfgX.RewriteLocation {
+				rewriteLocationHeaders(res.Header, targetX, originReq, reversedRewrites)
+			}
+
+			if cfgX.CookieRewrite != nil {
+				cfgX.CookieRewrite.Rewrite(res.Header)
+			}
+
 			for k, v := range cfgX.ResponseHeaders {
 				res.Header.Set(k, v[0])
 			}
@@ -231,6 +371,46 @@ func NewSingleHost(target string, cfg ...*SingleHostConfig) *Proxy {
 
 			return nil
 		},
-		OnError: cfgX.OnError,
+		OnError:               cfgX.OnError,
+		BodyLimit:             cfgX.BodyLimit,
+		GRPC:                  cfgX.GRPC,
+		GRPCWeb:               cfgX.GRPCWeb,
+		Transcode:             cfgX.Transcode,
+		UpstreamProtocol:      cfgX.UpstreamProtocol,
+		UpstreamProxyProtocol: cfgX.UpstreamProxyProtocol,
+		Forwarded:             cfgX.Forwarded,
+		OnWebSocketMessage:    cfgX.OnWebSocketMessage,
+		WebSocket:             cfgX.WebSocket,
+		Upgrade:               cfgX.Upgrade,
+		SSE:                   cfgX.SSE,
+		FlushInterval:         cfgX.FlushInterval,
+		Streaming:             cfgX.Streaming,
+		BufferResponses:       cfgX.BufferResponses,
 	})
+
+	// fails every request, like the errors of Config
+	if compileErr != nil {
+		log.Printf("error: %s\n", compileErr)
+		p.err = compileErr
+	}
+
+	return p
+}
+
+func (cfg *SingleHostConfig) compile() error {
+	if err := cfg.Rewrites.Compile(); err != nil {
+		return err
+	}
+
+	if err := cfg.Redirects.Compile(); err != nil {
+		return err
+	}
+
+	if cfg.CookieRewrite != nil {
+		if err := cfg.CookieRewrite.Compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
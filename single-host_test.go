@@ -2,19 +2,29 @@ package proxy
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-zoox/proxy/utils/contentcoding"
+	"github.com/go-zoox/proxy/utils/htmlrewriter"
 	"github.com/go-zoox/proxy/utils/rewriter"
+	"github.com/go-zoox/proxy/utils/transform"
 	"github.com/tidwall/gjson"
 )
 
@@ -432,35 +442,30 @@ var proxyQueryTests = []struct {
 // 	}
 // }
 
-// func TestReverseProxyFlushInterval(t *testing.T) {
-// 	const expected = "hi"
-// 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		w.Write([]byte(expected))
-// 	}))
-// 	defer backend.Close()
-
-// 	// backendURL, err := url.Parse(backend.URL)
-// 	// if err != nil {
-// 	// 	t.Fatal(err)
-// 	// }
+func TestReverseProxyFlushInterval(t *testing.T) {
+	const expected = "hi"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expected))
+	}))
+	defer backend.Close()
 
-// 	proxyHandler := NewSingleHost(backend.URL)
-// 	proxyHandler.FlushInterval = time.Microsecond
+	proxyHandler := NewSingleHost(backend.URL)
+	proxyHandler.FlushInterval = time.Microsecond
 
-// 	frontend := httptest.NewServer(proxyHandler)
-// 	defer frontend.Close()
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
 
-// 	req, _ := http.NewRequest("GET", frontend.URL, nil)
-// 	req.Close = true
-// 	res, err := frontend.Client().Do(req)
-// 	if err != nil {
-// 		t.Fatalf("Get: %v", err)
-// 	}
-// 	defer res.Body.Close()
-// 	if bodyBytes, _ := io.ReadAll(res.Body); string(bodyBytes) != expected {
-// 		t.Errorf("got body %q; expected %q", bodyBytes, expected)
-// 	}
-// }
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Close = true
+	res, err := frontend.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer res.Body.Close()
+	if bodyBytes, _ := io.ReadAll(res.Body); string(bodyBytes) != expected {
+		t.Errorf("got body %q; expected %q", bodyBytes, expected)
+	}
+}
 
 type mockFlusher struct {
 	http.ResponseWriter
@@ -479,85 +484,75 @@ func (w *wrappedRW) Unwrap() http.ResponseWriter {
 	return w.ResponseWriter
 }
 
-// func TestReverseProxyResponseControllerFlushInterval(t *testing.T) {
-// 	const expected = "hi"
-// 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		w.Write([]byte(expected))
-// 	}))
-// 	defer backend.Close()
-
-// 	backendURL, err := url.Parse(backend.URL)
-// 	if err != nil {
-// 		t.Fatal(err)
-// 	}
-
-// 	mf := &mockFlusher{}
-// 	proxyHandler := NewSingleHost(backendURL)
-// 	proxyHandler.FlushInterval = -1 // flush immediately
-// 	proxyWithMiddleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		mf.ResponseWriter = w
-// 		w = &wrappedRW{mf}
-// 		proxyHandler.ServeHTTP(w, r)
-// 	})
+func TestReverseProxyResponseControllerFlushInterval(t *testing.T) {
+	const expected = "hi"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expected))
+	}))
+	defer backend.Close()
 
-// 	frontend := httptest.NewServer(proxyWithMiddleware)
-// 	defer frontend.Close()
+	mf := &mockFlusher{}
+	proxyHandler := NewSingleHost(backend.URL)
+	proxyHandler.FlushInterval = -1 // flush immediately
+	proxyWithMiddleware := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mf.ResponseWriter = w
+		w = &wrappedRW{mf}
+		proxyHandler.ServeHTTP(w, r)
+	})
 
-// 	req, _ := http.NewRequest("GET", frontend.URL, nil)
-// 	req.Close = true
-// 	res, err := frontend.Client().Do(req)
-// 	if err != nil {
-// 		t.Fatalf("Get: %v", err)
-// 	}
-// 	defer res.Body.Close()
-// 	if bodyBytes, _ := io.ReadAll(res.Body); string(bodyBytes) != expected {
-// 		t.Errorf("got body %q; expected %q", bodyBytes, expected)
-// 	}
-// 	if !mf.flushed {
-// 		t.Errorf("response writer was not flushed")
-// 	}
-// }
+	frontend := httptest.NewServer(proxyWithMiddleware)
+	defer frontend.Close()
 
-// func TestReverseProxyFlushIntervalHeaders(t *testing.T) {
-// 	const expected = "hi"
-// 	stopCh := make(chan struct{})
-// 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-// 		w.Header().Add("MyHeader", expected)
-// 		w.WriteHeader(200)
-// 		w.(http.Flusher).Flush()
-// 		<-stopCh
-// 	}))
-// 	defer backend.Close()
-// 	defer close(stopCh)
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Close = true
+	res, err := frontend.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer res.Body.Close()
+	if bodyBytes, _ := io.ReadAll(res.Body); string(bodyBytes) != expected {
+		t.Errorf("got body %q; expected %q", bodyBytes, expected)
+	}
+	if !mf.flushed {
+		t.Errorf("response writer was not flushed")
+	}
+}
 
-// 	// backendURL, err := url.Parse(backend.URL)
-// 	// if err != nil {
-// 	// 	t.Fatal(err)
-// 	// }
+func TestReverseProxyFlushIntervalHeaders(t *testing.T) {
+	const expected = "hi"
+	stopCh := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("MyHeader", expected)
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		<-stopCh
+	}))
+	defer backend.Close()
+	defer close(stopCh)
 
-// 	proxyHandler := NewSingleHost(backend.URL)
-// 	proxyHandler.FlushInterval = time.Microsecond
+	proxyHandler := NewSingleHost(backend.URL)
+	proxyHandler.FlushInterval = time.Microsecond
 
-// 	frontend := httptest.NewServer(proxyHandler)
-// 	defer frontend.Close()
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
 
-// 	req, _ := http.NewRequest("GET", frontend.URL, nil)
-// 	req.Close = true
+	req, _ := http.NewRequest("GET", frontend.URL, nil)
+	req.Close = true
 
-// 	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
-// 	defer cancel()
-// 	req = req.WithContext(ctx)
+	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+	defer cancel()
+	req = req.WithContext(ctx)
 
-// 	res, err := frontend.Client().Do(req)
-// 	if err != nil {
-// 		t.Fatalf("Get: %v", err)
-// 	}
-// 	defer res.Body.Close()
+	res, err := frontend.Client().Do(req)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer res.Body.Close()
 
-// 	if res.Header.Get("MyHeader") != expected {
-// 		t.Errorf("got header %q; expected %q", res.Header.Get("MyHeader"), expected)
-// 	}
-// }
+	if res.Header.Get("MyHeader") != expected {
+		t.Errorf("got header %q; expected %q", res.Header.Get("MyHeader"), expected)
+	}
+}
 
 func TestReverseProxyCancellation(t *testing.T) {
 	const backendResponse = "I am the backend"
@@ -693,3 +688,713 @@ func TestUserAgentHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestSingleHostRedirects(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("backend should not be contacted, got %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		Redirects: rewriter.Redirects{
+			{From: "^/old/(.*)", To: "/new/$1", Status: http.StatusPermanentRedirect},
+		},
+	})
+
+	req := httptest.NewRequest("GET", "/old/foo?a=b", nil)
+	w := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(w, req)
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("Expected %d, got %d", http.StatusPermanentRedirect, w.Code)
+	}
+	if location := w.Header().Get("Location"); location != "/new/foo?a=b" {
+		t.Errorf("Expected location /new/foo?a=b, got %s", location)
+	}
+}
+
+func TestSingleHostRedirectsBehindProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		Redirects: rewriter.Redirects{{Type: rewriter.RedirectTypeHTTPS}},
+		// httptest requests come from 192.0.2.1
+		Forwarded: &ForwardedConfig{TrustedProxies: []string{"192.0.2.1"}},
+	})
+
+	cases := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"http", nil, http.StatusMovedPermanently},
+		{"x-forwarded-proto", http.Header{"X-Forwarded-Proto": {"https"}}, http.StatusOK},
+		{"x-forwarded-proto of the nearest proxy", http.Header{"X-Forwarded-Proto": {"https, http"}}, http.StatusMovedPermanently},
+		{"forwarded", http.Header{"Forwarded": {"for=198.51.100.1;proto=https"}}, http.StatusOK},
+		{"forwarded of an untrusted hop", http.Header{"Forwarded": {"for=198.51.100.1;proto=http, for=198.51.100.2;proto=https"}}, http.StatusOK},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+		for k, v := range c.header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(w, req)
+		if w.Code != c.status {
+			t.Errorf("%s: got status %d; expected %d", c.name, w.Code, c.status)
+		}
+	}
+
+	// untrusted peers can't spoof the scheme
+	req := httptest.NewRequest("GET", "http://example.com/foo", nil)
+	req.RemoteAddr = "198.51.100.1:1234"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(w, req)
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("untrusted: got status %d; expected %d", w.Code, http.StatusMovedPermanently)
+	}
+}
+
+func TestSingleHostRewriteLocation(t *testing.T) {
+	var backendURL string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", backendURL+"/login?next=1")
+		w.Header().Set("Content-Location", "/index.html")
+		w.Header().Add("Content-Location", backendURL+"/api.html")
+		w.Header().Set("Refresh", "5; url="+backendURL+"/home")
+		w.Header().Add("Refresh", `0; URL="`+backendURL+`/quoted"`)
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+	backendURL = backend.URL
+
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		Rewrites: rewriter.Rewriters{
+			{From: "^/api/(.*)", To: "/$1"},
+		},
+		RewriteLocation: true,
+	})
+
+	req := httptest.NewRequest("GET", "/api/foo", nil)
+	req.Host = "proxy.local"
+	w := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(w, req)
+
+	if g, e := w.Header().Get("Location"), "http://proxy.local/api/login?next=1"; g != e {
+		t.Errorf("got Location %q; expected %q", g, e)
+	}
+	if g, e := w.Header().Get("Content-Location"), "/api/index.html"; g != e {
+		t.Errorf("got Content-Location %q; expected %q", g, e)
+	}
+	if g, e := w.Header().Values("Content-Location"), []string{"/api/index.html", "http://proxy.local/api/api.html"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("got Content-Location %q; expected %q", g, e)
+	}
+	if g, e := w.Header().Values("Refresh"), []string{"5; url=http://proxy.local/api/home", `0; URL="http://proxy.local/api/quoted"`}; !reflect.DeepEqual(g, e) {
+		t.Errorf("got Refresh %q; expected %q", g, e)
+	}
+}
+
+func TestSingleHostCookieRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Domain=.github.com; Path=/; Priority=High")
+		w.Header().Add("Set-Cookie", "theme=dark; domain=github.com; path=/settings; SameSite=Lax")
+		w.Header().Add("Set-Cookie", "plain=1")
+	}))
+	defer backend.Close()
+
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		CookieRewrite: &CookieRewrite{
+			Domain: rewriter.Rewriters{
+				{From: `^\.?github\.com$`, To: ""},
+			},
+			Path: rewriter.Rewriters{
+				{From: "^/(.*)", To: "/github/$1"},
+			},
+			HttpOnly: true,
+			SameSite: "None",
+		},
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(w, req)
+
+	expected := []string{
+		"session=abc; Path=/github/; Priority=High; Secure; HttpOnly; SameSite=None",
+		"theme=dark; path=/github/settings; Secure; HttpOnly; SameSite=None",
+		"plain=1; Secure; HttpOnly; SameSite=None",
+	}
+	if g := w.Header().Values("Set-Cookie"); !reflect.DeepEqual(g, expected) {
+		t.Errorf("got Set-Cookie %q; expected %q", g, expected)
+	}
+}
+
+func TestCookieRewriteSameSite(t *testing.T) {
+	for sameSite, valid := range map[string]bool{"": true, "Strict": true, "lax": true, "NONE": true, "Laxx": false} {
+		err := (&CookieRewrite{SameSite: sameSite}).Compile()
+		if (err == nil) != valid {
+			t.Errorf("SameSite %q: got %v; expected valid %v", sameSite, err, valid)
+		}
+	}
+}
+
+func TestSingleHostHTMLStreamRewrite(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(`<html><head></head><body><a href="/foo">foo</a></body></html>`))
+		gw.Close()
+	}))
+	defer backend.Close()
+
+	hr := htmlrewriter.New()
+	hr.On("body", func(e *htmlrewriter.Element) {
+		e.Append("<script>injected()</script>")
+	})
+	hr.On("a", func(e *htmlrewriter.Element) {
+		e.SetAttribute("href", "/proxied/foo")
+	})
+
+	frontend := httptest.NewServer(NewSingleHost(backend.URL, &SingleHostConfig{
+		OnResponse: CreateOnHTMLStreamRewriteResponse(hr),
+	}))
+	defer frontend.Close()
+
+	getReq, _ := http.NewRequest("GET", frontend.URL, nil)
+	getReq.Header.Set("Accept-Encoding", "gzip")
+	res, err := (&http.Client{Transport: &http.Transport{DisableCompression: true}}).Do(getReq)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer res.Body.Close()
+
+	if g, e := res.TransferEncoding, []string{"chunked"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("got TransferEncoding %v; expected %v", g, e)
+	}
+	if g, e := res.Header.Get("Content-Encoding"), "gzip"; g != e {
+		t.Errorf("got Content-Encoding %q; expected %q", g, e)
+	}
+
+	gr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyBytes, _ := io.ReadAll(gr)
+	if g, e := string(bodyBytes), `<html><head></head><body><a href="/proxied/foo">foo</a><script>injected()</script></body></html>`; g != e {
+		t.Errorf("got body %q; expected %q", g, e)
+	}
+}
+
+func TestSingleHostHTMLRewriteEncodings(t *testing.T) {
+	const page = `<html><body>origin</body></html>`
+
+	for _, encoding := range []string{"br", "zstd", "gzip, br", "compress"} {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Encoding", encoding)
+			if encoding == "compress" {
+				w.Write([]byte(page))
+				return
+			}
+
+			cw, _ := contentcoding.NewWriter(w, encoding)
+			cw.Write([]byte(page))
+			cw.Close()
+		}))
+
+		for _, policy := range []UnsupportedEncodingPolicy{UnsupportedEncodingSkip, UnsupportedEncodingError} {
+			proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+				OnResponse: CreateOnHTMLRewriteResponse(func(origin []byte, res *http.Response) ([]byte, error) {
+					return bytes.Replace(origin, []byte("origin"), []byte("rewritten"), 1), nil
+				}, policy),
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			w := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(w, req)
+
+			if encoding == "compress" {
+				if policy == UnsupportedEncodingSkip && w.Body.String() != page {
+					t.Errorf("%s: expected body untouched, got %q", encoding, w.Body.String())
+				}
+				if policy == UnsupportedEncodingError && w.Code != http.StatusBadGateway {
+					t.Errorf("%s: expected %d, got %d", encoding, http.StatusBadGateway, w.Code)
+				}
+				continue
+			}
+
+			cr, err := contentcoding.NewReader(w.Body, w.Header().Get("Content-Encoding"))
+			if err != nil {
+				t.Fatalf("%s: %v", encoding, err)
+			}
+			bodyBytes, _ := io.ReadAll(cr)
+			if g, e := string(bodyBytes), `<html><body>rewritten</body></html>`; g != e {
+				t.Errorf("%s: got body %q; expected %q", encoding, g, e)
+			}
+		}
+
+		backend.Close()
+	}
+}
+
+func TestSingleHostHTMLRewriteBodyLimit(t *testing.T) {
+	// a small gzip body, expanding to 10 MiB
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write(make([]byte, 10<<20))
+		gw.Close()
+	}))
+	defer backend.Close()
+
+	rewritten := false
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		BodyLimit: &BodyLimit{MaxResponseBodySize: 64 << 10},
+		OnResponse: CreateOnHTMLRewriteResponse(func(origin []byte, res *http.Response) ([]byte, error) {
+			rewritten = true
+			return origin, nil
+		}),
+	})
+
+	w := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d; expected %d", w.Code, http.StatusBadGateway)
+	}
+	if rewritten {
+		t.Errorf("expected the body not to be rewritten")
+	}
+}
+
+func TestSingleHostTransform(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody, _ := io.ReadAll(r.Body)
+		if g, e := string(requestBody), `{"name":"zero","source":"proxy"}`; g != e {
+			t.Errorf("backend got body %q; expected %q", g, e)
+		}
+		if r.ContentLength != int64(len(requestBody)) {
+			t.Errorf("backend got Content-Length %d; expected %d", r.ContentLength, len(requestBody))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		gw.Write([]byte(`{"user_name":"zero","password":"secret"}`))
+		gw.Close()
+	}))
+	defer backend.Close()
+
+	requestPipeline := transform.New().
+		Add("application/json", transform.NewJSON().Set("source", "proxy"))
+	responsePipeline := transform.New().
+		Add("application/json", transform.NewJSON().Delete("password").Rename("user_name", "username"))
+
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		OnRequest: func(req *http.Request) error {
+			return TransformRequestBody(req, requestPipeline)
+		},
+		OnResponse: CreateOnTransformResponse(responsePipeline),
+	})
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"name":"zero"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(w, req)
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyBytes, _ := io.ReadAll(gr)
+	if g, e := string(bodyBytes), `{"username":"zero"}`; g != e {
+		t.Errorf("got body %q; expected %q", g, e)
+	}
+}
+
+func TestSingleHostRequestBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TransferEncoding) != 0 {
+			t.Errorf("backend got Transfer-Encoding %v; expected none", r.TransferEncoding)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if r.ContentLength != int64(len(body)) {
+			t.Errorf("backend got Content-Length %d; expected %d", r.ContentLength, len(body))
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		OnRequest: func(req *http.Request) error {
+			if err := ValidateRequestBody(req, 64, func(body []byte) error {
+				if bytes.Contains(body, []byte("forbidden")) {
+					return errors.New("forbidden content")
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			if err := SetRequestJSONFields(req, 64, map[string]interface{}{
+				"user.id": 1,
+				"source":  "proxy",
+			}); err != nil {
+				return err
+			}
+
+			return RewriteRequestForm(req, 64, func(values url.Values) error {
+				values.Del("password")
+				values.Set("source", "proxy")
+				return nil
+			})
+		},
+	})
+
+	testcases := []struct {
+		name        string
+		contentType string
+		body        string
+		chunked     bool
+		status      int
+		expected    string
+	}{
+		{"json", "application/json", `{"name":"zero"}`, false, http.StatusOK, `{"name":"zero","source":"proxy","user":{"id":1}}`},
+		{"json chunked", "application/json; charset=utf-8", `{"name":"zero"}`, true, http.StatusOK, `{"name":"zero","source":"proxy","user":{"id":1}}`},
+		{"json empty", "application/json", ``, false, http.StatusOK, `{"source":"proxy","user":{"id":1}}`},
+		{"json invalid", "application/json", `{"name":`, false, http.StatusBadRequest, ""},
+		{"form", "application/x-www-form-urlencoded", `name=zero&password=secret`, true, http.StatusOK, `name=zero&source=proxy`},
+		{"text untouched", "text/plain", `hello`, true, http.StatusOK, `hello`},
+		{"rejected", "text/plain", `forbidden`, false, http.StatusBadRequest, ""},
+		{"too large", "text/plain", strings.Repeat("x", 65), false, http.StatusRequestEntityTooLarge, ""},
+		{"too large chunked", "text/plain", strings.Repeat("x", 65), true, http.StatusRequestEntityTooLarge, ""},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", tc.contentType)
+			if tc.chunked {
+				req.ContentLength = -1
+				req.TransferEncoding = []string{"chunked"}
+			}
+			w := httptest.NewRecorder()
+			proxyHandler.ServeHTTP(w, req)
+
+			if w.Code != tc.status {
+				t.Fatalf("got status %d; expected %d (%s)", w.Code, tc.status, w.Body.String())
+			}
+			if tc.status == http.StatusOK && w.Body.String() != tc.expected {
+				t.Errorf("got body %q; expected %q", w.Body.String(), tc.expected)
+			}
+		})
+	}
+}
+
+func TestSingleHostRequestBodyEncoded(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(w, gr)
+	}))
+	defer backend.Close()
+
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		OnRequest: func(req *http.Request) error {
+			return SetRequestJSONFields(req, 64, map[string]interface{}{"source": "proxy"})
+		},
+	})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		var b bytes.Buffer
+		gw := gzip.NewWriter(&b)
+		gw.Write([]byte(body))
+		gw.Close()
+
+		req := httptest.NewRequest("POST", "/", &b)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(`{"name":"zero"}`); w.Body.String() != `{"name":"zero","source":"proxy"}` {
+		t.Errorf("got body %q (%d)", w.Body.String(), w.Code)
+	}
+
+	// small when compressed, too large when decoded
+	if w := send(`{"name":"` + strings.Repeat("x", 1024) + `"}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d; expected %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestSingleHostBodyLimit(t *testing.T) {
+	backendHits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendHits++
+		if _, err := io.ReadAll(r.Body); err != nil {
+			return
+		}
+
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 32)))
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write([]byte(strings.Repeat("x", 32)))
+		case "/stream":
+			w.Write([]byte(strings.Repeat("x", 16)))
+			w.(http.Flusher).Flush()
+			w.Write([]byte(strings.Repeat("x", 16)))
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer backend.Close()
+
+	limit := &BodyLimit{
+		MaxRequestBodySize:  8,
+		MaxResponseBodySize: 20,
+	}
+	proxyHandler := NewSingleHost(backend.URL, &SingleHostConfig{
+		BodyLimit: limit,
+	})
+
+	send := func(path string, body string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		w := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send("/", "12345678", false); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("got %d %q; expected 200 ok", w.Code, w.Body.String())
+	}
+
+	backendHits = 0
+	if w := send("/", "123456789", false); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d; expected %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if backendHits != 0 {
+		t.Errorf("expected the upstream not to be contacted by Content-Length")
+	}
+
+	if w := send("/", strings.Repeat("x", 1024), true); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d; expected %d for a streamed request", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	if w := send("/large", "", false); w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d; expected %d", w.Code, http.StatusBadGateway)
+	}
+
+	// aborted while streaming, the status is already sent, so the handler is aborted
+	func() {
+		defer func() {
+			if err := recover(); err != http.ErrAbortHandler {
+				t.Errorf("got %v; expected the handler to be aborted", err)
+			}
+		}()
+		send("/stream", "", false)
+	}()
+
+	limit.TruncateResponseBody = true
+	proxyHandler = NewSingleHost(backend.URL, &SingleHostConfig{
+		BodyLimit: limit,
+	})
+	for _, path := range []string{"/large", "/stream"} {
+		w := send(path, "", false)
+		if w.Code != http.StatusOK || w.Body.String() != strings.Repeat("x", 20) {
+			t.Errorf("%s: got %d %q; expected the body truncated to 20 bytes", path, w.Code, w.Body.String())
+		}
+		if cl := w.Header().Get("Content-Length"); path == "/large" && cl != "20" {
+			t.Errorf("%s: got Content-Length %q; expected 20", path, cl)
+		}
+	}
+	// encoded bodies are not truncated, they would be corrupt
+	req := httptest.NewRequest("GET", "/gzip", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	proxyHandler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("/gzip: got status %d; expected %d", w.Code, http.StatusBadGateway)
+	}
+}
+
+func TestMultiHostsBodyLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	portN, _ := strconv.Atoi(port)
+
+	proxyHandler := NewMultiHosts(&MultiHostsConfig{
+		Routes: []MultiHostsRoute{
+			{Host: "limited.example.com", Backend: MultiHostsRouteBackend{
+				ServiceName: host,
+				ServicePort: int64(portN),
+				BodyLimit:   &BodyLimit{MaxRequestBodySize: 4},
+			}},
+			{Host: "open.example.com", Backend: MultiHostsRouteBackend{
+				ServiceName: host,
+				ServicePort: int64(portN),
+			}},
+		},
+	})
+
+	for host, status := range map[string]int{
+		"limited.example.com": http.StatusRequestEntityTooLarge,
+		"open.example.com":    http.StatusOK,
+	} {
+		req := httptest.NewRequest("POST", "http://"+host+"/", strings.NewReader("hello"))
+		w := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Errorf("%s: got status %d; expected %d", host, w.Code, status)
+		}
+	}
+}
+
+func TestXForwardedHostPort(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+	proxyHandler := NewSingleHost(backend.URL)
+
+	testcases := []struct {
+		host  string
+		tls   bool
+		proto string
+		xhost string
+		port  string
+	}{
+		{"example.com", false, "http", "example.com", "80"},
+		{"example.com", true, "https", "example.com", "443"},
+		{"example.com:8443", true, "https", "example.com", "8443"},
+		{"[::1]:8080", false, "http", "[::1]", "8080"},
+		{"[2001:db8::1]", true, "https", "[2001:db8::1]", "443"},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tc.host
+		if tc.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		proxyHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got.Get("X-Forwarded-Proto") != tc.proto || got.Get("X-Forwarded-Host") != tc.xhost || got.Get("X-Forwarded-Port") != tc.port {
+			t.Errorf("%s (tls %v): got %s %s %s; expected %s %s %s", tc.host, tc.tls,
+				got.Get("X-Forwarded-Proto"), got.Get("X-Forwarded-Host"), got.Get("X-Forwarded-Port"),
+				tc.proto, tc.xhost, tc.port)
+		}
+	}
+}
+
+func TestMultiHostsHostnames(t *testing.T) {
+	// the backend is reached by its IPv6 service name
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Listener.Close()
+	backend.Listener = l
+	backend.Start()
+	defer backend.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	proxyHandler := NewMultiHosts(&MultiHostsConfig{
+		Routes: []MultiHostsRoute{
+			{Host: "xn--bcher-kva.example", Backend: MultiHostsRouteBackend{
+				ServiceName: "::1",
+				ServicePort: int64(port),
+			}},
+		},
+	})
+
+	for _, host := range []string{"bücher.example", "XN--BCHER-KVA.example.", "xn--bcher-kva.example:8080"} {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Host = host
+		w := httptest.NewRecorder()
+		proxyHandler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d; expected %d", host, w.Code, http.StatusOK)
+			continue
+		}
+		if w.Body.String() != "ok" {
+			t.Errorf("%s: got %q; expected the backend response", host, w.Body.String())
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	backendHost, backendPort := ParseHostPort(backendURL.Host, "http")
+	port, _ := strconv.ParseInt(backendPort, 10, 64)
+
+	single := NewSingleHost(backend.URL, &SingleHostConfig{
+		Rewrites: rewriter.Rewriters{{From: "^/api/(.*", To: "/$1"}},
+	})
+	if single.Err() == nil {
+		t.Errorf("single host: expected the compile error")
+	}
+	w := httptest.NewRecorder()
+	single.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/api/foo", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("single host: got status %d; expected %d", w.Code, http.StatusBadGateway)
+	}
+
+	multi := NewMultiHosts(&MultiHostsConfig{
+		Routes: []MultiHostsRoute{
+			{Host: "^(invalid$", Backend: MultiHostsRouteBackend{ServiceName: backendHost, ServicePort: port}},
+			{Host: "invalid.example.com", Backend: MultiHostsRouteBackend{
+				ServiceName: backendHost,
+				ServicePort: port,
+				Rewriters:   rewriter.Rewriters{{From: "^/api/(.*", To: "/$1"}},
+			}},
+			{Host: ".*", Backend: MultiHostsRouteBackend{ServiceName: backendHost, ServicePort: port}},
+		},
+	})
+	if multi.Err() == nil {
+		t.Errorf("multi hosts: expected the compile error")
+	}
+
+	for host, code := range map[string]int{
+		"invalid.example.com": http.StatusBadGateway,
+		"valid.example.com":   http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		multi.ServeHTTP(w, httptest.NewRequest("GET", "http://"+host+"/api/foo", nil))
+		if w.Code != code {
+			t.Errorf("multi hosts %s: got status %d; expected %d", host, w.Code, code)
+		}
+	}
+
+	if err := NewSingleHost(backend.URL).Err(); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
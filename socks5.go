@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/go-zoox/proxy/utils/socks5"
+)
+
+// ErrSOCKS5NotForward is returned by ServeSOCKS5 when the proxy is not a forward proxy,
+// see Config.Forward.
+var ErrSOCKS5NotForward = errors.New("socks5: the proxy is not a forward proxy")
+
+// SOCKS5Config is the configuration for the SOCKS5 front-end, see Proxy.ServeSOCKS5.
+//
+// Tunnels go through the same policy and authentication as CONNECT,
+// see ForwardConfig.Policy and ForwardConfig.Auth.
+type SOCKS5Config struct {
+	// InspectHTTP routes plaintext HTTP sent on tunnels through OnRequest and OnResponse,
+	//	like absolute-form requests of the forward proxy, and TLS through ForwardConfig.MITM
+	//	if it is configured. Other protocols are tunneled as is.
+	//	Default is false.
+	InspectHTTP bool
+
+	// InspectTimeout is how long to wait for the client to talk first when InspectHTTP,
+	//	protocols where the server talks first, like SMTP, are tunneled after it.
+	//	Default is 500ms.
+	InspectTimeout time.Duration
+
+	// HandshakeTimeout is the timeout of the SOCKS5 negotiation.
+	//	Default is 30s.
+	HandshakeTimeout time.Duration
+}
+
+// ListenAndServeSOCKS5 listens on the TCP address addr and serves SOCKS5, see ServeSOCKS5.
+func (r *Proxy) ListenAndServeSOCKS5(addr string, cfg ...*SOCKS5Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return r.ServeSOCKS5(l, cfg...)
+}
+
+// ServeSOCKS5 serves SOCKS5 (CONNECT command only) on l, it blocks until l is closed.
+// The proxy must be created with Config.Forward, or ErrSOCKS5NotForward is returned.
+//
+// Example:
+//
+//	p := proxy.NewForward(&proxy.ForwardConfig{
+//		Auth: func(username, password string) bool {
+//			return username == "zero" && password == "secret"
+//		},
+//	})
+//	go http.ListenAndServe(":8080", p)
+//	p.ListenAndServeSOCKS5(":1080")
+func (r *Proxy) ServeSOCKS5(l net.Listener, cfg ...*SOCKS5Config) error {
+	cfgX := &SOCKS5Config{}
+	if len(cfg) != 0 && cfg[0] != nil {
+		cfgX = cfg[0]
+	}
+
+	forward := r.forward
+	if forward == nil {
+		return ErrSOCKS5NotForward
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		go r.serveSOCKS5Conn(conn, forward, cfgX)
+	}
+}
+
+func (r *Proxy) serveSOCKS5Conn(conn net.Conn, forward *forwardProxy, cfg *SOCKS5Config) {
+	handshakeTimeout := cfg.HandshakeTimeout
+	if handshakeTimeout == 0 {
+		handshakeTimeout = 30 * time.Second
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	req, err := socks5.Handshake(conn, forward.cfg.Auth)
+	if err != nil {
+		log.Printf("socks5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if req.Command != socks5.CommandConnect {
+		socks5.WriteReply(conn, socks5.ReplyCommandNotSupported, nil)
+		conn.Close()
+		return
+	}
+
+	addr := req.Addr()
+	backConn, err := forward.dial(context.Background(), "tcp", addr)
+	if err != nil {
+		log.Printf("socks5 connect from %s to %s failed: %v", conn.RemoteAddr(), addr, err)
+		socks5.WriteReply(conn, socks5ReplyOf(err), nil)
+		conn.Close()
+		return
+	}
+
+	if err := socks5.WriteReply(conn, socks5.ReplySucceeded, backConn.LocalAddr()); err != nil {
+		backConn.Close()
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	userConn := &bufferedConn{conn, bufio.NewReader(conn)}
+	if cfg.InspectHTTP {
+		switch inspect(userConn, cfg.InspectTimeout) {
+		case "http":
+			// sent by the transport, through the hooks
+			backConn.Close()
+			r.serveTunnelHTTP(userConn, "http", addr)
+			return
+		case "tls":
+			if forward.mitm != nil && !forward.mitm.isBypassed(req.Host) {
+				backConn.Close()
+				r.serveMITM(userConn, addr)
+				return
+			}
+		}
+	}
+
+	defer conn.Close()
+	defer backConn.Close()
+	tunnel(userConn, backConn, forward.idleTimeout())
+}
+
+// socks5ReplyOf returns the reply for the dial error.
+func socks5ReplyOf(err error) byte {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.Status() == http.StatusForbidden {
+		return socks5.ReplyNotAllowed
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return socks5.ReplyConnectionRefused
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return socks5.ReplyTTLExpired
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5.ReplyHostUnreachable
+	}
+
+	return socks5.ReplyGeneralFailure
+}
+
+// httpMethods are the request methods detected by inspect, followed by a space.
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("PATCH "),
+	[]byte("DELETE "),
+	[]byte("OPTIONS "),
+	[]byte("TRACE "),
+}
+
+// inspect returns the protocol the client talks first on the tunnel, http, tls,
+// or empty if unknown, or if the client did not talk within timeout.
+func inspect(conn *bufferedConn, timeout time.Duration) string {
+	if timeout == 0 {
+		timeout = 500 * time.Millisecond
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := conn.r.Peek(1)
+	if err != nil {
+		return ""
+	}
+
+	// TLS handshake record
+	if first[0] == 0x16 {
+		return "tls"
+	}
+
+	// the shortest request line, like GET / HTTP/1.1, is longer
+	head, _ := conn.r.Peek(8)
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(head, method) {
+			return "http"
+		}
+	}
+
+	return ""
+}
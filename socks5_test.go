@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	xproxy "golang.org/x/net/proxy"
+)
+
+func newSOCKS5Client(t *testing.T, addr string, auth *xproxy.Auth, tlsConfig *tls.Config) *http.Client {
+	dialer, err := xproxy.SOCKS5("tcp", addr, auth, xproxy.Direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:     dialer.(xproxy.ContextDialer).DialContext,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+}
+
+func serveSOCKS5(t *testing.T, p *Proxy, cfg *SOCKS5Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go p.ServeSOCKS5(l, cfg)
+	return l.Addr().String()
+}
+
+func TestSOCKS5(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	p := New(&Config{
+		Forward: &ForwardConfig{
+			Auth: func(username, password string) bool {
+				return username == "zero" && password == "secret"
+			},
+			Policy: &ForwardPolicy{DenyHosts: []string{`^denied\.example\.com$`}},
+		},
+		OnResponse: func(res *http.Response, inReq *http.Request) error {
+			res.Header.Set("X-Inspected", "true")
+			return nil
+		},
+	})
+	auth := &xproxy.Auth{User: "zero", Password: "secret"}
+
+	for _, inspect := range []bool{false, true} {
+		addr := serveSOCKS5(t, p, &SOCKS5Config{InspectHTTP: inspect})
+
+		res, err := newSOCKS5Client(t, addr, auth, nil).Get(backend.URL + "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != "hello /foo" {
+			t.Errorf("inspect %v: got %q; expected %q", inspect, body, "hello /foo")
+		}
+		if inspected := res.Header.Get("X-Inspected") == "true"; inspected != inspect {
+			t.Errorf("inspect %v: got inspected %v", inspect, inspected)
+		}
+	}
+
+	addr := serveSOCKS5(t, p, nil)
+	if _, err := newSOCKS5Client(t, addr, &xproxy.Auth{User: "zero", Password: "wrong"}, nil).Get(backend.URL); err == nil {
+		t.Errorf("expected wrong credentials to fail")
+	}
+	if _, err := newSOCKS5Client(t, addr, auth, nil).Get("http://denied.example.com"); err == nil {
+		t.Errorf("expected denied destinations to fail")
+	}
+}
+
+func TestSOCKS5NotForward(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	p := NewSingleHost("http://127.0.0.1")
+	if err := p.ServeSOCKS5(l); err != ErrSOCKS5NotForward {
+		t.Errorf("got %v; expected %v", err, ErrSOCKS5NotForward)
+	}
+}
+
+func TestSOCKS5MITM(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	ca := newTestCA(t)
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	p := New(&Config{
+		Forward: &ForwardConfig{MITM: &MITMConfig{CA: ca}},
+		OnResponse: func(res *http.Response, inReq *http.Request) error {
+			res.Header.Set("X-Inspected", "true")
+			return nil
+		},
+	})
+	p.Transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	addr := serveSOCKS5(t, p, &SOCKS5Config{InspectHTTP: true})
+
+	res, err := newSOCKS5Client(t, addr, nil, &tls.Config{RootCAs: roots}).Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("X-Inspected") != "true" {
+		t.Errorf("expected the tls tunnel to be inspected")
+	}
+}
+
+func TestSOCKS5ServerFirst(t *testing.T) {
+	// like SMTP, the server talks first
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("220 ready\r\n"))
+	}()
+
+	addr := serveSOCKS5(t, NewForward(), &SOCKS5Config{InspectHTTP: true})
+	dialer, _ := xproxy.SOCKS5("tcp", addr, nil, xproxy.Direct)
+	conn, err := dialer.(xproxy.ContextDialer).DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	banner, _ := io.ReadAll(conn)
+	if string(banner) != "220 ready\r\n" {
+		t.Errorf("got %q; expected the server banner", banner)
+	}
+}
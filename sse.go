@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/go-zoox/proxy/utils/sse"
+)
+
+// ErrDropSSEEvent is returned by SSEConfig.OnEvent to drop the event.
+var ErrDropSSEEvent = errors.New("drop sse event")
+
+// errSSENoContent is the 204 of the upstream, which tells to stop reconnecting.
+var errSSENoContent = errors.New("upstream answered 204 No Content")
+
+// SSEEvent is an event of a Server-Sent Events stream.
+type SSEEvent = sse.Event
+
+// SSEConfig enables the Server-Sent Events mode for text/event-stream responses:
+// events are parsed and written one by one, instead of copying the bytes,
+// and the stream can outlive the upstream connection, see MaxReconnects.
+type SSEConfig struct {
+	// OnEvent is called with every event of the upstream, it can modify the event,
+	// or drop it with ErrDropSSEEvent, other errors end the stream.
+	OnEvent func(event *SSEEvent, inReq *http.Request) error
+
+	// HeartbeatInterval writes a comment to the client when nothing is written for this duration,
+	// so intermediaries do not time out silent streams.
+	//	Default is 0, which means no heartbeat.
+	HeartbeatInterval time.Duration
+
+	// MaxReconnects is the max consecutive reconnections to the upstream when its stream
+	// fails or ends, with the Last-Event-ID of the last event, so the client sees a continuous stream.
+	// Requests with a body which can't be sent again, see http.Request.GetBody, are not reconnected.
+	//	Default is 0, which means no reconnection.
+	MaxReconnects int
+
+	// ReconnectDelay is the delay before reconnecting, the retry field of the upstream overrides it.
+	//	Default is 1s.
+	ReconnectDelay time.Duration
+
+	// MaxEventSize is the max size of an event, larger events end the upstream stream,
+	// negative means no limit.
+	//	Default is 0, which means 1 MiB, see sse.DefaultMaxEventSize.
+	MaxEventSize int
+}
+
+func (c *SSEConfig) reconnectDelay() time.Duration {
+	if c.ReconnectDelay != 0 {
+		return c.ReconnectDelay
+	}
+
+	return time.Second
+}
+
+// isEventStream returns true for successful text/event-stream responses.
+func isEventStream(res *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return res.StatusCode == http.StatusOK && mediaType == sse.ContentType
+}
+
+type sseResult struct {
+	event *SSEEvent
+	err   error
+}
+
+// readSSE sends the events of body until it fails or done is closed.
+func readSSE(body io.Reader, maxEventSize int, results chan<- sseResult, done <-chan struct{}) {
+	reader := sse.NewReader(body)
+	reader.MaxEventSize = maxEventSize
+	for {
+		event, err := reader.Next()
+		select {
+		case results <- sseResult{event, err}:
+		case <-done:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// copySSE writes the events of res to dst, see SSEConfig,
+// res.Body is the body of the last upstream response when it returns.
+func (r *Proxy) copySSE(dst io.Writer, rw http.ResponseWriter, res *http.Response, req, inReq *http.Request) error {
+	cfg := r.sse
+	flush := func() {
+		if flush := flusherOf(dst); flush != nil {
+			flush()
+		}
+	}
+	// headers first, the first event may take time
+	flush()
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	delay := cfg.reconnectDelay()
+	reconnects := 0
+	maxReconnects := cfg.MaxReconnects
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		maxReconnects = 0
+	}
+
+	var heartbeat <-chan time.Time
+	var heartbeatTimer *time.Timer
+	if cfg.HeartbeatInterval > 0 {
+		heartbeatTimer = time.NewTimer(cfg.HeartbeatInterval)
+		defer heartbeatTimer.Stop()
+		heartbeat = heartbeatTimer.C
+	}
+	written := func() {
+		flush()
+		if heartbeatTimer != nil {
+			heartbeatTimer.Reset(cfg.HeartbeatInterval)
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	results := make(chan sseResult)
+	go readSSE(res.Body, cfg.MaxEventSize, results, done)
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return req.Context().Err()
+		case <-heartbeat:
+			if err := sse.WriteComment(dst, "heartbeat"); err != nil {
+				return err
+			}
+			written()
+			continue
+		case result := <-results:
+			if result.err == nil {
+				reconnects = 0
+				event := result.event
+				if event.HasID {
+					lastEventID = event.ID
+				}
+				if event.Retry > 0 {
+					delay = event.Retry
+				}
+
+				if cfg.OnEvent != nil {
+					if err := cfg.OnEvent(event, inReq); err != nil {
+						if errors.Is(err, ErrDropSSEEvent) {
+							continue
+						}
+
+						log.Printf("sse event error: %v (%s)", err, req.URL)
+						return nil
+					}
+				}
+
+				if _, err := event.WriteTo(dst); err != nil {
+					return err
+				}
+				written()
+				continue
+			}
+
+			if result.err != io.EOF {
+				log.Printf("sse upstream error: %v (%s)", result.err, req.URL)
+			}
+		}
+
+		// the upstream stream is over, reconnect while heartbeats keep the client
+		res.Body.Close()
+		for {
+			if reconnects >= maxReconnects {
+				return nil
+			}
+			reconnects++
+
+			if err := r.sleepSSE(req.Context(), delay, heartbeat, dst, written); err != nil {
+				return err
+			}
+
+			next, err := r.reconnectSSE(rw, req, inReq, lastEventID)
+			if err == errSSENoContent {
+				return nil
+			}
+			if err != nil {
+				log.Printf("sse reconnect %d/%d: %v (%s)", reconnects, maxReconnects, err, req.URL)
+				continue
+			}
+
+			res.Body = next.Body
+			results = make(chan sseResult)
+			go readSSE(res.Body, cfg.MaxEventSize, results, done)
+			break
+		}
+	}
+}
+
+// sleepSSE waits for delay, writing the heartbeats meanwhile.
+func (r *Proxy) sleepSSE(ctx context.Context, delay time.Duration, heartbeat <-chan time.Time, dst io.Writer, written func()) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-heartbeat:
+			if err := sse.WriteComment(dst, "heartbeat"); err != nil {
+				return err
+			}
+			written()
+		}
+	}
+}
+
+// reconnectSSE sends req again, with lastEventID, the response must be an event stream,
+// it goes through OnResponse and the body limit like the first one, but its headers are not sent.
+func (r *Proxy) reconnectSSE(rw http.ResponseWriter, req, inReq *http.Request, lastEventID string) (*http.Response, error) {
+	next := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		next.Body = body
+	}
+
+	// reset by an empty id, like browsers
+	if lastEventID != "" {
+		next.Header.Set("Last-Event-ID", lastEventID)
+	} else {
+		next.Header.Del("Last-Event-ID")
+	}
+
+	res, err := r.createResponse(rw, next)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusNoContent {
+		res.Body.Close()
+		return nil, errSSENoContent
+	}
+
+	if !isEventStream(res) {
+		res.Body.Close()
+		return nil, NewHTTPError(http.StatusBadGateway, "upstream answered "+res.Status+" without an event stream")
+	}
+
+	cleanResponseHeaders(res.Header)
+	if r.OnResponse != nil {
+		if err := r.OnResponse(res, inReq); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+	}
+
+	if err := limitResponseBody(res, next, getBodyLimit(req.Context())); err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSSE(t *testing.T) {
+	var connections atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch connections.Add(1) {
+		case 1:
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "id: 1\ndata: a\n\nid: 2\ndata: drop\n\n: comment\nid: 3\ndata: c\n\n")
+		case 2:
+			if id := r.Header.Get("Last-Event-ID"); id != "3" {
+				t.Errorf("got Last-Event-ID %q; expected 3", id)
+			}
+			w.Header().Set("Content-Type", "text/event-stream")
+			fmt.Fprint(w, "id: 4\ndata: d\n\n")
+		default:
+			// stop reconnecting
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer backend.Close()
+
+	testcases := []struct {
+		name          string
+		maxReconnects int
+		expected      string
+		responses     int32
+	}{
+		{"reconnect", 3, "id: 1\ndata: A\n\nid: 3\ndata: C\n\nid: 4\ndata: D\n\n", 2},
+		{"no reconnect", 0, "id: 1\ndata: A\n\nid: 3\ndata: C\n\n", 1},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			connections.Store(0)
+			var responses atomic.Int32
+			front := httptest.NewServer(NewSingleHost(backend.URL, &SingleHostConfig{
+				// reconnected responses go through OnResponse too
+				OnResponse: func(res *http.Response) error {
+					responses.Add(1)
+					return nil
+				},
+				SSE: &SSEConfig{
+					OnEvent: func(event *SSEEvent, inReq *http.Request) error {
+						if event.Data == "drop" {
+							return ErrDropSSEEvent
+						}
+
+						event.Data = strings.ToUpper(event.Data)
+						return nil
+					},
+					MaxReconnects:  tc.maxReconnects,
+					ReconnectDelay: 10 * time.Millisecond,
+				},
+			}))
+			defer front.Close()
+
+			res, err := http.Get(front.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != tc.expected {
+				t.Errorf("got %q; expected %q", body, tc.expected)
+			}
+			if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Errorf("got content type %q; expected text/event-stream", ct)
+			}
+			if n := responses.Load(); n != tc.responses {
+				t.Errorf("got %d responses in OnResponse; expected %d", n, tc.responses)
+			}
+		})
+	}
+}
+
+func TestSSEHeartbeat(t *testing.T) {
+	done := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer backend.Close()
+	defer close(done)
+
+	front := httptest.NewServer(NewSingleHost(backend.URL, &SingleHostConfig{
+		SSE: &SSEConfig{HeartbeatInterval: 20 * time.Millisecond},
+	}))
+	defer front.Close()
+
+	res, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	// the event, then heartbeats while the upstream is silent
+	br := bufio.NewReader(res.Body)
+	for _, expected := range []string{"data: first\n", "\n", ": heartbeat\n", "\n", ": heartbeat\n"} {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected {
+			t.Errorf("got %q; expected %q", line, expected)
+		}
+	}
+}
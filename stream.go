@@ -0,0 +1,525 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-zoox/proxy/utils/matcher"
+	"github.com/go-zoox/proxy/utils/sni"
+)
+
+// StreamConfig is the configuration for layer-4 proxying, see NewStream.
+type StreamConfig struct {
+	// Upstreams are the upstream addresses, host:port, picked round-robin,
+	//	a TCP upstream failing to connect is skipped for the next one,
+	//	and is not picked first anymore for FailTimeout after MaxFails failures.
+	Upstreams []string `json:"upstreams"`
+
+	// Routes route TLS connections by SNI to their upstreams, TLS is passed through,
+	//	the first match wins, other connections go to Upstreams. TCP only.
+	//	With routes, the proxy waits for the client to talk first, up to SNITimeout,
+	//	so protocols where the server talks first, like MySQL, should use another listener.
+	Routes []StreamRoute `json:"routes"`
+
+	// SNITimeout is the time to wait for the TLS ClientHello.
+	//	Default is 5s.
+	SNITimeout time.Duration `json:"sni_timeout"`
+
+	// DialTimeout is the timeout to connect to TCP upstreams.
+	//	Default is 10s.
+	DialTimeout time.Duration `json:"dial_timeout"`
+
+	// MaxFails is the number of consecutive failures to connect to a TCP upstream,
+	// after which it is considered down, and tried only if all the others are down too.
+	//	Default is 1.
+	MaxFails int `json:"max_fails"`
+
+	// FailTimeout is the time an upstream is considered down for.
+	//	Default is 10s.
+	FailTimeout time.Duration `json:"fail_timeout"`
+
+	// UDPIdleTimeout closes the UDP sessions without datagrams for this duration.
+	//	Default is 60s.
+	UDPIdleTimeout time.Duration `json:"udp_idle_timeout"`
+
+	// UpstreamProxyProtocol sends a PROXY protocol header of this version, 1 or 2,
+	//	first on the TCP upstream connections, with the client address.
+	//	Default is 0, which means no header.
+	UpstreamProxyProtocol int `json:"upstream_proxy_protocol"`
+}
+
+// StreamRoute routes the TLS connections for the server name SNI,
+// a host pattern like the routes of MultiHosts, see utils/matcher.
+type StreamRoute struct {
+	SNI       string   `json:"sni"`
+	Upstreams []string `json:"upstreams"`
+}
+
+// StreamStats are the counters of a Stream, UDP sessions count as connections.
+type StreamStats struct {
+	ActiveConnections int64 `json:"active_connections"`
+	TotalConnections  int64 `json:"total_connections"`
+	// BytesReceived are the bytes received from the clients.
+	BytesReceived int64 `json:"bytes_received"`
+	// BytesSent are the bytes sent to the clients.
+	BytesSent int64 `json:"bytes_sent"`
+}
+
+// Stream is a layer-4 proxy, forwarding TCP connections and UDP datagrams
+// to upstreams as they are, for services which must not be terminated,
+// like databases or TLS passthrough.
+type Stream struct {
+	cfg       *StreamConfig
+	upstreams *upstreams
+	routes    *matcher.Matcher
+	// routeUpstreams are the upstreams of Routes, by index
+	routeUpstreams []*upstreams
+	// err is the config error, Serve methods fail with it
+	err error
+
+	stats StreamStats
+}
+
+// NewStream creates a new layer-4 proxy.
+//
+// Example:
+//
+//	s := NewStream(&StreamConfig{
+//		Upstreams: []string{"10.0.0.1:6379", "10.0.0.2:6379"},
+//	})
+//	s.ListenAndServeTCP(":6379")
+//
+//	// TLS passthrough by SNI
+//	s := NewStream(&StreamConfig{
+//		Routes: []StreamRoute{
+//			{SNI: "*.a.example.com", Upstreams: []string{"10.0.0.1:443"}},
+//			{SNI: `^b\.example\.com$`, Upstreams: []string{"10.0.0.2:443"}},
+//		},
+//	})
+//	s.ListenAndServeTCP(":443")
+func NewStream(cfg *StreamConfig) *Stream {
+	s := &Stream{
+		cfg:       cfg,
+		upstreams: newUpstreams(cfg.Upstreams, cfg),
+	}
+
+	patterns := make([]string, len(cfg.Routes))
+	for i, route := range cfg.Routes {
+		patterns[i] = route.SNI
+		s.routeUpstreams = append(s.routeUpstreams, newUpstreams(route.Upstreams, cfg))
+	}
+
+	var err error
+	if s.routes, err = matcher.New(patterns...); err != nil {
+		s.err = fmt.Errorf("stream routes: %v", err)
+		log.Printf("error: %s\n", s.err)
+	}
+
+	if v := cfg.UpstreamProxyProtocol; v != 0 && v != 1 && v != 2 {
+		s.err = fmt.Errorf("stream upstream proxy protocol: unsupported version %d", v)
+		log.Printf("error: %s\n", s.err)
+	}
+
+	return s
+}
+
+// Stats returns a snapshot of the counters.
+func (s *Stream) Stats() StreamStats {
+	return StreamStats{
+		ActiveConnections: atomic.LoadInt64(&s.stats.ActiveConnections),
+		TotalConnections:  atomic.LoadInt64(&s.stats.TotalConnections),
+		BytesReceived:     atomic.LoadInt64(&s.stats.BytesReceived),
+		BytesSent:         atomic.LoadInt64(&s.stats.BytesSent),
+	}
+}
+
+// ListenAndServeTCP listens on the TCP address addr and serves it, see ServeTCP.
+func (s *Stream) ListenAndServeTCP(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.ServeTCP(l)
+}
+
+// ServeTCP forwards the connections accepted on l, it blocks until l is closed.
+func (s *Stream) ServeTCP(l net.Listener) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			return err
+		}
+
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *Stream) serveTCPConn(conn net.Conn) {
+	defer conn.Close()
+	s.open()
+	defer s.close()
+
+	upstreams, peeked := s.route(conn)
+	backConn, err := upstreams.dial(s.dialTimeout())
+	if err != nil {
+		log.Printf("stream from %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	defer backConn.Close()
+
+	if err := writeProxyProtocol(backConn, conn, s.cfg.UpstreamProxyProtocol); err != nil {
+		return
+	}
+
+	tunnel(
+		&countConn{conn, io.MultiReader(bytes.NewReader(peeked), conn), &s.stats.BytesReceived},
+		&countConn{backConn, backConn, &s.stats.BytesSent},
+		0,
+	)
+}
+
+// route returns the upstreams for conn, by SNI if there are routes,
+// and the bytes read from conn to find it.
+func (s *Stream) route(conn net.Conn) (*upstreams, []byte) {
+	if len(s.cfg.Routes) == 0 {
+		return s.upstreams, nil
+	}
+
+	timeout := s.cfg.SNITimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	serverName, peeked, err := sni.ServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || serverName == "" {
+		return s.upstreams, peeked
+	}
+
+	if index, ok := s.routes.Match(serverName); ok {
+		return s.routeUpstreams[index], peeked
+	}
+
+	return s.upstreams, peeked
+}
+
+// ListenAndServeUDP listens on the UDP address addr and serves it, see ServeUDP.
+func (s *Stream) ListenAndServeUDP(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	return s.ServeUDP(pc)
+}
+
+// ServeUDP forwards the datagrams received on pc, it blocks until pc is closed.
+//
+// Each client address is a session with its own upstream socket,
+// replies of the upstream are sent back to the client, until UDPIdleTimeout.
+func (s *Stream) ServeUDP(pc net.PacketConn) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+
+			return err
+		}
+		atomic.AddInt64(&s.stats.BytesReceived, int64(n))
+
+		// the lock is only held to find the session, the upstream is dialed by the session,
+		//	so a slow dial doesn't stall the other sessions
+		mu.Lock()
+		session, ok := sessions[clientAddr.String()]
+		if !ok {
+			session = &udpSession{queue: make(chan []byte, udpQueueSize), active: time.Now().UnixNano()}
+			sessions[clientAddr.String()] = session
+			s.open()
+
+			go func(clientAddr net.Addr) {
+				s.serveUDPSession(pc, clientAddr, session, func() {
+					// removed before the socket is closed, so new datagrams start a new session
+					mu.Lock()
+					delete(sessions, clientAddr.String())
+					mu.Unlock()
+				})
+				s.close()
+			}(clientAddr)
+		}
+
+		session.touch()
+		select {
+		case session.queue <- append([]byte(nil), buf[:n]...):
+		default:
+			// the upstream is not keeping up, dropped like by a full socket buffer
+		}
+		mu.Unlock()
+	}
+}
+
+// udpQueueSize is the max number of datagrams of a session waiting for the upstream.
+const udpQueueSize = 64
+
+// serveUDPSession dials the upstream of the session, writes the queued datagrams to it,
+// and sends its replies back to the client, until the session is idle.
+// remove is called when the session stops taking datagrams, before the upstream socket is closed.
+func (s *Stream) serveUDPSession(pc net.PacketConn, clientAddr net.Addr, session *udpSession, remove func()) {
+	backConn, err := s.upstreams.dialUDP()
+	if err != nil {
+		remove()
+		log.Printf("stream from %s failed: %v", clientAddr, err)
+		return
+	}
+	defer backConn.Close()
+
+	done := make(chan struct{})
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for {
+			select {
+			case datagram := <-session.queue:
+				if _, err := backConn.Write(datagram); err != nil {
+					log.Printf("stream from %s failed: %v", clientAddr, err)
+				}
+			case <-done:
+				// the datagrams queued before the session was removed
+				for {
+					select {
+					case datagram := <-session.queue:
+						backConn.Write(datagram)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	s.serveUDPReplies(pc, clientAddr, backConn, session)
+
+	remove()
+	close(done)
+	<-written
+}
+
+// serveUDPReplies sends the replies of the upstream to the client, until the session is idle.
+func (s *Stream) serveUDPReplies(pc net.PacketConn, clientAddr net.Addr, backConn net.Conn, session *udpSession) {
+	idleTimeout := s.cfg.UDPIdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 60 * time.Second
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		backConn.SetReadDeadline(time.Now().Add(idleTimeout))
+		n, err := backConn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() && time.Since(session.lastActive()) < idleTimeout {
+				// the client is still sending
+				continue
+			}
+
+			return
+		}
+
+		if _, err := pc.WriteTo(buf[:n], clientAddr); err != nil {
+			return
+		}
+		atomic.AddInt64(&s.stats.BytesSent, int64(n))
+	}
+}
+
+func (s *Stream) open() {
+	atomic.AddInt64(&s.stats.ActiveConnections, 1)
+	atomic.AddInt64(&s.stats.TotalConnections, 1)
+}
+
+func (s *Stream) close() {
+	atomic.AddInt64(&s.stats.ActiveConnections, -1)
+}
+
+func (s *Stream) dialTimeout() time.Duration {
+	if s.cfg.DialTimeout != 0 {
+		return s.cfg.DialTimeout
+	}
+
+	return 10 * time.Second
+}
+
+type udpSession struct {
+	// queue is the datagrams of the client, written to the upstream by the session
+	queue chan []byte
+	// active is the last datagram time of the client, in unix nanoseconds
+	active int64
+}
+
+func (u *udpSession) touch() {
+	atomic.StoreInt64(&u.active, time.Now().UnixNano())
+}
+
+func (u *udpSession) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&u.active))
+}
+
+// upstreams picks the upstream addresses round-robin,
+// the TCP upstreams failing to connect are marked down for a while.
+type upstreams struct {
+	addrs []string
+	next  uint32
+
+	maxFails    int
+	failTimeout time.Duration
+
+	mu sync.Mutex
+	// fails are the consecutive failures, by index
+	fails []int
+	// downUntil are the times the upstreams are down until, by index
+	downUntil []time.Time
+}
+
+func newUpstreams(addrs []string, cfg *StreamConfig) *upstreams {
+	u := &upstreams{
+		addrs:       addrs,
+		maxFails:    cfg.MaxFails,
+		failTimeout: cfg.FailTimeout,
+		fails:       make([]int, len(addrs)),
+		downUntil:   make([]time.Time, len(addrs)),
+	}
+
+	if u.maxFails <= 0 {
+		u.maxFails = 1
+	}
+
+	if u.failTimeout == 0 {
+		u.failTimeout = 10 * time.Second
+	}
+
+	return u
+}
+
+// dial connects to the next upstream, the following ones are tried if it fails,
+// the upstreams which are down are tried last.
+func (u *upstreams) dial(timeout time.Duration) (net.Conn, error) {
+	if len(u.addrs) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+
+	var err error
+	for _, index := range u.order() {
+		addr := u.addrs[index]
+
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", addr, timeout); err == nil {
+			u.succeed(index)
+			return conn, nil
+		}
+		log.Printf("stream upstream %s failed: %v", addr, err)
+		u.fail(index)
+	}
+
+	return nil, err
+}
+
+// order returns the indexes of the upstreams to try, round-robin, the ones which are down last.
+func (u *upstreams) order() []int {
+	start := atomic.AddUint32(&u.next, 1)
+	now := time.Now()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	order := make([]int, 0, len(u.addrs))
+	var down []int
+	for i := 0; i < len(u.addrs); i++ {
+		index := int((start + uint32(i)) % uint32(len(u.addrs)))
+		if now.Before(u.downUntil[index]) {
+			down = append(down, index)
+			continue
+		}
+		order = append(order, index)
+	}
+
+	return append(order, down...)
+}
+
+func (u *upstreams) succeed(index int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.fails[index] = 0
+	u.downUntil[index] = time.Time{}
+}
+
+func (u *upstreams) fail(index int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.fails[index]++
+	if u.fails[index] >= u.maxFails {
+		u.fails[index] = 0
+		u.downUntil[index] = time.Now().Add(u.failTimeout)
+	}
+}
+
+// dialUDP returns a socket for the next upstream, there is no connection to fail.
+func (u *upstreams) dialUDP() (net.Conn, error) {
+	if len(u.addrs) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+
+	next := atomic.AddUint32(&u.next, 1)
+	return net.Dial("udp", u.addrs[next%uint32(len(u.addrs))])
+}
+
+// countConn counts the bytes read, r may replay bytes read before.
+type countConn struct {
+	net.Conn
+	r io.Reader
+	n *int64
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func (c *countConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("half-close is not supported")
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamTCP(t *testing.T) {
+	// echo server
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	// the first upstream is down, it is skipped
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+
+	s := NewStream(&StreamConfig{
+		Upstreams: []string{down.Addr().String(), upstream.Addr().String()},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.ServeTCP(l)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.Write([]byte("PING\r\n"))
+		// half-close, the echo still comes back
+		conn.(*net.TCPConn).CloseWrite()
+		got, _ := io.ReadAll(conn)
+		conn.Close()
+		if string(got) != "PING\r\n" {
+			t.Errorf("got %q; expected the echo", got)
+		}
+	}
+
+	waitFor(t, func() bool { return s.Stats().ActiveConnections == 0 })
+	stats := s.Stats()
+	if stats.TotalConnections != 2 || stats.BytesReceived != 12 || stats.BytesSent != 12 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
+
+func TestStreamSNI(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	a, b, fallback := newBackend("a"), newBackend("b"), newBackend("fallback")
+	defer a.Close()
+	defer b.Close()
+	defer fallback.Close()
+
+	s := NewStream(&StreamConfig{
+		Upstreams: []string{fallback.Listener.Addr().String()},
+		Routes: []StreamRoute{
+			{SNI: "*.a.example.com", Upstreams: []string{a.Listener.Addr().String()}},
+			{SNI: `^b\.example\.com$`, Upstreams: []string{b.Listener.Addr().String()}},
+		},
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.ServeTCP(l)
+
+	for serverName, expected := range map[string]string{
+		"www.a.example.com": "a",
+		"b.example.com":     "b",
+		"c.example.com":     "fallback",
+	} {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+serverName+"\r\nConnection: close\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		conn.Close()
+		if string(body) != expected {
+			t.Errorf("%s: got %q; expected %q", serverName, body, expected)
+		}
+	}
+}
+
+func TestStreamUDP(t *testing.T) {
+	// upper-case echo server
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			upstream.WriteTo([]byte(strings.ToUpper(string(buf[:n]))), addr)
+		}
+	}()
+
+	s := NewStream(&StreamConfig{
+		Upstreams:      []string{upstream.LocalAddr().String()},
+		UDPIdleTimeout: 100 * time.Millisecond,
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go s.ServeUDP(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 1024)
+	for _, message := range []string{"hello", "world"} {
+		conn.Write([]byte(message))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != strings.ToUpper(message) {
+			t.Errorf("got %q; expected %q", got, strings.ToUpper(message))
+		}
+	}
+
+	if stats := s.Stats(); stats.ActiveConnections != 1 || stats.BytesReceived != 10 || stats.BytesSent != 10 {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	// the idle session is closed
+	waitFor(t, func() bool { return s.Stats().ActiveConnections == 0 })
+
+	// and a new one is started
+	conn.Write([]byte("again"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "AGAIN" || s.Stats().TotalConnections != 2 {
+		t.Errorf("got %q, stats %+v; expected AGAIN in a new session", got, s.Stats())
+	}
+}
+
+func TestStreamUpstreamsHealth(t *testing.T) {
+	live, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	u := newUpstreams([]string{dead.Addr().String(), live.Addr().String()}, &StreamConfig{})
+	for i := 0; i < 2; i++ {
+		conn, err := u.dial(time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// the dead upstream failed once, it is tried last
+	for i := 0; i < 4; i++ {
+		if order := u.order(); len(order) != 2 || order[0] != 1 {
+			t.Errorf("got order %v; expected the live upstream first", order)
+		}
+	}
+
+	// down upstreams are still tried if all of them are down
+	u = newUpstreams([]string{dead.Addr().String()}, &StreamConfig{})
+	u.dial(time.Second)
+	if order := u.order(); len(order) != 1 {
+		t.Errorf("got order %v; expected the down upstream", order)
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timed out waiting for the condition")
+}
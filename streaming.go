@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-zoox/headers"
+)
+
+// DefaultMaxBufferSize is the MaxBufferSize of the rule of Config.BufferResponses.
+const DefaultMaxBufferSize int64 = 10 << 20
+
+// StreamingRule is how the responses of a content type are streamed, see Config.Streaming.
+//
+// Example:
+//
+//	Streaming: []StreamingRule{
+//		// always stream
+//		{ContentType: "application/x-ndjson", FlushInterval: -1},
+//		// buffer small JSON, so OnResponse sees the complete body
+//		{ContentType: "application/json", Buffer: true, MaxBufferSize: 64 * 1024},
+//	}
+type StreamingRule struct {
+	// ContentType is the media type, like application/json, text/* or */*, parameters are ignored.
+	ContentType string `json:"content_type"`
+
+	// FlushInterval is the flush interval of the responses, negative means immediately,
+	// gRPC and event streams are always flushed immediately.
+	//	Default is 0, which means the default of the proxy, see Config.FlushInterval.
+	FlushInterval time.Duration `json:"flush_interval"`
+
+	// Buffer reads the whole body before OnResponse, so hooks see complete bodies,
+	// and the response is sent with a Content-Length.
+	Buffer bool `json:"buffer"`
+
+	// MaxBufferSize is the max size of buffered bodies, larger bodies are streamed.
+	//	Default is 0, which means no limit, but BodyLimit.MaxResponseBodySize.
+	MaxBufferSize int64 `json:"max_buffer_size"`
+}
+
+// match returns true if the rule is for the media type.
+func (s *StreamingRule) match(mediaType string) bool {
+	pattern := strings.ToLower(s.ContentType)
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mediaType, prefix+"/")
+	}
+
+	return false
+}
+
+// streamingRule returns the first rule of the response content type, nil if there is none.
+func (r *Proxy) streamingRule(res *http.Response) *StreamingRule {
+	if len(r.streaming) == 0 {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get(headers.ContentType))
+	for i := range r.streaming {
+		if r.streaming[i].match(mediaType) {
+			return &r.streaming[i]
+		}
+	}
+
+	return nil
+}
+
+// isStream returns true for responses which are never buffered, like gRPC and event streams.
+func isStream(res *http.Response) bool {
+	contentType := res.Header.Get(headers.ContentType)
+	if isGRPCContentType(contentType) {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream"
+}
+
+// bufferResponse reads the body of the response if its rule buffers it, see StreamingRule.Buffer,
+// up to maxSize, the rest is streamed, or answered with 502 if over BodyLimit.MaxResponseBodySize.
+func (r *Proxy) bufferResponse(res *http.Response, req *http.Request, limit *BodyLimit) error {
+	rule := r.streamingRule(res)
+	if rule == nil || !rule.Buffer || isStream(res) {
+		return nil
+	}
+
+	// no body
+	if req.Method == http.MethodHead || res.StatusCode == http.StatusNoContent || res.StatusCode == http.StatusNotModified || res.Body == nil || res.Body == http.NoBody {
+		return nil
+	}
+
+	maxSize := rule.MaxBufferSize
+	if limit.MaxResponseBodySize > 0 && (maxSize == 0 || limit.MaxResponseBodySize < maxSize) {
+		maxSize = limit.MaxResponseBodySize
+	}
+
+	src := res.Body
+	if maxSize > 0 {
+		src = io.NopCloser(io.LimitReader(res.Body, maxSize+1))
+	}
+
+	body, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		// over the body limit, known before the headers are sent
+		if max := limit.MaxResponseBodySize; max > 0 && int64(len(body)) > max && !limit.truncates(res) {
+			return &HTTPError{http.StatusBadGateway, fmt.Sprintf("upstream response body too large: more than %d bytes", max)}
+		}
+
+		// too large, streamed
+		res.Body = &readCloser{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return nil
+	}
+	res.Body.Close()
+
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	// trailers are sent after a chunked body
+	if len(res.Trailer) == 0 {
+		res.TransferEncoding = nil
+		res.Header.Set(headers.ContentLength, strconv.Itoa(len(body)))
+	}
+
+	return nil
+}
+
+// readCloser reads from a reader, and closes the closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamingBuffer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		// chunked
+		w.Write([]byte(`{"a":`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`1}`))
+	}))
+	defer backend.Close()
+
+	testcases := []struct {
+		name           string
+		cfg            *SingleHostConfig
+		contentType    string
+		expectedLength int64
+	}{
+		{"buffered", &SingleHostConfig{Streaming: []StreamingRule{{ContentType: "application/json", Buffer: true}}}, "application/json; charset=utf-8", 7},
+		{"wildcard", &SingleHostConfig{Streaming: []StreamingRule{{ContentType: "application/*", Buffer: true}}}, "application/json", 7},
+		{"larger than max buffer size", &SingleHostConfig{Streaming: []StreamingRule{{ContentType: "application/json", Buffer: true, MaxBufferSize: 4}}}, "application/json", -1},
+		{"other content type", &SingleHostConfig{Streaming: []StreamingRule{{ContentType: "application/json", Buffer: true}}}, "text/plain", -1},
+		{"buffer responses", &SingleHostConfig{BufferResponses: true}, "text/plain", 7},
+		{"event stream", &SingleHostConfig{BufferResponses: true}, "text/event-stream", -1},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			var length int64
+			var body string
+			tc.cfg.OnResponse = func(res *http.Response) error {
+				length = res.ContentLength
+				b, err := io.ReadAll(res.Body)
+				body = string(b)
+				res.Body = io.NopCloser(strings.NewReader(body))
+				return err
+			}
+			frontend := httptest.NewServer(NewSingleHost(backend.URL, tc.cfg))
+			defer frontend.Close()
+
+			res, err := http.Get(frontend.URL + "?type=" + url.QueryEscape(tc.contentType))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			io.ReadAll(res.Body)
+
+			if length != tc.expectedLength || body != `{"a":1}` {
+				t.Errorf("got length %d, body %q in OnResponse; expected %d", length, body, tc.expectedLength)
+			}
+			if res.ContentLength != tc.expectedLength {
+				t.Errorf("got Content-Length %d; expected %d", res.ContentLength, tc.expectedLength)
+			}
+		})
+	}
+}
+
+func TestStreamingBufferBodyLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"a":`))
+		w.(http.Flusher).Flush()
+		w.Write([]byte(`1}`))
+	}))
+	defer backend.Close()
+
+	called := false
+	frontend := httptest.NewServer(NewSingleHost(backend.URL, &SingleHostConfig{
+		BufferResponses: true,
+		BodyLimit:       &BodyLimit{MaxResponseBodySize: 4},
+		OnResponse: func(res *http.Response) error {
+			called = true
+			return nil
+		},
+	}))
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadGateway || called {
+		t.Errorf("got status %d, OnResponse called %v; expected %d before OnResponse", res.StatusCode, called, http.StatusBadGateway)
+	}
+}
+
+func TestStreamingBufferResponsesMaxSize(t *testing.T) {
+	p := New(&Config{BufferResponses: true})
+	if rule := p.streaming[len(p.streaming)-1]; rule.MaxBufferSize != DefaultMaxBufferSize {
+		t.Errorf("got max buffer size %d; expected %d", rule.MaxBufferSize, DefaultMaxBufferSize)
+	}
+}
+
+func TestStreamingFlushInterval(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// with a length, not flushed by default
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Length", "16")
+		fmt.Fprint(w, "{\"line\":\"one\"}\n")
+		w.(http.Flusher).Flush()
+		<-next
+		fmt.Fprint(w, "\n")
+	}))
+	defer backend.Close()
+	defer close(next)
+
+	frontend := httptest.NewServer(NewSingleHost(backend.URL, &SingleHostConfig{
+		Streaming: []StreamingRule{{ContentType: "application/x-ndjson", FlushInterval: -1}},
+	}))
+	defer frontend.Close()
+
+	// headers and the first line, before the backend ends
+	lines := make(chan string, 1)
+	go func() {
+		res, err := http.Get(frontend.URL)
+		if err != nil {
+			lines <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "{\"line\":\"one\"}\n" {
+			t.Errorf("got %q; expected the first line", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first line to be flushed")
+	}
+}
+
+func TestStreamingRuleKeepsEventStreams(t *testing.T) {
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		<-next
+	}))
+	defer backend.Close()
+	defer close(next)
+
+	frontend := httptest.NewServer(NewSingleHost(backend.URL, &SingleHostConfig{
+		Streaming: []StreamingRule{{ContentType: "*/*", FlushInterval: time.Hour}},
+	}))
+	defer frontend.Close()
+
+	lines := make(chan string, 1)
+	go func() {
+		res, err := http.Get(frontend.URL)
+		if err != nil {
+			lines <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+
+		line, _ := bufio.NewReader(res.Body).ReadString('\n')
+		lines <- line
+	}()
+
+	select {
+	case line := <-lines:
+		if line != "data: one\n" {
+			t.Errorf("got %q; expected the first event", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the event stream to be flushed immediately")
+	}
+}
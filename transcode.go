@@ -0,0 +1,556 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/httprule"
+	"github.com/tidwall/gjson"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const transcoderKey key = "transcoder"
+
+// TranscodeConfig is the configuration for transcoding REST/JSON requests to gRPC calls,
+// like grpc-gateway, see NewTranscoder.
+//
+// The rules are the google.api.http annotations of the methods in the descriptors,
+// matched after OnRequest, so on the rewritten path, requests matching none of them
+// are proxied as they are. OnRequest sees the REST request, OnResponse the JSON response,
+// errors are answered as JSON, like {"code":5,"message":"not found"}.
+// Unary methods only, streaming methods are not transcoded.
+type TranscodeConfig struct {
+	// DescriptorSet is a compiled FileDescriptorSet, with the imports, like the output of
+	//	protoc --include_imports --descriptor_set_out=api.pb
+	DescriptorSet []byte `json:"-"`
+
+	// DescriptorSetFile is the file of DescriptorSet, if it is empty.
+	DescriptorSetFile string `json:"descriptor_set_file"`
+
+	// Services are the full names of the services to transcode, like library.v1.LibraryService.
+	//	Default is empty, which means all the services.
+	Services []string `json:"services"`
+
+	// UseProtoNames uses the field names of the proto files in responses, instead of lowerCamelCase.
+	UseProtoNames bool `json:"use_proto_names"`
+
+	// EmitUnpopulated writes the fields with default values in responses.
+	EmitUnpopulated bool `json:"emit_unpopulated"`
+}
+
+// Transcoder transcodes REST/JSON requests to gRPC calls, see TranscodeConfig.
+type Transcoder struct {
+	cfg   *TranscodeConfig
+	rules []*transcodeRule
+	// types resolves the types of google.protobuf.Any in the descriptor set
+	types *dynamicpb.Types
+}
+
+type transcodeRule struct {
+	method       string
+	template     *httprule.Template
+	body         string
+	responseBody string
+	md           protoreflect.MethodDescriptor
+}
+
+// NewTranscoder loads the descriptors and compiles the google.api.http rules.
+func NewTranscoder(cfg *TranscodeConfig) (*Transcoder, error) {
+	data := cfg.DescriptorSet
+	if len(data) == 0 {
+		if cfg.DescriptorSetFile == "" {
+			return nil, errors.New("transcode: descriptor set is required")
+		}
+
+		var err error
+		if data, err = os.ReadFile(cfg.DescriptorSetFile); err != nil {
+			return nil, fmt.Errorf("transcode: %v", err)
+		}
+	}
+
+	set := &descriptorpb.FileDescriptorSet{}
+	// the google.api.http options are parsed, as annotations is linked
+	if err := proto.Unmarshal(data, set); err != nil {
+		return nil, fmt.Errorf("transcode: invalid descriptor set: %v", err)
+	}
+
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, fmt.Errorf("transcode: invalid descriptor set: %v", err)
+	}
+
+	services := map[string]bool{}
+	for _, name := range cfg.Services {
+		services[name] = true
+	}
+
+	t := &Transcoder{cfg: cfg, types: dynamicpb.NewTypes(files)}
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len() && err == nil; i++ {
+			sd := fd.Services().Get(i)
+			if len(services) != 0 && !services[string(sd.FullName())] {
+				continue
+			}
+
+			for j := 0; j < sd.Methods().Len() && err == nil; j++ {
+				err = t.addMethod(sd.Methods().Get(j))
+			}
+		}
+
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *Transcoder) addMethod(md protoreflect.MethodDescriptor) error {
+	opts, ok := md.Options().(*descriptorpb.MethodOptions)
+	if !ok || opts == nil || !proto.HasExtension(opts, annotations.E_Http) {
+		return nil
+	}
+
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil
+	}
+
+	rule := proto.GetExtension(opts, annotations.E_Http).(*annotations.HttpRule)
+	for _, r := range append([]*annotations.HttpRule{rule}, rule.AdditionalBindings...) {
+		var method, path string
+		switch pattern := r.Pattern.(type) {
+		case *annotations.HttpRule_Get:
+			method, path = http.MethodGet, pattern.Get
+		case *annotations.HttpRule_Put:
+			method, path = http.MethodPut, pattern.Put
+		case *annotations.HttpRule_Post:
+			method, path = http.MethodPost, pattern.Post
+		case *annotations.HttpRule_Delete:
+			method, path = http.MethodDelete, pattern.Delete
+		case *annotations.HttpRule_Patch:
+			method, path = http.MethodPatch, pattern.Patch
+		case *annotations.HttpRule_Custom:
+			method, path = pattern.Custom.Kind, pattern.Custom.Path
+		default:
+			continue
+		}
+
+		template, err := httprule.Parse(path)
+		if err != nil {
+			return fmt.Errorf("transcode: %s: %v", md.FullName(), err)
+		}
+
+		if r.Body != "" && r.Body != "*" && md.Input().Fields().ByName(protoreflect.Name(r.Body)) == nil {
+			return fmt.Errorf("transcode: %s: unknown body field %q", md.FullName(), r.Body)
+		}
+
+		t.rules = append(t.rules, &transcodeRule{
+			method:       method,
+			template:     template,
+			body:         r.Body,
+			responseBody: r.ResponseBody,
+			md:           md,
+		})
+	}
+
+	return nil
+}
+
+// match returns the rule of req, and the values of the path variables.
+func (t *Transcoder) match(req *http.Request) (*transcodeRule, map[string]string) {
+	for _, rule := range t.rules {
+		if rule.method != req.Method {
+			continue
+		}
+
+		if values, ok := rule.template.Match(req.URL.EscapedPath()); ok {
+			return rule, values
+		}
+	}
+
+	return nil, nil
+}
+
+// SetTranscoder overrides the transcoder of the request being proxied, like per route,
+// it is meant to be called in OnRequest, with the outgoing request.
+func SetTranscoder(req *http.Request, t *Transcoder) {
+	if current, ok := req.Context().Value(transcoderKey).(*transcodeState); ok && t != nil {
+		current.transcoder = t
+	}
+}
+
+// transcodeState is the transcoder of a request, and the rule once transcoded.
+type transcodeState struct {
+	transcoder *Transcoder
+	rule       *transcodeRule
+}
+
+func withTranscoder(ctx context.Context, t *Transcoder) context.Context {
+	return context.WithValue(ctx, transcoderKey, &transcodeState{transcoder: t})
+}
+
+// getTranscodeState returns the state of the transcoded request, nil if it is not transcoded.
+func getTranscodeState(ctx context.Context) *transcodeState {
+	if state, ok := ctx.Value(transcoderKey).(*transcodeState); ok && state.rule != nil {
+		return state
+	}
+
+	return nil
+}
+
+// transcodeRequest turns req into the gRPC call of the matching rule, in gRPC mode,
+// req is unchanged if there is no transcoder or no rule matches.
+func transcodeRequest(req *http.Request, maxSize int64) error {
+	state, ok := req.Context().Value(transcoderKey).(*transcodeState)
+	if !ok || state.transcoder == nil {
+		return nil
+	}
+
+	rule, values := state.transcoder.match(req)
+	if rule == nil {
+		return nil
+	}
+	// from now on, errors are answered as JSON
+	state.rule = rule
+
+	msg := dynamicpb.NewMessage(rule.md.Input())
+	if rule.body != "" {
+		body, err := ReadRequestBody(req, maxSize)
+		if err != nil {
+			return err
+		}
+
+		if len(bytes.TrimSpace(body)) != 0 {
+			if rule.body != "*" {
+				// the field of the body, by its JSON name
+				fd := rule.md.Input().Fields().ByName(protoreflect.Name(rule.body))
+				body = []byte(fmt.Sprintf(`{%q:%s}`, fd.JSONName(), body))
+			}
+
+			if err := (protojson.UnmarshalOptions{Resolver: state.transcoder.types}).Unmarshal(body, msg); err != nil {
+				return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			}
+		}
+	}
+
+	bound := map[string]bool{}
+	for field, value := range values {
+		if err := setMessageField(msg, field, []string{value}); err != nil {
+			return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid path parameter %s: %v", field, err))
+		}
+		bound[field] = true
+	}
+
+	// the query binds the fields not bound by the path or the body,
+	//	unknown fields are ignored like by grpc-gateway, like ?_=123 of cache busters
+	if rule.body != "*" {
+		for field, values := range req.URL.Query() {
+			if bound[field] || (rule.body != "" && strings.SplitN(field, ".", 2)[0] == rule.body) {
+				continue
+			}
+
+			if err := setMessageField(msg, field, values); errors.Is(err, errUnknownField) {
+				continue
+			} else if err != nil {
+				return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid query parameter %s: %v", field, err))
+			}
+		}
+	}
+
+	message, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	frame := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(message)))
+	frame = append(frame, message...)
+
+	req.Method = http.MethodPost
+	req.URL.Path = fmt.Sprintf("/%s/%s", rule.md.Parent().FullName(), rule.md.Name())
+	req.URL.RawPath = ""
+	req.URL.RawQuery = ""
+	req.Header.Set(headers.ContentType, "application/grpc+proto")
+	// the body is decoded, and the response is read by the proxy
+	req.Header.Del(headers.ContentEncoding)
+	req.Header.Del(headers.AcceptEncoding)
+	setRequestBody(req, frame)
+
+	SetGRPC(req, true)
+	return nil
+}
+
+// errUnknownField is returned by setMessageField for paths which are not fields.
+var errUnknownField = errors.New("unknown field")
+
+// setMessageField sets the field by path, like book.id, JSON or proto names,
+// repeated fields get all the values.
+func setMessageField(msg protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fields := msg.Descriptor().Fields()
+		fd := fields.ByJSONName(name)
+		if fd == nil {
+			fd = fields.ByName(protoreflect.Name(name))
+		}
+		if fd == nil {
+			return fmt.Errorf("%w %q", errUnknownField, name)
+		}
+
+		if i < len(names)-1 {
+			if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field %q is not a message", name)
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+
+		if fd.IsMap() || (!fd.IsList() && len(values) > 1) {
+			return fmt.Errorf("field %q does not accept %d values", name, len(values))
+		}
+
+		for _, value := range values {
+			v, err := parseFieldValue(fd, value)
+			if err != nil {
+				return err
+			}
+
+			if fd.IsList() {
+				msg.Mutable(fd).List().Append(v)
+			} else {
+				msg.Set(fd, v)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseFieldValue(fd protoreflect.FieldDescriptor, value string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(value), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(value)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(value, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(value, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(value, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(value, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(value, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(value, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(value)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(value)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("unknown enum value %q", value)
+		}
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), nil
+	}
+
+	return protoreflect.Value{}, fmt.Errorf("field %q of kind %s is not supported in paths and queries", fd.Name(), fd.Kind())
+}
+
+// transcodeResponse turns the gRPC response into JSON, gRPC errors into HTTP errors,
+// the response is read up to maxSize, larger ones are answered with 502, 0 means no limit.
+func (s *transcodeState) transcodeResponse(res *http.Response, maxSize int64) error {
+	t, rule := s.transcoder, s.rule
+
+	var src io.Reader = res.Body
+	if maxSize > 0 {
+		src = io.LimitReader(res.Body, maxSize+1)
+	}
+
+	body, err := io.ReadAll(src)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	if maxSize > 0 && int64(len(body)) > maxSize {
+		return &HTTPError{http.StatusBadGateway, fmt.Sprintf("upstream response body too large: more than %d bytes", maxSize)}
+	}
+
+	// the trailers are there after the body, or in headers for trailers-only responses
+	code, message := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+	if code == "" {
+		code, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+	}
+	if code != "0" {
+		codeN, err := strconv.Atoi(code)
+		if err != nil {
+			return fmt.Errorf("upstream answered an invalid grpc-status %q", code)
+		}
+
+		return &transcodeError{code: codeN, message: decodeGRPCMessage(message)}
+	}
+
+	if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		return errors.New("upstream answered an invalid or compressed gRPC message")
+	}
+
+	msg := dynamicpb.NewMessage(rule.md.Output())
+	if err := proto.Unmarshal(body[5:], msg); err != nil {
+		return err
+	}
+
+	marshaler := protojson.MarshalOptions{
+		UseProtoNames:   t.cfg.UseProtoNames,
+		EmitUnpopulated: t.cfg.EmitUnpopulated,
+		Resolver:        t.types,
+	}
+	data, err := marshaler.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if rule.responseBody != "" {
+		fd := rule.md.Output().Fields().ByName(protoreflect.Name(rule.responseBody))
+		name := fd.JSONName()
+		if t.cfg.UseProtoNames {
+			name = string(fd.Name())
+		}
+		data = []byte(gjson.GetBytes(data, name).Raw)
+		if len(data) == 0 {
+			data = []byte("null")
+		}
+	}
+
+	cleanTranscodedHeaders(res.Header)
+	res.Header.Set(headers.ContentType, "application/json")
+	res.Header.Set(headers.ContentLength, strconv.Itoa(len(data)))
+	res.ContentLength = int64(len(data))
+	res.Trailer = nil
+	res.Body = io.NopCloser(bytes.NewReader(data))
+	return nil
+}
+
+// cleanTranscodedHeaders removes the gRPC headers, the other metadata is kept.
+func cleanTranscodedHeaders(h http.Header) {
+	for k := range h {
+		if strings.HasPrefix(k, "Grpc-") || k == headers.Trailer {
+			delete(h, k)
+		}
+	}
+}
+
+// transcodeError is a gRPC error of a transcoded request.
+type transcodeError struct {
+	code    int
+	message string
+}
+
+func (e *transcodeError) Error() string {
+	return fmt.Sprintf("grpc error %d: %s", e.code, e.message)
+}
+
+// writeTranscodeError answers a transcoded request with a JSON error, like grpc-gateway.
+func writeTranscodeError(rw http.ResponseWriter, err error) {
+	code, message := grpcCodeOf(err), err.Error()
+	var grpcErr *transcodeError
+	if errors.As(err, &grpcErr) {
+		code, message = grpcErr.code, grpcErr.message
+	}
+
+	status := httpStatusOfGRPCCode(code)
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		status = httpErr.Status()
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"code":    code,
+		"message": message,
+		"details": []interface{}{},
+	})
+
+	rw.Header().Set(headers.ContentType, "application/json")
+	rw.WriteHeader(status)
+	rw.Write(body)
+}
+
+// httpStatusOfGRPCCode maps gRPC status codes to HTTP, like grpc-gateway.
+func httpStatusOfGRPCCode(code int) int {
+	switch code {
+	case grpcCodeOK:
+		return http.StatusOK
+	case grpcCodeCanceled:
+		// Client Closed Request
+		return 499
+	case grpcCodeInvalidArgument, grpcCodeFailedPrecondition, grpcCodeOutOfRange:
+		return http.StatusBadRequest
+	case grpcCodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case grpcCodeNotFound:
+		return http.StatusNotFound
+	case grpcCodeAlreadyExists, grpcCodeAborted:
+		return http.StatusConflict
+	case grpcCodePermissionDenied:
+		return http.StatusForbidden
+	case grpcCodeUnauthenticated:
+		return http.StatusUnauthorized
+	case grpcCodeResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcCodeUnimplemented:
+		return http.StatusNotImplemented
+	case grpcCodeUnavailable:
+		return http.StatusServiceUnavailable
+	}
+
+	// Unknown, Internal, DataLoss
+	return http.StatusInternalServerError
+}
+
+// decodeGRPCMessage decodes the percent-encoded grpc-message.
+func decodeGRPCMessage(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		if message[i] == '%' && i+2 < len(message) {
+			if v, err := strconv.ParseUint(message[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(message[i])
+	}
+
+	return b.String()
+}
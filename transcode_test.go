@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// healthDescriptorSet returns the descriptors of the health service, with http rules on Check.
+func healthDescriptorSet(t *testing.T) []byte {
+	file := protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto)
+	for _, method := range file.Service[0].Method {
+		if method.GetName() != "Check" {
+			continue
+		}
+
+		method.Options = &descriptorpb.MethodOptions{}
+		proto.SetExtension(method.Options, annotations.E_Http, &annotations.HttpRule{
+			Pattern: &annotations.HttpRule_Get{Get: "/v1/health/{service}"},
+			AdditionalBindings: []*annotations.HttpRule{
+				{Pattern: &annotations.HttpRule_Get{Get: "/v1/health"}},
+				{Pattern: &annotations.HttpRule_Post{Post: "/v1/health:check"}, Body: "*", ResponseBody: "status"},
+			},
+		})
+	}
+
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestTranscode(t *testing.T) {
+	addr := newGRPCBackend(t)
+	p := NewSingleHost("http://"+addr, &SingleHostConfig{
+		Transcode: &TranscodeConfig{DescriptorSet: healthDescriptorSet(t)},
+	})
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	testcases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"path", http.MethodGet, "/v1/health/svc", "", http.StatusOK, `{"status":"SERVING"}`},
+		{"query", http.MethodGet, "/v1/health?service=svc", "", http.StatusOK, `{"status":"SERVING"}`},
+		{"body", http.MethodPost, "/v1/health:check", `{"service":"svc"}`, http.StatusOK, `"SERVING"`},
+		{"grpc error", http.MethodGet, "/v1/health/unknown", "", http.StatusNotFound, `"code":5`},
+		{"invalid body", http.MethodPost, "/v1/health:check", `{"unknown":1}`, http.StatusBadRequest, `"code":`},
+		{"unknown query", http.MethodGet, "/v1/health?service=svc&_=123", "", http.StatusOK, `{"status":"SERVING"}`},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, front.URL+tc.path, strings.NewReader(tc.body))
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tc.status {
+				t.Errorf("got status %d; expected %d (%s)", res.StatusCode, tc.status, body)
+			}
+			if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("got content type %q; expected application/json", ct)
+			}
+			if !strings.Contains(string(body), tc.expected) {
+				t.Errorf("got body %s; expected %s", body, tc.expected)
+			}
+			if res.Header.Get("Grpc-Status") != "" || res.Trailer.Get("Grpc-Status") != "" {
+				t.Errorf("got grpc-status, expected no gRPC headers")
+			}
+		})
+	}
+}
+
+func TestTranscodeBodyLimit(t *testing.T) {
+	addr := newGRPCBackend(t)
+	front := httptest.NewServer(NewSingleHost("http://"+addr, &SingleHostConfig{
+		Transcode: &TranscodeConfig{DescriptorSet: healthDescriptorSet(t)},
+		BodyLimit: &BodyLimit{MaxResponseBodySize: 4},
+	}))
+	defer front.Close()
+
+	res, err := http.Get(front.URL + "/v1/health/svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadGateway || res.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("got status %d, content type %q; expected %d as JSON", res.StatusCode, res.Header.Get("Content-Type"), http.StatusBadGateway)
+	}
+}
+
+func TestNewTranscoderErrors(t *testing.T) {
+	if _, err := NewTranscoder(&TranscodeConfig{}); err == nil {
+		t.Errorf("expected an error without descriptor set")
+	}
+
+	if _, err := NewTranscoder(&TranscodeConfig{DescriptorSet: []byte("invalid")}); err == nil {
+		t.Errorf("expected an error for an invalid descriptor set")
+	}
+
+	transcoder, err := NewTranscoder(&TranscodeConfig{DescriptorSet: healthDescriptorSet(t), Services: []string{"unknown.Service"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transcoder.rules) != 0 {
+		t.Errorf("got %d rules; expected none for other services", len(transcoder.rules))
+	}
+}
+
+func TestTranscodeAnyTypes(t *testing.T) {
+	// test.Inner is only in the descriptor set
+	file := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test.proto"),
+		Package:    proto.String("test"),
+		Dependency: []string{"google/protobuf/any.proto"},
+		Syntax:     proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{Name: proto.String("Inner"), Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("name"), JsonName: proto.String("name"), Number: proto.Int32(1), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()},
+			}},
+		},
+	}
+	data, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(anypb.File_google_protobuf_any_proto),
+		file,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transcoder, err := NewTranscoder(&TranscodeConfig{DescriptorSet: data})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := &anypb.Any{}
+	if err := (protojson.UnmarshalOptions{Resolver: transcoder.types}).Unmarshal([]byte(`{"@type":"type.googleapis.com/test.Inner","name":"zero"}`), msg); err != nil {
+		t.Fatal(err)
+	}
+	out, err := (protojson.MarshalOptions{Resolver: transcoder.types}).Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), `"name":"zero"`) {
+		t.Errorf("got %s; expected the fields of test.Inner", out)
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/transform"
+)
+
+// CreateOnTransformResponse create a function to transform response bodies by content type,
+// see transform.Pipeline. Compressed bodies are decoded and encoded back, Content-Length is updated.
+//
+//	policy is the UnsupportedEncodingPolicy, default is UnsupportedEncodingSkip.
+func CreateOnTransformResponse(p *transform.Pipeline, policy ...UnsupportedEncodingPolicy) func(*http.Response) error {
+	policyX := getUnsupportedEncodingPolicy(policy)
+
+	return func(res *http.Response) error {
+		contentType := res.Header.Get(headers.ContentType)
+		if !hasResponseBody(res) || !p.Match(contentType) {
+			return nil
+		}
+
+		b, err := transformBody(res.Header, res.Body, transformMaxSize(res), func(b []byte) ([]byte, error) {
+			return p.Transform(contentType, b)
+		})
+		if err != nil {
+			return policyX.handle(err, res)
+		}
+
+		res.Body = io.NopCloser(bytes.NewReader(b))
+		res.ContentLength = int64(len(b))
+		res.Header.Set(headers.ContentLength, strconv.Itoa(len(b)))
+		res.Header.Del(headers.TransferEncoding)
+		res.TransferEncoding = nil
+		return nil
+	}
+}
+
+// TransformRequestBody transforms the request body by content type, see transform.Pipeline,
+// it is meant to be called in OnRequest. Compressed bodies are decoded and encoded back,
+// Content-Length is updated.
+//
+//	maxSize is the max body size, see RewriteRequestBody, default is DefaultMaxRequestBodySize.
+func TransformRequestBody(req *http.Request, p *transform.Pipeline, maxSize ...int64) error {
+	contentType := req.Header.Get(headers.ContentType)
+	if req.Body == nil || req.Body == http.NoBody || !p.Match(contentType) {
+		return nil
+	}
+
+	var maxSizeX int64
+	if len(maxSize) != 0 {
+		maxSizeX = maxSize[0]
+	}
+
+	return RewriteRequestBody(req, maxSizeX, func(b []byte) ([]byte, error) {
+		return p.Transform(contentType, b)
+	})
+}
+
+// setRequestBody replaces the request body, with a known length,
+// so the request is not sent chunked.
+func setRequestBody(req *http.Request, b []byte) {
+	req.TransferEncoding = nil
+	req.ContentLength = int64(len(b))
+	if len(b) == 0 {
+		req.Body = http.NoBody
+		req.GetBody = func() (io.ReadCloser, error) {
+			return http.NoBody, nil
+		}
+		req.Header.Del(headers.ContentLength)
+		return
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Header.Set(headers.ContentLength, strconv.Itoa(len(b)))
+}
@@ -0,0 +1,383 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const upgradeRouteKey key = "upgrade-route"
+
+var (
+	// ErrUpgradeClosed is the error of upgraded connections closed with Close or CloseUpgradedConns.
+	ErrUpgradeClosed = errors.New("upgraded connection closed by the proxy")
+	// ErrUpgradeIdleTimeout is the error of upgraded connections closed by UpgradeConfig.IdleTimeout.
+	ErrUpgradeIdleTimeout = errors.New("upgraded connection idle timeout")
+	// ErrUpgradeMaxLifetime is the error of upgraded connections closed by UpgradeConfig.MaxLifetime.
+	ErrUpgradeMaxLifetime = errors.New("upgraded connection max lifetime reached")
+)
+
+// UpgradeConfig is the configuration for upgraded connections, like WebSockets,
+// which are tracked by the proxy, see Proxy.UpgradedConns.
+type UpgradeConfig struct {
+	// OnOpen is called when a connection is upgraded, before any byte is copied.
+	OnOpen func(conn *UpgradedConn)
+
+	// OnClose is called when both sides are closed, with the error which closed the connection,
+	// ErrUpgradeClosed, ErrUpgradeIdleTimeout, ErrUpgradeMaxLifetime if closed by the proxy,
+	// nil if closed by a side, or after a closing handshake in the WebSocket-aware mode,
+	// where connections closed without close frames end with io.EOF.
+	OnClose func(conn *UpgradedConn, err error)
+
+	// IdleTimeout closes the connection if no byte is received in either direction.
+	//	Default is 0, which means no timeout.
+	IdleTimeout time.Duration
+
+	// MaxLifetime closes the connection after this duration, whatever the traffic.
+	//	Default is 0, which means no limit.
+	MaxLifetime time.Duration
+}
+
+// UpgradedConn is an upgraded connection being proxied.
+type UpgradedConn struct {
+	// ID is unique per proxy.
+	ID uint64
+	// Route is the route of the connection, see SetUpgradeRoute.
+	Route string
+	// Protocol is the upgrade protocol, like websocket.
+	Protocol string
+	// Request is the upgrade request sent to the upstream.
+	Request *http.Request
+	// OpenedAt is when the connection is upgraded.
+	OpenedAt time.Time
+
+	fromClient   atomic.Int64
+	fromUpstream atomic.Int64
+	lastActive   atomic.Int64
+
+	closers   []io.Closer
+	closeOnce sync.Once
+	// closeFn closes the connection gracefully, like with a WebSocket close frame
+	closeFn func()
+	mu      sync.Mutex
+	err     error
+	done    chan struct{}
+}
+
+// BytesFromClient returns the bytes received from the client, and sent to the upstream.
+func (c *UpgradedConn) BytesFromClient() int64 {
+	return c.fromClient.Load()
+}
+
+// BytesFromUpstream returns the bytes received from the upstream, and sent to the client.
+func (c *UpgradedConn) BytesFromUpstream() int64 {
+	return c.fromUpstream.Load()
+}
+
+// Done is closed when the connection is closed.
+func (c *UpgradedConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Close closes both sides, with ErrUpgradeClosed.
+func (c *UpgradedConn) Close() {
+	c.close(ErrUpgradeClosed)
+}
+
+func (c *UpgradedConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		closeFn := c.closeFn
+		c.mu.Unlock()
+
+		if closeFn != nil {
+			closeFn()
+		}
+
+		for _, closer := range c.closers {
+			closer.Close()
+		}
+	})
+}
+
+// setCloseFn sets how the connection is closed by the proxy, instead of closing the connections.
+func (c *UpgradedConn) setCloseFn(fn func()) {
+	c.mu.Lock()
+	c.closeFn = fn
+	c.mu.Unlock()
+}
+
+func (c *UpgradedConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+func (c *UpgradedConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// reader counts the bytes read from r as activity, in counter.
+func (c *UpgradedConn) reader(r io.Reader, counter *atomic.Int64) io.Reader {
+	return &countingReader{r: r, conn: c, counter: counter}
+}
+
+type countingReader struct {
+	r       io.Reader
+	conn    *UpgradedConn
+	counter *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.counter.Add(int64(n))
+		r.conn.touch()
+	}
+
+	return n, err
+}
+
+// readWriter reads and writes different streams, like the counted reader of a connection.
+type readWriter struct {
+	io.Reader
+	io.Writer
+}
+
+// SetUpgradeRoute sets the route of the upgraded connection of the request being proxied,
+// to list, drain or close the connections of a route, see Proxy.UpgradedConns,
+// it is meant to be called in OnRequest, with the outgoing request.
+func SetUpgradeRoute(req *http.Request, route string) {
+	if current, ok := req.Context().Value(upgradeRouteKey).(*string); ok {
+		*current = route
+	}
+}
+
+func withUpgradeRoute(ctx context.Context) context.Context {
+	route := ""
+	return context.WithValue(ctx, upgradeRouteKey, &route)
+}
+
+func getUpgradeRoute(ctx context.Context) string {
+	if route, ok := ctx.Value(upgradeRouteKey).(*string); ok {
+		return *route
+	}
+
+	return ""
+}
+
+// upgradeRegistry tracks the upgraded connections.
+type upgradeRegistry struct {
+	cfg    *UpgradeConfig
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*UpgradedConn
+	// draining counts the drains in progress, per route, "" is the unnamed route
+	draining map[string]int
+	// drainingAll counts the drains in progress of all the routes
+	drainingAll int
+}
+
+func newUpgradeRegistry(cfg *UpgradeConfig) *upgradeRegistry {
+	if cfg == nil {
+		cfg = &UpgradeConfig{}
+	}
+
+	return &upgradeRegistry{
+		cfg:      cfg,
+		conns:    map[uint64]*UpgradedConn{},
+		draining: map[string]int{},
+	}
+}
+
+// open registers the connection, and starts its timeouts, finish must be called once it is done.
+// It returns nil if the route started draining meanwhile, the caller closes the connection then.
+func (u *upgradeRegistry) open(req *http.Request, protocol string, closers ...io.Closer) *UpgradedConn {
+	c := &UpgradedConn{
+		Route:    getUpgradeRoute(req.Context()),
+		Protocol: protocol,
+		Request:  req,
+		OpenedAt: time.Now(),
+		closers:  closers,
+		done:     make(chan struct{}),
+	}
+	c.touch()
+
+	// checked with the registration, so a drain either sees the connection or refuses it
+	u.mu.Lock()
+	if u.drainingLocked(c.Route) {
+		u.mu.Unlock()
+		return nil
+	}
+	u.nextID++
+	c.ID = u.nextID
+	u.conns[c.ID] = c
+	u.mu.Unlock()
+
+	if u.cfg.OnOpen != nil {
+		u.cfg.OnOpen(c)
+	}
+
+	if timeout := u.cfg.IdleTimeout; timeout > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(timeout, func() {
+			if idle := time.Since(time.Unix(0, c.lastActive.Load())); idle < timeout {
+				timer.Reset(timeout - idle)
+				return
+			}
+
+			c.close(ErrUpgradeIdleTimeout)
+		})
+		go func() {
+			<-c.done
+			timer.Stop()
+		}()
+	}
+
+	if u.cfg.MaxLifetime > 0 {
+		timer := time.AfterFunc(u.cfg.MaxLifetime, func() {
+			c.close(ErrUpgradeMaxLifetime)
+		})
+		go func() {
+			<-c.done
+			timer.Stop()
+		}()
+	}
+
+	return c
+}
+
+// finish closes the connection, unregisters it, and calls OnClose,
+// with the close error of the proxy, or err.
+func (u *upgradeRegistry) finish(c *UpgradedConn, err error) {
+	for _, closer := range c.closers {
+		closer.Close()
+	}
+
+	u.mu.Lock()
+	delete(u.conns, c.ID)
+	u.mu.Unlock()
+	close(c.done)
+
+	if closeErr := c.closeErr(); closeErr != nil {
+		err = closeErr
+	}
+
+	if u.cfg.OnClose != nil {
+		u.cfg.OnClose(c, err)
+	}
+}
+
+func (u *upgradeRegistry) isDraining(route string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.drainingLocked(route)
+}
+
+func (u *upgradeRegistry) drainingLocked(route string) bool {
+	return u.drainingAll > 0 || u.draining[route] > 0
+}
+
+// list returns the connections of the routes, all if routes is empty, by ID.
+func (u *upgradeRegistry) list(routes []string) []*UpgradedConn {
+	u.mu.Lock()
+	conns := make([]*UpgradedConn, 0, len(u.conns))
+	for _, c := range u.conns {
+		if matchRoute(c.Route, routes) {
+			conns = append(conns, c)
+		}
+	}
+	u.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+
+	return conns
+}
+
+func matchRoute(route string, routes []string) bool {
+	if len(routes) == 0 {
+		return true
+	}
+
+	for _, r := range routes {
+		if r == route {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UpgradedConns returns the live upgraded connections of the routes, all if routes is empty,
+// see SetUpgradeRoute.
+func (r *Proxy) UpgradedConns(routes ...string) []*UpgradedConn {
+	return r.upgrades.list(routes)
+}
+
+// CloseUpgradedConns closes the upgraded connections of the routes, all if routes is empty,
+// it returns the number of closed connections.
+func (r *Proxy) CloseUpgradedConns(routes ...string) int {
+	conns := r.upgrades.list(routes)
+	for _, c := range conns {
+		c.Close()
+	}
+
+	return len(conns)
+}
+
+// DrainUpgradedConns waits for the upgraded connections of the routes, all if routes is empty
+// ("" is the unnamed route), to be closed by their sides, new upgrades of the routes are answered with 503 meanwhile.
+// The connections left when ctx is done are closed, and ctx.Err() is returned, like during deploys:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+//	defer cancel()
+//	p.DrainUpgradedConns(ctx)
+func (r *Proxy) DrainUpgradedConns(ctx context.Context, routes ...string) error {
+	u := r.upgrades
+
+	u.mu.Lock()
+	if len(routes) == 0 {
+		u.drainingAll++
+	}
+	for _, route := range routes {
+		u.draining[route]++
+	}
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		if len(routes) == 0 {
+			u.drainingAll--
+		}
+		for _, route := range routes {
+			if u.draining[route]--; u.draining[route] == 0 {
+				delete(u.draining, route)
+			}
+		}
+		u.mu.Unlock()
+	}()
+
+	// listed again, for the upgrades registered while draining started
+	for conns := u.list(routes); len(conns) != 0; conns = u.list(routes) {
+		for _, c := range conns {
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+				r.CloseUpgradedConns(routes...)
+				return ctx.Err()
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-zoox/proxy/utils/websocket"
+)
+
+type upgradeEvents struct {
+	opened chan *UpgradedConn
+	closed chan error
+}
+
+func newUpgradeConfig(cfg *UpgradeConfig) (*UpgradeConfig, *upgradeEvents) {
+	events := &upgradeEvents{opened: make(chan *UpgradedConn, 1), closed: make(chan error, 1)}
+	cfg.OnOpen = func(conn *UpgradedConn) {
+		events.opened <- conn
+	}
+	cfg.OnClose = func(conn *UpgradedConn, err error) {
+		events.closed <- err
+	}
+
+	return cfg, events
+}
+
+func (e *upgradeEvents) expectClosed(t *testing.T, expected error) {
+	t.Helper()
+
+	select {
+	case err := <-e.closed:
+		if !errors.Is(err, expected) {
+			t.Errorf("got close error %v; expected %v", err, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestUpgradedConns(t *testing.T) {
+	target, _ := newWebSocketBackend(t)
+	cfg, events := newUpgradeConfig(&UpgradeConfig{})
+	p := NewSingleHost(target, &SingleHostConfig{
+		Upgrade: cfg,
+		OnRequest: func(req *http.Request) error {
+			SetUpgradeRoute(req, "chat")
+			return nil
+		},
+	})
+	conn, br := dialWebSocket(t, serveWebSocketProxy(t, p))
+
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")})
+	expectFrame(t, br, websocket.OpText, []byte("echo: hello"))
+
+	opened := <-events.opened
+	if opened.Protocol != "websocket" || opened.Route != "chat" {
+		t.Errorf("got protocol %q, route %q; expected websocket, chat", opened.Protocol, opened.Route)
+	}
+
+	conns := p.UpgradedConns("chat")
+	if len(conns) != 1 || conns[0] != opened {
+		t.Fatalf("got %d connections; expected the opened one", len(conns))
+	}
+	// masked frame of 5 bytes from the client, unmasked frame of 11 bytes from the upstream
+	if conns[0].BytesFromClient() != 11 || conns[0].BytesFromUpstream() != 13 {
+		t.Errorf("got %d, %d bytes; expected 11, 13", conns[0].BytesFromClient(), conns[0].BytesFromUpstream())
+	}
+
+	if n := p.CloseUpgradedConns("other"); n != 0 {
+		t.Errorf("got %d connections closed; expected none for other routes", n)
+	}
+	if n := p.CloseUpgradedConns(); n != 1 {
+		t.Errorf("got %d connections closed; expected 1", n)
+	}
+
+	events.expectClosed(t, ErrUpgradeClosed)
+	if _, err := io.ReadAll(br); err != nil {
+		t.Errorf("got %v; expected the client connection to be closed", err)
+	}
+	if conns := p.UpgradedConns(); len(conns) != 0 {
+		t.Errorf("got %d connections; expected none", len(conns))
+	}
+}
+
+func TestUpgradedConnsTimeouts(t *testing.T) {
+	target, _ := newWebSocketBackend(t)
+
+	testcases := []struct {
+		name     string
+		cfg      *UpgradeConfig
+		expected error
+	}{
+		{"idle timeout", &UpgradeConfig{IdleTimeout: 50 * time.Millisecond}, ErrUpgradeIdleTimeout},
+		{"max lifetime", &UpgradeConfig{MaxLifetime: 50 * time.Millisecond}, ErrUpgradeMaxLifetime},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, events := newUpgradeConfig(tc.cfg)
+			dialWebSocket(t, serveWebSocketProxy(t, NewSingleHost(target, &SingleHostConfig{Upgrade: cfg})))
+
+			events.expectClosed(t, tc.expected)
+		})
+	}
+}
+
+func TestDrainUpgradedConns(t *testing.T) {
+	target, _ := newWebSocketBackend(t)
+	cfg, events := newUpgradeConfig(&UpgradeConfig{})
+	// WebSocket-aware, closed with a close frame
+	p := NewSingleHost(target, &SingleHostConfig{Upgrade: cfg, WebSocket: &WebSocketConfig{}})
+	addr := serveWebSocketProxy(t, p)
+	conn, br := dialWebSocket(t, addr)
+	<-events.opened
+
+	drained := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		drained <- p.DrainUpgradedConns(ctx)
+	}()
+
+	// new upgrades are rejected while draining
+	for !p.upgrades.isDraining("") {
+		time.Sleep(time.Millisecond)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; expected 503 while draining", res.StatusCode)
+	}
+
+	// the connection left is closed, with going away
+	if err := <-drained; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v; expected deadline exceeded", err)
+	}
+	events.expectClosed(t, ErrUpgradeClosed)
+	expectFrame(t, br, websocket.OpClose, websocket.FormatClose(websocket.CloseGoingAway, "going away"))
+
+	// drained when the connections are closed by their sides
+	conn, _ = dialWebSocket(t, addr)
+	<-events.opened
+	go func() {
+		drained <- p.DrainUpgradedConns(context.Background())
+	}()
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpClose, Payload: websocket.FormatClose(websocket.CloseNormalClosure, "")})
+	if err := <-drained; err != nil {
+		t.Errorf("got %v; expected drained", err)
+	}
+	events.expectClosed(t, nil)
+}
+
+func TestDrainUpgradedConnsRoutes(t *testing.T) {
+	p := New(&Config{})
+	open := func(route string) *UpgradedConn {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req = req.WithContext(withUpgradeRoute(req.Context()))
+		SetUpgradeRoute(req, route)
+		return p.upgrades.open(req, "websocket")
+	}
+
+	api := open("api")
+	drained := make(chan error, 1)
+	go func() {
+		drained <- p.DrainUpgradedConns(context.Background(), "api")
+	}()
+	for !p.upgrades.isDraining("api") {
+		time.Sleep(time.Millisecond)
+	}
+
+	// only the drained route is refused
+	if c := open("api"); c != nil {
+		t.Error("expected the drained route to be refused")
+	}
+	for _, route := range []string{"", "web"} {
+		if c := open(route); c == nil {
+			t.Errorf("expected the route %q to be opened", route)
+		} else {
+			p.upgrades.finish(c, nil)
+		}
+	}
+
+	p.upgrades.finish(api, nil)
+	if err := <-drained; err != nil {
+		t.Errorf("got %v; expected drained", err)
+	}
+
+	// the unnamed route, not all the routes
+	web := open("web")
+	if err := p.DrainUpgradedConns(context.Background(), ""); err != nil {
+		t.Errorf("got %v; expected drained", err)
+	}
+	if len(p.UpgradedConns("web")) != 1 {
+		t.Error("expected the drain of the unnamed route to keep the other routes")
+	}
+	p.upgrades.finish(web, nil)
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// Upstream protocols, see Config.UpstreamProtocol.
+const (
+	// UpstreamProtocolHTTP1 is HTTP/1.1, also over TLS.
+	UpstreamProtocolHTTP1 = "http1"
+	// UpstreamProtocolHTTP2 is HTTP/2 over TLS, without fallback to HTTP/1.1.
+	UpstreamProtocolHTTP2 = "h2"
+	// UpstreamProtocolH2C is HTTP/2 over cleartext TCP, with prior knowledge.
+	UpstreamProtocolH2C = "h2c"
+)
+
+const upstreamProtocolKey key = "upstream_protocol"
+
+// SetUpstreamProtocol overrides the upstream protocol of the request being proxied, like per route,
+// it is meant to be called in OnRequest, with the outgoing request.
+func SetUpstreamProtocol(req *http.Request, protocol string) {
+	if current, ok := req.Context().Value(upstreamProtocolKey).(*string); ok && protocol != "" {
+		*current = protocol
+	}
+}
+
+func withUpstreamProtocol(ctx context.Context, protocol string) context.Context {
+	return context.WithValue(ctx, upstreamProtocolKey, &protocol)
+}
+
+func getUpstreamProtocol(ctx context.Context) string {
+	if protocol, ok := ctx.Value(upstreamProtocolKey).(*string); ok {
+		return *protocol
+	}
+
+	return ""
+}
+
+func checkUpstreamProtocol(protocol string) error {
+	switch protocol {
+	case "", UpstreamProtocolHTTP1, UpstreamProtocolHTTP2, UpstreamProtocolH2C:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported upstream protocol %q", protocol)
+}
+
+// H2CHandler returns the proxy as a handler serving HTTP/2 over cleartext TCP too,
+// with prior knowledge or by upgrade, besides HTTP/1.1, like for gRPC clients without TLS.
+//
+// Example:
+//
+//	p := proxy.NewSingleHost("http://127.0.0.1:50051", &proxy.SingleHostConfig{
+//		UpstreamProtocol: proxy.UpstreamProtocolH2C,
+//	})
+//	http.ListenAndServe(":8080", p.H2CHandler())
+func (r *Proxy) H2CHandler() http.Handler {
+	return h2c.NewHandler(r, &http2.Server{})
+}
+
+// HTTP/2 health checks of the upstream connections, dead connections are closed
+// when a ping sent after upstreamReadIdleTimeout without frames is not answered in upstreamPingTimeout.
+const (
+	upstreamReadIdleTimeout = 30 * time.Second
+	upstreamPingTimeout     = 15 * time.Second
+)
+
+// upstreamTransports are the transports of the upstream protocols, made on first use
+// from the base transport, so its TLS config and dialer apply.
+type upstreamTransports struct {
+	// mu is only held to make the transports
+	mu         sync.Mutex
+	transports sync.Map
+}
+
+func (u *upstreamTransports) get(protocol string, base http.RoundTripper) (http.RoundTripper, error) {
+	if transport, ok := u.transports.Load(protocol); ok {
+		return transport.(http.RoundTripper), nil
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if transport, ok := u.transports.Load(protocol); ok {
+		return transport.(http.RoundTripper), nil
+	}
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	baseX, ok := base.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("upstream protocol %s: unsupported transport %T", protocol, base)
+	}
+
+	var transport http.RoundTripper
+	switch protocol {
+	case UpstreamProtocolHTTP1:
+		http1 := baseX.Clone()
+		http1.ForceAttemptHTTP2 = false
+		// a non-nil empty map disables HTTP/2
+		http1.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if http1.TLSClientConfig != nil {
+			http1.TLSClientConfig.NextProtos = nil
+		}
+		transport = http1
+	case UpstreamProtocolHTTP2:
+		dial := dialContextOf(baseX)
+		transport = &http2.Transport{
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := dial(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+
+				if cfg.ServerName == "" {
+					cfg.ServerName, _, _ = net.SplitHostPort(addr)
+				}
+
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.HandshakeContext(ctx); err != nil {
+					conn.Close()
+					return nil, err
+				}
+
+				if protocol := tlsConn.ConnectionState().NegotiatedProtocol; protocol != http2.NextProtoTLS {
+					tlsConn.Close()
+					return nil, fmt.Errorf("upstream %s does not support HTTP/2, negotiated %q", addr, protocol)
+				}
+
+				return tlsConn, nil
+			},
+			TLSClientConfig:    baseX.TLSClientConfig.Clone(),
+			DisableCompression: baseX.DisableCompression,
+			ReadIdleTimeout:    upstreamReadIdleTimeout,
+			PingTimeout:        upstreamPingTimeout,
+		}
+	case UpstreamProtocolH2C:
+		dial := dialContextOf(baseX)
+		transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+			DisableCompression: baseX.DisableCompression,
+			ReadIdleTimeout:    upstreamReadIdleTimeout,
+			PingTimeout:        upstreamPingTimeout,
+		}
+	default:
+		return nil, checkUpstreamProtocol(protocol)
+	}
+
+	u.transports.Store(protocol, transport)
+	return transport, nil
+}
+
+func dialContextOf(t *http.Transport) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if t.DialContext != nil {
+		return t.DialContext
+	}
+
+	return (&net.Dialer{}).DialContext
+}
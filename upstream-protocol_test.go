@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func protoHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+}
+
+func TestUpstreamProtocolH2C(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(protoHandler(), &http2.Server{}))
+	defer backend.Close()
+
+	for protocol, expected := range map[string]string{
+		"":                    "HTTP/1.1",
+		UpstreamProtocolHTTP1: "HTTP/1.1",
+		UpstreamProtocolH2C:   "HTTP/2.0",
+	} {
+		p := NewSingleHost(backend.URL, &SingleHostConfig{UpstreamProtocol: protocol})
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Body.String() != expected {
+			t.Errorf("protocol %q: got %s; expected %s", protocol, rec.Body.String(), expected)
+		}
+	}
+}
+
+func TestUpstreamProtocolHTTP2(t *testing.T) {
+	backend := httptest.NewUnstartedServer(protoHandler())
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	// only HTTP/1.1
+	backend1 := httptest.NewTLSServer(protoHandler())
+	defer backend1.Close()
+
+	testcases := []struct {
+		backend  string
+		protocol string
+		expected string
+	}{
+		{backend.URL, "", "HTTP/2.0"},
+		{backend.URL, UpstreamProtocolHTTP1, "HTTP/1.1"},
+		{backend.URL, UpstreamProtocolHTTP2, "HTTP/2.0"},
+		{backend1.URL, UpstreamProtocolHTTP2, ""},
+	}
+
+	for _, tc := range testcases {
+		p := NewSingleHost(tc.backend, &SingleHostConfig{UpstreamProtocol: tc.protocol})
+		p.Transport = &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if tc.expected == "" {
+			if rec.Code != http.StatusBadGateway {
+				t.Errorf("protocol %q: got status %d; expected %d without HTTP/2", tc.protocol, rec.Code, http.StatusBadGateway)
+			}
+			continue
+		}
+		if rec.Body.String() != tc.expected {
+			t.Errorf("protocol %q: got %s; expected %s", tc.protocol, rec.Body.String(), tc.expected)
+		}
+	}
+}
+
+func TestUpstreamProtocolMultiHosts(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(protoHandler(), &http2.Server{}))
+	defer backend.Close()
+	host, port := ParseHostPort(backend.Listener.Addr().String())
+	portN, _ := net.LookupPort("tcp", port)
+
+	p := NewMultiHosts(&MultiHostsConfig{
+		Routes: []MultiHostsRoute{
+			{Host: "h2c.example.com", Backend: MultiHostsRouteBackend{ServiceName: host, ServicePort: int64(portN), UpstreamProtocol: UpstreamProtocolH2C}},
+			{Host: "http1.example.com", Backend: MultiHostsRouteBackend{ServiceName: host, ServicePort: int64(portN)}},
+		},
+	})
+
+	for host, expected := range map[string]string{"h2c.example.com": "HTTP/2.0", "http1.example.com": "HTTP/1.1"} {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil))
+		if rec.Body.String() != expected {
+			t.Errorf("%s: got %s; expected %s", host, rec.Body.String(), expected)
+		}
+	}
+
+	invalid := NewMultiHosts(&MultiHostsConfig{
+		Routes: []MultiHostsRoute{{Host: "example.com", Backend: MultiHostsRouteBackend{ServiceName: host, UpstreamProtocol: "spdy"}}},
+	})
+	rec := httptest.NewRecorder()
+	invalid.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("got status %d; expected %d for an invalid protocol", rec.Code, http.StatusBadGateway)
+	}
+}
+
+func TestH2CHandler(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(protoHandler(), &http2.Server{}))
+	defer backend.Close()
+
+	p := NewSingleHost(backend.URL, &SingleHostConfig{UpstreamProtocol: UpstreamProtocolH2C})
+	var clientProto string
+	onRequest := p.OnRequest
+	p.OnRequest = func(req, inReq *http.Request) error {
+		clientProto = inReq.Proto
+		return onRequest(req, inReq)
+	}
+	server := httptest.NewServer(p.H2CHandler())
+	defer server.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if clientProto != "HTTP/2.0" || string(body) != "HTTP/2.0" {
+		t.Errorf("got client %s, upstream %s; expected HTTP/2.0 both ways", clientProto, body)
+	}
+}
+
+func TestUpstreamTransports(t *testing.T) {
+	var u upstreamTransports
+	for _, protocol := range []string{UpstreamProtocolHTTP2, UpstreamProtocolH2C} {
+		transport, err := u.get(protocol, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h2, ok := transport.(*http2.Transport)
+		if !ok || h2.ReadIdleTimeout == 0 || h2.PingTimeout == 0 {
+			t.Errorf("%s: got %T; expected an HTTP/2 transport with health checks", protocol, transport)
+		}
+		if again, _ := u.get(protocol, nil); again != transport {
+			t.Errorf("%s: expected the transport to be reused", protocol)
+		}
+	}
+}
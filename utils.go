@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
 	"net"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/hostport"
 	"golang.org/x/net/http/httpguts"
 )
 
@@ -59,16 +61,13 @@ func cleanRequestHeaders(h http.Header, inReq *http.Request) {
 	}
 }
 
-func addRequestHeaders(h http.Header, req *http.Request, isAnonymouse bool) {
-	// real ip
-	h.Set(headers.XRealIP, req.RemoteAddr)
+func addRequestHeaders(h http.Header, req *http.Request, clientIP string, isAnonymouse bool) {
+	// real ip, without port
+	h.Set(headers.XRealIP, clientIP)
 
 	// x-forwarded-XXXX
-	host, port := ParseHostPort(req.Host)
-	scheme := req.URL.Scheme
-	if scheme == "" {
-		scheme = "http"
-	}
+	scheme := requestScheme(req)
+	host, port := ParseHostPort(req.Host, scheme)
 
 	// if not anonymouse, add headers:
 	//   x-forwarded-proto
@@ -76,11 +75,35 @@ func addRequestHeaders(h http.Header, req *http.Request, isAnonymouse bool) {
 	//   x-forwarded-port
 	if !isAnonymouse {
 		h.Set(headers.XForwardedProto, scheme)
-		h.Set(headers.XForwardedHost, host)
+		h.Set(headers.XForwardedHost, hostport.Join(host, ""))
 		h.Set(headers.XForwardedPort, port)
 	}
 }
 
+// requestScheme returns the scheme the client requested, resolved through the trusted proxies,
+// see forwardedResolver.scheme, or the scheme of the request received by the proxy.
+func requestScheme(req *http.Request) string {
+	if scheme, ok := req.Context().Value(schemeKey).(string); ok {
+		return scheme
+	}
+
+	return connScheme(req)
+}
+
+// connScheme returns the scheme of the request received by the proxy,
+// https if it came over TLS, the scheme of absolute-form requests, or http.
+func connScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+
+	if req.URL.Scheme != "" {
+		return req.URL.Scheme
+	}
+
+	return "http"
+}
+
 func updateRequestUpgradeHeaders(h http.Header, upgrade string) {
 	// After stripping all the hop-by-hop connection headers above, add back any
 	// necessary for protocol upgrades, such as for websockets
@@ -216,7 +239,8 @@ func defaultOnError(err error, rw http.ResponseWriter, req *http.Request) {
 
 	// panic(err)
 
-	if errX, ok := err.(*HTTPError); ok {
+	var errX *HTTPError
+	if errors.As(err, &errX) {
 		if errX.Status() != 0 {
 			status = errX.Status()
 		}
@@ -234,17 +258,18 @@ func defaultOnError(err error, rw http.ResponseWriter, req *http.Request) {
 	rw.Write([]byte(message))
 }
 
-// ParseHostPort parses host and port from a string in the form host[:port].
-func ParseHostPort(rawHost string) (string, string) {
-	arr := strings.Split(rawHost, ":")
-	host := arr[0]
-	port := ""
-	if len(arr) > 1 {
-		port = arr[1]
-	}
-
+// ParseHostPort parses host and port from a string in the form host[:port],
+// IPv6 addresses may be in brackets, which are removed from host.
+// The port defaults to the default port of scheme, 80 without scheme, see hostport.DefaultPort.
+func ParseHostPort(rawHost string, scheme ...string) (string, string) {
+	host, port := hostport.Split(rawHost)
 	if port == "" {
-		port = "80"
+		schemeX := ""
+		if len(scheme) != 0 {
+			schemeX = scheme[0]
+		}
+
+		port = hostport.DefaultPort(schemeX)
 	}
 
 	return host, port
@@ -266,13 +291,26 @@ func (c switchProtocolCopier) copyToBackend(errc chan<- error) {
 	errc <- err
 }
 
-type writeFlusher interface {
-	io.Writer
-	http.Flusher
+// flusherOf returns the flush function of w, through http.ResponseController
+// for response writers, so wrapped writers are flushed, nil if w can't be flushed.
+func flusherOf(w io.Writer) func() error {
+	if rw, ok := w.(http.ResponseWriter); ok {
+		return http.NewResponseController(rw).Flush
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		return func() error {
+			f.Flush()
+			return nil
+		}
+	}
+
+	return nil
 }
 
 type maxLatencyWriter struct {
-	dst     writeFlusher
+	dst     io.Writer
+	flush   func() error
 	latency time.Duration // non-zero; negative means to flush immediately
 
 	mu           sync.Mutex // protects t, flushPending, and dst.Flush
@@ -286,7 +324,7 @@ func (m *maxLatencyWriter) Write(p []byte) (n int, err error) {
 
 	n, err = m.dst.Write(p)
 	if m.latency < 0 {
-		m.dst.Flush()
+		m.flush()
 		return
 	}
 
@@ -312,7 +350,7 @@ func (m *maxLatencyWriter) delayedFlush() {
 		return
 	}
 
-	m.dst.Flush()
+	m.flush()
 	m.flushPending = false
 }
 
@@ -0,0 +1,222 @@
+// Package contentcoding decodes and encodes http bodies by Content-Encoding.
+//
+// Supported encodings are gzip, deflate, br and zstd, and lists of them,
+// like "gzip, br", which means gzip was applied first.
+package contentcoding
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Writer is an encoding writer, Flush writes the pending data,
+// so streaming responses can be flushed.
+type Writer interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// UnsupportedError is returned for unsupported content encodings.
+type UnsupportedError struct {
+	Encoding string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported content encoding: %s", e.Encoding)
+}
+
+// Parse parses the Content-Encoding header into the list of encodings,
+// in the order they were applied, identity is dropped.
+func Parse(encoding string) []string {
+	var encodings []string
+	for _, e := range strings.Split(encoding, ",") {
+		if e = normalize(e); e != "" && e != "identity" {
+			encodings = append(encodings, e)
+		}
+	}
+
+	return encodings
+}
+
+// IsIdentity returns true if encoding means no encoding.
+func IsIdentity(encoding string) bool {
+	return len(Parse(encoding)) == 0
+}
+
+// IsSupported returns true if encoding can be decoded and encoded.
+func IsSupported(encoding string) bool {
+	for _, e := range Parse(encoding) {
+		if !isSupported(e) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isSupported(encoding string) bool {
+	switch encoding {
+	case "gzip", "x-gzip", "deflate", "br", "zstd":
+		return true
+	}
+
+	return false
+}
+
+// NewReader returns a reader decoding r, encodings are decoded in reverse order.
+func NewReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	encodings := Parse(encoding)
+	if err := checkSupported(encodings); err != nil {
+		return nil, err
+	}
+
+	chain := &readerChain{Reader: r}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoder, err := newReader(chain.Reader, encodings[i])
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+
+		chain.Reader = decoder
+		chain.closers = append(chain.closers, decoder)
+	}
+
+	return chain, nil
+}
+
+// NewWriter returns a writer encoding to w, it must be closed to write the pending data.
+func NewWriter(w io.Writer, encoding string) (Writer, error) {
+	encodings := Parse(encoding)
+	if err := checkSupported(encodings); err != nil {
+		return nil, err
+	}
+
+	// the first encoding is applied first, so it is the outermost writer
+	chain := &writerChain{Writer: w}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		encoder, err := newWriter(chain.Writer, encodings[i])
+		if err != nil {
+			return nil, err
+		}
+
+		chain.Writer = encoder
+		chain.writers = append([]Writer{encoder}, chain.writers...)
+	}
+
+	return chain, nil
+}
+
+func checkSupported(encodings []string) error {
+	for _, e := range encodings {
+		if !isSupported(e) {
+			return &UnsupportedError{e}
+		}
+	}
+
+	return nil
+}
+
+func newReader(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return newDeflateReader(r)
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return nil, &UnsupportedError{encoding}
+}
+
+func newWriter(w io.Writer, encoding string) (Writer, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+
+	return nil, &UnsupportedError{encoding}
+}
+
+func normalize(encoding string) string {
+	return strings.ToLower(strings.TrimSpace(encoding))
+}
+
+// newDeflateReader decodes deflate, which is zlib by the spec (RFC 9110),
+// but raw deflate is sent by some servers, so both are accepted.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+
+	return flate.NewReader(br), nil
+}
+
+type readerChain struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (c *readerChain) Close() error {
+	var err error
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		if cerr := c.closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// writerChain writes to the outermost writer, writers are ordered from outermost to innermost.
+type writerChain struct {
+	io.Writer
+	writers []Writer
+}
+
+func (c *writerChain) Flush() error {
+	for _, w := range c.writers {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *writerChain) Close() error {
+	for _, w := range c.writers {
+		if err := w.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
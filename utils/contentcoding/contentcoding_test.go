@@ -0,0 +1,73 @@
+package contentcoding
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	text := strings.Repeat("<p>hello world</p>", 100)
+
+	for _, encoding := range []string{"", "identity", "gzip", "deflate", "br", "zstd", "gzip, br", "zstd,gzip"} {
+		var encoded bytes.Buffer
+		w, err := NewWriter(&encoded, encoding)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if _, err := w.Write([]byte(text)); err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+
+		r, err := NewReader(&encoded, encoding)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		r.Close()
+
+		if string(decoded) != text {
+			t.Errorf("%s: round trip mismatch", encoding)
+		}
+	}
+}
+
+func TestMultipleEncodingsOrder(t *testing.T) {
+	var encoded bytes.Buffer
+	w, _ := NewWriter(&encoded, "br, gzip")
+	w.Write([]byte("hello"))
+	w.Close()
+
+	// gzip is applied last, so it is the outermost layer
+	if _, err := gzip.NewReader(bytes.NewReader(encoded.Bytes())); err != nil {
+		t.Errorf("expected the outermost layer to be gzip, got %v", err)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	if IsSupported("gzip, compress") {
+		t.Errorf("compress should not be supported")
+	}
+
+	_, err := NewReader(strings.NewReader(""), "gzip, compress")
+	var unsupported *UnsupportedError
+	if !errors.As(err, &unsupported) || unsupported.Encoding != "compress" {
+		t.Errorf("expected UnsupportedError(compress), got %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	if g, e := Parse(" GZIP, identity,br "), []string{"gzip", "br"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("got %v, expected %v", g, e)
+	}
+}
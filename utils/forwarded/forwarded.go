@@ -0,0 +1,217 @@
+// Package forwarded parses and formats the Forwarded header, RFC 7239.
+//
+// See https://www.rfc-editor.org/rfc/rfc7239
+package forwarded
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Header is the name of the header.
+const Header = "Forwarded"
+
+// Element is the information added by one proxy, the values are unquoted.
+type Element struct {
+	// For is the node making the request to the proxy, like 192.0.2.60,
+	//	"[2001:db8::1]:4711", an obfuscated identifier like _hidden, or unknown.
+	For string
+	// By is the node of the proxy receiving the request.
+	By string
+	// Host is the Host header of the request received by the proxy.
+	Host string
+	// Proto is the scheme of the request received by the proxy, http or https.
+	Proto string
+}
+
+// String returns the element in its wire format, values are quoted if needed.
+func (e Element) String() string {
+	var pairs []string
+	for _, pair := range [][2]string{{"for", e.For}, {"by", e.By}, {"host", e.Host}, {"proto", e.Proto}} {
+		if pair[1] != "" {
+			pairs = append(pairs, pair[0]+"="+quote(pair[1]))
+		}
+	}
+
+	return strings.Join(pairs, ";")
+}
+
+// Format returns the elements in their wire format, one header value.
+func Format(elements []Element) string {
+	values := make([]string, len(elements))
+	for i, e := range elements {
+		values[i] = e.String()
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// Parse parses the values of the header, in order, unknown parameters are ignored.
+func Parse(values []string) ([]Element, error) {
+	var elements []Element
+	for _, value := range values {
+		p := &parser{s: value}
+		for {
+			e, err := p.element()
+			if err != nil {
+				return nil, fmt.Errorf("invalid forwarded header %q: %v", value, err)
+			}
+			elements = append(elements, e)
+
+			p.skipSpaces()
+			if p.eof() {
+				break
+			}
+			if p.s[p.i] != ',' {
+				return nil, fmt.Errorf("invalid forwarded header %q: unexpected %q", value, p.s[p.i])
+			}
+			p.i++
+		}
+	}
+
+	return elements, nil
+}
+
+// Node returns the node for ip, and port if not empty, IPv6 addresses are in brackets.
+func Node(ip net.IP, port string) string {
+	node := ip.String()
+	if ip.To4() == nil {
+		node = "[" + node + "]"
+	}
+
+	if port != "" {
+		node += ":" + port
+	}
+
+	return node
+}
+
+// NodeIP returns the IP of node, nil for obfuscated identifiers and unknown.
+func NodeIP(node string) net.IP {
+	if strings.HasPrefix(node, "[") {
+		end := strings.Index(node, "]")
+		if end < 0 {
+			return nil
+		}
+
+		return net.ParseIP(node[1:end])
+	}
+
+	host := node
+	if i := strings.LastIndex(node, ":"); i >= 0 {
+		host = node[:i]
+	}
+
+	return net.ParseIP(host)
+}
+
+type parser struct {
+	s string
+	i int
+}
+
+func (p *parser) eof() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *parser) skipSpaces() {
+	for !p.eof() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *parser) element() (Element, error) {
+	var e Element
+	for {
+		p.skipSpaces()
+		name := p.token()
+		if name == "" || p.eof() || p.s[p.i] != '=' {
+			return e, fmt.Errorf("expected a parameter at %d", p.i)
+		}
+		p.i++
+
+		value, err := p.value()
+		if err != nil {
+			return e, err
+		}
+
+		switch strings.ToLower(name) {
+		case "for":
+			e.For = value
+		case "by":
+			e.By = value
+		case "host":
+			e.Host = value
+		case "proto":
+			e.Proto = strings.ToLower(value)
+		}
+
+		p.skipSpaces()
+		if p.eof() || p.s[p.i] != ';' {
+			return e, nil
+		}
+		p.i++
+	}
+}
+
+func (p *parser) token() string {
+	start := p.i
+	for !p.eof() && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+
+	return p.s[start:p.i]
+}
+
+func (p *parser) value() (string, error) {
+	if p.eof() || p.s[p.i] != '"' {
+		if value := p.token(); value != "" {
+			return value, nil
+		}
+
+		return "", fmt.Errorf("expected a value at %d", p.i)
+	}
+
+	p.i++
+	var b strings.Builder
+	for !p.eof() {
+		c := p.s[p.i]
+		p.i++
+
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", fmt.Errorf("unterminated quoted string")
+			}
+			c = p.s[p.i]
+			p.i++
+		}
+		b.WriteByte(c)
+	}
+
+	return "", fmt.Errorf("unterminated quoted string")
+}
+
+func quote(value string) string {
+	for i := 0; i < len(value); i++ {
+		if !isTokenChar(value[i]) {
+			r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+			return `"` + r.Replace(value) + `"`
+		}
+	}
+
+	return value
+}
+
+// isTokenChar returns true for tchar of RFC 7230.
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,69 @@
+package forwarded
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	elements, err := Parse([]string{
+		`for="_gazonk"`,
+		`For="[2001:db8:cafe::17]:4711"`,
+		`for=192.0.2.60;proto=HTTP;by=203.0.113.43, for=198.51.100.17;host="example.com"`,
+		`for=unknown;secret=x`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Element{
+		{For: "_gazonk"},
+		{For: "[2001:db8:cafe::17]:4711"},
+		{For: "192.0.2.60", Proto: "http", By: "203.0.113.43"},
+		{For: "198.51.100.17", Host: "example.com"},
+		{For: "unknown"},
+	}
+	if !reflect.DeepEqual(elements, expected) {
+		t.Errorf("got %+v; expected %+v", elements, expected)
+	}
+
+	for _, value := range []string{`for`, `for=`, `for="192.0.2.60`, `for=192.0.2.60 for=192.0.2.61`, `;`} {
+		if _, err := Parse([]string{value}); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	value := Format([]Element{
+		{For: Node(net.ParseIP("192.0.2.60"), ""), Proto: "https", Host: "example.com"},
+		{For: Node(net.ParseIP("2001:db8::17"), "4711"), By: "_proxy"},
+	})
+	if expected := `for=192.0.2.60;host=example.com;proto=https, for="[2001:db8::17]:4711";by=_proxy`; value != expected {
+		t.Errorf("got %s; expected %s", value, expected)
+	}
+
+	elements, err := Parse([]string{value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elements[1].For != "[2001:db8::17]:4711" {
+		t.Errorf("got %q after a round trip", elements[1].For)
+	}
+}
+
+func TestNodeIP(t *testing.T) {
+	for node, expected := range map[string]string{
+		"192.0.2.60":               "192.0.2.60",
+		"192.0.2.60:80":            "192.0.2.60",
+		"[2001:db8:cafe::17]":      "2001:db8:cafe::17",
+		"[2001:db8:cafe::17]:4711": "2001:db8:cafe::17",
+		"_gazonk":                  "<nil>",
+		"unknown":                  "<nil>",
+	} {
+		if got := NodeIP(node).String(); got != expected {
+			t.Errorf("%s: got %s; expected %s", node, got, expected)
+		}
+	}
+}
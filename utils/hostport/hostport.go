@@ -0,0 +1,82 @@
+// Package hostport parses the host[:port] of Host headers and URLs,
+// with bracketed IPv6 addresses, IDNA hostnames and the default ports of schemes.
+package hostport
+
+import (
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Split separates host and port of hostport, the brackets of IPv6 addresses are removed,
+// port is empty if there is none.
+// If the port is not numeric, it returns the entire input as host, like url.URL.Hostname.
+func Split(hostport string) (host, port string) {
+	host = hostport
+
+	colon := strings.LastIndexByte(host, ':')
+	// a colon inside the brackets belongs to the IPv6 address
+	if colon != -1 && colon > strings.LastIndexByte(host, ']') && isNumeric(host[colon+1:]) {
+		host, port = host[:colon], host[colon+1:]
+	}
+
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	} else if port != "" && strings.Contains(host, ":") {
+		// an unbracketed IPv6 address, like ::1, the last group is not a port
+		return hostport, ""
+	}
+
+	return host, port
+}
+
+// Join joins host and port, IPv6 addresses are in brackets, port may be empty.
+func Join(host, port string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if port == "" {
+		return host
+	}
+
+	return host + ":" + port
+}
+
+// DefaultPort returns the default port of scheme, 443 for https and wss, 80 otherwise.
+func DefaultPort(scheme string) string {
+	switch strings.ToLower(scheme) {
+	case "https", "wss":
+		return "443"
+	}
+
+	return "80"
+}
+
+// Normalize returns host in lower case, IDNA hostnames in their ASCII form (punycode),
+// without the trailing dot of fully qualified names. IP addresses are returned as is,
+// and invalid hostnames are only lower-cased.
+func Normalize(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if net.ParseIP(host) != nil {
+		return host
+	}
+
+	ascii, err := idna.Lookup.ToASCII(host)
+	if err != nil {
+		return host
+	}
+
+	return ascii
+}
+
+func isNumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,57 @@
+package hostport
+
+import "testing"
+
+func TestSplit(t *testing.T) {
+	for hostport, expected := range map[string][2]string{
+		"example.com":      {"example.com", ""},
+		"example.com:8080": {"example.com", "8080"},
+		"example.com:":     {"example.com", ""},
+		"[::1]:8080":       {"::1", "8080"},
+		"[::1]":            {"::1", ""},
+		"::1":              {"::1", ""},
+		"2001:db8::1":      {"2001:db8::1", ""},
+		"127.0.0.1:80":     {"127.0.0.1", "80"},
+		"example.com:http": {"example.com:http", ""},
+	} {
+		host, port := Split(hostport)
+		if host != expected[0] || port != expected[1] {
+			t.Errorf("%s: got %q %q; expected %q %q", hostport, host, port, expected[0], expected[1])
+		}
+	}
+}
+
+func TestJoin(t *testing.T) {
+	for _, tc := range [][3]string{
+		{"example.com", "8080", "example.com:8080"},
+		{"example.com", "", "example.com"},
+		{"::1", "8080", "[::1]:8080"},
+		{"::1", "", "[::1]"},
+	} {
+		if got := Join(tc[0], tc[1]); got != tc[2] {
+			t.Errorf("got %s; expected %s", got, tc[2])
+		}
+	}
+}
+
+func TestDefaultPort(t *testing.T) {
+	for scheme, expected := range map[string]string{"http": "80", "https": "443", "WSS": "443", "ws": "80", "": "80"} {
+		if got := DefaultPort(scheme); got != expected {
+			t.Errorf("%s: got %s; expected %s", scheme, got, expected)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for host, expected := range map[string]string{
+		"Example.COM.":          "example.com",
+		"bücher.example":        "xn--bcher-kva.example",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+		"2001:DB8::1":           "2001:db8::1",
+		"under_score.com":       "under_score.com",
+	} {
+		if got := Normalize(host); got != expected {
+			t.Errorf("%s: got %s; expected %s", host, got, expected)
+		}
+	}
+}
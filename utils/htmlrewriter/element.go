@@ -0,0 +1,106 @@
+package htmlrewriter
+
+import (
+	"golang.org/x/net/html"
+)
+
+// Element is a matched element, passed to the handlers.
+//
+// Content passed to Before, After, Prepend, Append and SetInnerContent
+// is written as raw html.
+type Element struct {
+	token *html.Token
+
+	changed  bool
+	removed  bool
+	replaced bool
+
+	before  []string
+	after   []string
+	prepend []string
+	append  []string
+	inner   string
+}
+
+// TagName returns the lower case tag name.
+func (e *Element) TagName() string {
+	return e.token.Data
+}
+
+// GetAttribute returns the attribute value.
+func (e *Element) GetAttribute(name string) (string, bool) {
+	return getAttribute(e.token, name)
+}
+
+// HasAttribute returns true if the element has the attribute.
+func (e *Element) HasAttribute(name string) bool {
+	_, ok := getAttribute(e.token, name)
+	return ok
+}
+
+// SetAttribute sets the attribute value, adds it if not exists.
+func (e *Element) SetAttribute(name, value string) {
+	e.changed = true
+
+	for i := range e.token.Attr {
+		if e.token.Attr[i].Namespace == "" && e.token.Attr[i].Key == name {
+			e.token.Attr[i].Val = value
+			return
+		}
+	}
+
+	e.token.Attr = append(e.token.Attr, html.Attribute{Key: name, Val: value})
+}
+
+// RemoveAttribute removes the attribute.
+func (e *Element) RemoveAttribute(name string) {
+	attrs := e.token.Attr[:0]
+	for _, attr := range e.token.Attr {
+		if attr.Namespace == "" && attr.Key == name {
+			e.changed = true
+			continue
+		}
+
+		attrs = append(attrs, attr)
+	}
+
+	e.token.Attr = attrs
+}
+
+// Before inserts content before the element.
+func (e *Element) Before(content string) {
+	e.before = append(e.before, content)
+}
+
+// After inserts content after the element.
+func (e *Element) After(content string) {
+	e.after = append(e.after, content)
+}
+
+// Prepend inserts content right after the start tag.
+func (e *Element) Prepend(content string) {
+	e.prepend = append(e.prepend, content)
+}
+
+// Append inserts content right before the end tag,
+// for example, Append on body injects before </body>.
+func (e *Element) Append(content string) {
+	e.append = append(e.append, content)
+}
+
+// SetInnerContent replaces the content of the element.
+func (e *Element) SetInnerContent(content string) {
+	e.replaced = true
+	e.inner = content
+}
+
+// Remove removes the element with its content,
+// content inserted with Before and After is kept.
+func (e *Element) Remove() {
+	e.removed = true
+}
+
+// IsRemoved returns true if the element is removed.
+func (e *Element) IsRemoved() bool {
+	return e.removed
+}
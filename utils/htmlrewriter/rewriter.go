@@ -0,0 +1,274 @@
+// Package htmlrewriter rewrites html in a streaming way, like Cloudflare HTMLRewriter.
+//
+// The document is tokenized as it is read, matched elements are passed to
+// the handlers and the output is produced token by token, the document is never
+// buffered as a whole. Tokens not touched by any handler are written byte for byte.
+//
+// Example:
+//
+//	r := htmlrewriter.New()
+//	r.On("a[href^='https://upstream.com']", func(e *htmlrewriter.Element) {
+//		href, _ := e.GetAttribute("href")
+//		e.SetAttribute("href", strings.Replace(href, "https://upstream.com", "", 1))
+//	})
+//	r.On("head", func(e *htmlrewriter.Element) {
+//		e.Append(`<script src="/inject.js"></script>`)
+//	})
+//	r.On("script[src*=tracker]", func(e *htmlrewriter.Element) {
+//		e.Remove()
+//	})
+//	io.Copy(dst, r.Reader(src))
+package htmlrewriter
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Rewriter is a set of element handlers, it is safe to use for multiple documents concurrently.
+type Rewriter struct {
+	handlers []handler
+}
+
+type handler struct {
+	selectors []*selector
+	fn        func(e *Element)
+}
+
+// New creates a new Rewriter.
+func New() *Rewriter {
+	return &Rewriter{}
+}
+
+// On registers fn for the elements matching selector,
+// handlers are called in registration order.
+func (r *Rewriter) On(selector string, fn func(e *Element)) error {
+	selectors, err := parseSelectors(selector)
+	if err != nil {
+		return err
+	}
+
+	r.handlers = append(r.handlers, handler{selectors, fn})
+	return nil
+}
+
+// Reader returns a reader of the rewritten src.
+func (r *Rewriter) Reader(src io.Reader) io.Reader {
+	return &reader{
+		rewriter:  r,
+		tokenizer: html.NewTokenizer(src),
+	}
+}
+
+// Rewrite rewrites src to dst.
+func (r *Rewriter) Rewrite(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, r.Reader(src))
+	return err
+}
+
+// RewriteString rewrites the html string.
+func (r *Rewriter) RewriteString(s string) (string, error) {
+	var b strings.Builder
+	if err := r.Rewrite(&b, strings.NewReader(s)); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+func (r *Rewriter) match(token *html.Token) *Element {
+	var element *Element
+	for _, h := range r.handlers {
+		for _, sel := range h.selectors {
+			if !sel.match(token) {
+				continue
+			}
+
+			if element == nil {
+				element = &Element{token: token}
+			}
+			h.fn(element)
+			break
+		}
+	}
+
+	return element
+}
+
+type openElement struct {
+	name    string
+	element *Element
+	// skip means the content of the element is not written.
+	skip bool
+}
+
+type reader struct {
+	rewriter  *Rewriter
+	tokenizer *html.Tokenizer
+
+	buf   bytes.Buffer
+	stack []openElement
+	err   error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 && r.err == nil {
+		r.next()
+	}
+
+	if r.buf.Len() != 0 {
+		return r.buf.Read(p)
+	}
+
+	return 0, r.err
+}
+
+func (r *reader) next() {
+	tokenType := r.tokenizer.Next()
+	switch tokenType {
+	case html.ErrorToken:
+		// close the elements left open, so appended content is not lost
+		for len(r.stack) != 0 {
+			r.close(r.pop(), nil)
+		}
+
+		r.err = r.tokenizer.Err()
+	case html.StartTagToken, html.SelfClosingTagToken:
+		// copied, Token lowercases the tag name in place
+		raw := append([]byte(nil), r.tokenizer.Raw()...)
+		token := r.tokenizer.Token()
+		isVoid := tokenType == html.SelfClosingTagToken || voidElements[token.Data]
+
+		if r.skipping() {
+			if !isVoid {
+				r.stack = append(r.stack, openElement{name: token.Data, skip: true})
+			}
+			return
+		}
+
+		element := r.rewriter.match(&token)
+		if element == nil {
+			r.buf.Write(raw)
+			if !isVoid {
+				r.stack = append(r.stack, openElement{name: token.Data})
+			}
+			return
+		}
+
+		r.writeAll(element.before)
+		if !element.removed {
+			if element.changed {
+				r.buf.WriteString(token.String())
+			} else {
+				r.buf.Write(raw)
+			}
+
+			r.writeAll(element.prepend)
+			if element.replaced {
+				r.buf.WriteString(element.inner)
+			}
+		}
+
+		if isVoid {
+			r.writeAll(element.after)
+			return
+		}
+
+		r.stack = append(r.stack, openElement{
+			name:    token.Data,
+			element: element,
+			skip:    element.removed || element.replaced,
+		})
+	case html.EndTagToken:
+		// copied, TagName lowercases in place
+		raw := append([]byte(nil), r.tokenizer.Raw()...)
+		name, _ := r.tokenizer.TagName()
+
+		index := -1
+		for i := len(r.stack) - 1; i >= 0; i-- {
+			if r.stack[i].name == string(name) {
+				index = i
+				break
+			}
+		}
+
+		if index == -1 {
+			if !r.skipping() {
+				r.buf.Write(raw)
+			}
+			return
+		}
+
+		// elements implicitly closed by this end tag
+		for len(r.stack)-1 > index {
+			r.close(r.pop(), nil)
+		}
+		r.close(r.pop(), raw)
+	default:
+		if !r.skipping() {
+			r.buf.Write(r.tokenizer.Raw())
+		}
+	}
+}
+
+// close writes the end of the element, raw is the end tag, nil if implicitly closed.
+func (r *reader) close(o openElement, raw []byte) {
+	if r.skipping() {
+		return
+	}
+
+	if o.element == nil {
+		r.buf.Write(raw)
+		return
+	}
+
+	if !o.element.removed {
+		r.writeAll(o.element.append)
+		r.buf.Write(raw)
+	}
+	r.writeAll(o.element.after)
+}
+
+func (r *reader) pop() openElement {
+	o := r.stack[len(r.stack)-1]
+	r.stack = r.stack[:len(r.stack)-1]
+	return o
+}
+
+// skipping returns true if any open element skips its content.
+func (r *reader) skipping() bool {
+	for i := range r.stack {
+		if r.stack[i].skip {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *reader) writeAll(contents []string) {
+	for _, content := range contents {
+		r.buf.WriteString(content)
+	}
+}
+
+// voidElements have no end tag.
+var voidElements = map[string]bool{
+	"area":   true,
+	"base":   true,
+	"br":     true,
+	"col":    true,
+	"embed":  true,
+	"hr":     true,
+	"img":    true,
+	"input":  true,
+	"link":   true,
+	"meta":   true,
+	"param":  true,
+	"source": true,
+	"track":  true,
+	"wbr":    true,
+}
@@ -0,0 +1,165 @@
+package htmlrewriter
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const document = `<!DOCTYPE html>
+<html>
+<head><title>Test</title><link rel="stylesheet" href="https://upstream.com/app.css"></head>
+<body class="page">
+<a href="https://upstream.com/foo" class="link external">foo</a>
+<div id="ads"><p>buy <b>now</b></p></div>
+<script>if (a < b) { document.write("</div>") }</script>
+<img src="/logo.png" />
+</body>
+</html>`
+
+func TestRewrite(t *testing.T) {
+	r := New()
+	if err := r.On(`a[href^="https://upstream.com"], link[rel=stylesheet]`, func(e *Element) {
+		name := "href"
+		value, _ := e.GetAttribute(name)
+		e.SetAttribute(name, strings.Replace(value, "https://upstream.com", "", 1))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.On("head", func(e *Element) {
+		e.Append(`<script src="/inject.js"></script>`)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.On("body.page", func(e *Element) {
+		e.Prepend("<header></header>")
+		e.Append("<footer></footer>")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.On("#ads", func(e *Element) {
+		e.Remove()
+		e.After("<!-- ads removed -->")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.On("img", func(e *Element) {
+		e.RemoveAttribute("src")
+		e.SetAttribute("alt", `"logo"`)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.RewriteString(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<!DOCTYPE html>
+<html>
+<head><title>Test</title><link rel="stylesheet" href="/app.css"><script src="/inject.js"></script></head>
+<body class="page"><header></header>
+<a href="/foo" class="link external">foo</a>
+<!-- ads removed -->
+<script>if (a < b) { document.write("</div>") }</script>
+<img alt="&#34;logo&#34;"/>
+<footer></footer></body>
+</html>`
+	if got != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", got, expected)
+	}
+}
+
+func TestRewriteUntouched(t *testing.T) {
+	r := New()
+	if err := r.On("video", func(e *Element) {
+		e.Remove()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := r.RewriteString(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != document {
+		t.Errorf("got:\n%s\nexpected the document untouched", got)
+	}
+}
+
+func TestRewriteKeepsCase(t *testing.T) {
+	r := New()
+	if err := r.On("span", func(e *Element) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	const mixed = `<DIV Class="A"><SPAN ID="x">Hello</SPAN></DIV>`
+	got, err := r.RewriteString(mixed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != mixed {
+		t.Errorf("got %q; expected %q", got, mixed)
+	}
+}
+
+func TestSetInnerContentAndUnclosed(t *testing.T) {
+	r := New()
+	r.On("title", func(e *Element) {
+		e.SetInnerContent("Proxied")
+	})
+	r.On("body", func(e *Element) {
+		e.Append("<footer></footer>")
+	})
+
+	got, err := r.RewriteString(`<html><head><title>Origin <b>x</b></title></head><body><p>unclosed`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<html><head><title>Proxied</title></head><body><p>unclosed<footer></footer>`
+	if got != expected {
+		t.Errorf("got %s, expected %s", got, expected)
+	}
+}
+
+// chunkedReader returns at most one byte per read, like a slow upstream.
+type chunkedReader struct {
+	s string
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if c.s == "" {
+		return 0, io.EOF
+	}
+
+	p[0] = c.s[0]
+	c.s = c.s[1:]
+	return 1, nil
+}
+
+func TestStreaming(t *testing.T) {
+	r := New()
+	r.On("a", func(e *Element) {
+		e.SetAttribute("rel", "noopener")
+	})
+
+	var b strings.Builder
+	if err := r.Rewrite(&b, &chunkedReader{`<p>hello <a href="/">world</a></p>`}); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := `<p>hello <a href="/" rel="noopener">world</a></p>`; b.String() != expected {
+		t.Errorf("got %s, expected %s", b.String(), expected)
+	}
+}
+
+func TestInvalidSelector(t *testing.T) {
+	for _, s := range []string{"", "div p", "a[href", "a[href!=x]", "#"} {
+		if err := New().On(s, func(e *Element) {}); err == nil {
+			t.Errorf("expected selector %q to be invalid", s)
+		}
+	}
+}
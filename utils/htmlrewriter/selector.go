@@ -0,0 +1,218 @@
+package htmlrewriter
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// selector is a compound selector, like a#id.class[attr^="value"].
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []attrSelector
+}
+
+type attrSelector struct {
+	name     string
+	operator string
+	value    string
+}
+
+// parseSelectors parses a comma separated list of compound selectors.
+//
+// Supported:
+//
+//	*, tag, #id, .class,
+//	[attr], [attr=value], [attr~=value], [attr|=value], [attr^=value], [attr$=value], [attr*=value]
+//
+// Combinators (descendant, child, sibling) are not supported.
+func parseSelectors(s string) ([]*selector, error) {
+	var selectors []*selector
+	for _, part := range strings.Split(s, ",") {
+		sel, err := parseSelector(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector(%s): %v", s, err)
+		}
+
+		selectors = append(selectors, sel)
+	}
+
+	return selectors, nil
+}
+
+func parseSelector(s string) (*selector, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty selector")
+	}
+
+	sel := &selector{}
+	i := 0
+	if s[0] == '*' {
+		i++
+	} else {
+		name := readIdent(s, i)
+		sel.tag = strings.ToLower(name)
+		i += len(name)
+	}
+
+	for i < len(s) {
+		switch s[i] {
+		case '#':
+			name := readIdent(s, i+1)
+			if name == "" {
+				return nil, fmt.Errorf("empty id at %d", i)
+			}
+			sel.id = name
+			i += 1 + len(name)
+		case '.':
+			name := readIdent(s, i+1)
+			if name == "" {
+				return nil, fmt.Errorf("empty class at %d", i)
+			}
+			sel.classes = append(sel.classes, name)
+			i += 1 + len(name)
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("unclosed attribute selector at %d", i)
+			}
+
+			attr, err := parseAttrSelector(s[i+1 : i+end])
+			if err != nil {
+				return nil, err
+			}
+			sel.attrs = append(sel.attrs, attr)
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("unsupported character %q at %d", s[i], i)
+		}
+	}
+
+	return sel, nil
+}
+
+func parseAttrSelector(s string) (attrSelector, error) {
+	name := readIdent(s, 0)
+	if name == "" {
+		return attrSelector{}, fmt.Errorf("empty attribute name")
+	}
+
+	attr := attrSelector{name: strings.ToLower(name)}
+	rest := strings.TrimSpace(s[len(name):])
+	if rest == "" {
+		return attr, nil
+	}
+
+	index := strings.IndexByte(rest, '=')
+	if index == -1 || index > 1 {
+		return attrSelector{}, fmt.Errorf("invalid attribute selector: %s", s)
+	}
+
+	attr.operator = rest[:index+1]
+	switch attr.operator {
+	case "=", "~=", "|=", "^=", "$=", "*=":
+	default:
+		return attrSelector{}, fmt.Errorf("invalid attribute operator: %s", attr.operator)
+	}
+
+	value := strings.TrimSpace(rest[index+1:])
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		value = value[1 : len(value)-1]
+	}
+	attr.value = value
+
+	return attr, nil
+}
+
+func readIdent(s string, start int) string {
+	end := start
+	for end < len(s) {
+		c := s[end]
+		if c == '-' || c == '_' || c == ':' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			end++
+			continue
+		}
+		break
+	}
+
+	return s[start:end]
+}
+
+func (s *selector) match(token *html.Token) bool {
+	if s.tag != "" && s.tag != token.Data {
+		return false
+	}
+
+	if s.id != "" {
+		if id, ok := getAttribute(token, "id"); !ok || id != s.id {
+			return false
+		}
+	}
+
+	if len(s.classes) != 0 {
+		class, _ := getAttribute(token, "class")
+		classes := strings.Fields(class)
+		for _, c := range s.classes {
+			if !contains(classes, c) {
+				return false
+			}
+		}
+	}
+
+	for _, attr := range s.attrs {
+		if !attr.match(token) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (a *attrSelector) match(token *html.Token) bool {
+	value, ok := getAttribute(token, a.name)
+	if !ok {
+		return false
+	}
+
+	switch a.operator {
+	case "":
+		return true
+	case "=":
+		return value == a.value
+	case "~=":
+		return contains(strings.Fields(value), a.value)
+	case "|=":
+		return value == a.value || strings.HasPrefix(value, a.value+"-")
+	case "^=":
+		return a.value != "" && strings.HasPrefix(value, a.value)
+	case "$=":
+		return a.value != "" && strings.HasSuffix(value, a.value)
+	case "*=":
+		return a.value != "" && strings.Contains(value, a.value)
+	}
+
+	return false
+}
+
+func getAttribute(token *html.Token, name string) (string, bool) {
+	for _, attr := range token.Attr {
+		if attr.Namespace == "" && attr.Key == name {
+			return attr.Val, true
+		}
+	}
+
+	return "", false
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,219 @@
+// Package httprule parses and matches the path templates of google.api.http rules,
+// like /v1/{name=shelves/*}/books/{book_id}:publish.
+//
+// See https://github.com/googleapis/googleapis/blob/master/google/api/http.proto
+package httprule
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	literal segmentKind = iota
+	// single matches one segment, *
+	single
+	// multi matches the rest of the segments, **
+	multi
+)
+
+type segment struct {
+	kind  segmentKind
+	value string
+}
+
+// variable is a field bound to the segments from start to end, end excluded.
+type variable struct {
+	field      string
+	start, end int
+}
+
+// Template is a compiled path template.
+type Template struct {
+	raw       string
+	segments  []segment
+	variables []variable
+	verb      string
+}
+
+// Parse compiles the path template.
+func Parse(template string) (*Template, error) {
+	if !strings.HasPrefix(template, "/") {
+		return nil, fmt.Errorf("httprule: template %q must start with /", template)
+	}
+
+	t := &Template{raw: template}
+	rest := template[1:]
+
+	// the verb follows the last colon outside of the variables
+	if i := strings.LastIndexByte(rest, ':'); i >= 0 && i > strings.LastIndexByte(rest, '}') {
+		rest, t.verb = rest[:i], rest[i+1:]
+	}
+
+	for rest != "" {
+		var token string
+		if strings.HasPrefix(rest, "{") {
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("httprule: unterminated variable in %q", template)
+			}
+			token, rest = rest[:end+1], rest[end+1:]
+		} else if end := strings.IndexByte(rest, '/'); end >= 0 {
+			token, rest = rest[:end], rest[end:]
+		} else {
+			token, rest = rest, ""
+		}
+
+		if err := t.add(token); err != nil {
+			return nil, fmt.Errorf("httprule: %q: %v", template, err)
+		}
+
+		if rest != "" {
+			if rest[0] != '/' {
+				return nil, fmt.Errorf("httprule: %q: expected / after %q", template, token)
+			}
+			rest = rest[1:]
+			if rest == "" {
+				return nil, fmt.Errorf("httprule: %q: trailing /", template)
+			}
+		}
+	}
+
+	for i, s := range t.segments {
+		if s.kind == multi && i != len(t.segments)-1 {
+			return nil, fmt.Errorf("httprule: %q: ** must be the last segment", template)
+		}
+	}
+
+	return t, nil
+}
+
+func (t *Template) add(token string) error {
+	if !strings.HasPrefix(token, "{") {
+		t.segments = append(t.segments, parseSegment(token))
+		return nil
+	}
+
+	field, pattern := token[1:len(token)-1], "*"
+	if i := strings.IndexByte(field, '='); i >= 0 {
+		field, pattern = field[:i], field[i+1:]
+	}
+	if field == "" || pattern == "" {
+		return fmt.Errorf("invalid variable %s", token)
+	}
+
+	start := len(t.segments)
+	for _, s := range strings.Split(pattern, "/") {
+		if s == "" || strings.ContainsAny(s, "{}") {
+			return fmt.Errorf("invalid variable %s", token)
+		}
+		t.segments = append(t.segments, parseSegment(s))
+	}
+
+	t.variables = append(t.variables, variable{field: field, start: start, end: len(t.segments)})
+	return nil
+}
+
+func parseSegment(s string) segment {
+	switch s {
+	case "*":
+		return segment{kind: single}
+	case "**":
+		return segment{kind: multi}
+	}
+
+	return segment{kind: literal, value: s}
+}
+
+// String returns the template.
+func (t *Template) String() string {
+	return t.raw
+}
+
+// Verb returns the custom verb, like publish, empty if none.
+func (t *Template) Verb() string {
+	return t.verb
+}
+
+// Match matches the escaped path, like url.URL.EscapedPath, and returns the values
+// of the variables by field path, like name or book.id.
+func (t *Template) Match(path string) (map[string]string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	path = path[1:]
+
+	if t.verb != "" {
+		if !strings.HasSuffix(path, ":"+t.verb) {
+			return nil, false
+		}
+		path = strings.TrimSuffix(path, ":"+t.verb)
+	}
+
+	parts := strings.Split(path, "/")
+	// the start of each template segment in parts, ** spans the rest
+	positions := make([]int, len(t.segments)+1)
+	i := 0
+	for j, s := range t.segments {
+		positions[j] = i
+		switch s.kind {
+		case literal:
+			if i >= len(parts) || parts[i] != s.value {
+				return nil, false
+			}
+			i++
+		case single:
+			if i >= len(parts) || parts[i] == "" {
+				return nil, false
+			}
+			i++
+		case multi:
+			i = len(parts)
+		}
+	}
+	positions[len(t.segments)] = i
+	if i != len(parts) {
+		return nil, false
+	}
+
+	values := map[string]string{}
+	for _, v := range t.variables {
+		raw := parts[positions[v.start]:positions[v.end]]
+		// a single segment is unescaped entirely, multiple segments keep their slashes
+		value := strings.Join(raw, "/")
+		if v.end-v.start == 1 && t.segments[v.start].kind != multi {
+			unescaped, err := url.PathUnescape(value)
+			if err != nil {
+				return nil, false
+			}
+			value = unescaped
+		} else {
+			var err error
+			if value, err = unescapeKeepSlashes(raw); err != nil {
+				return nil, false
+			}
+		}
+
+		values[v.field] = value
+	}
+
+	return values, true
+}
+
+func unescapeKeepSlashes(parts []string) (string, error) {
+	unescaped := make([]string, len(parts))
+	for i, part := range parts {
+		// %2F stays escaped, it is not a separator
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "%2F", "%252F"), "%2f", "%252f")
+		value, err := url.PathUnescape(part)
+		if err != nil {
+			return "", err
+		}
+		unescaped[i] = value
+	}
+
+	return strings.Join(unescaped, "/"), nil
+}
@@ -0,0 +1,47 @@
+package httprule
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	testcases := []struct {
+		template string
+		path     string
+		ok       bool
+		values   map[string]string
+	}{
+		{"/v1/messages/{message_id}", "/v1/messages/123", true, map[string]string{"message_id": "123"}},
+		{"/v1/messages/{message_id}", "/v1/messages/a%20b", true, map[string]string{"message_id": "a b"}},
+		{"/v1/messages/{message_id}", "/v1/messages/123/x", false, nil},
+		{"/v1/messages/{message_id}", "/v1/messages/", false, nil},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books/2", true, map[string]string{"name": "shelves/1/books/2"}},
+		{"/v1/{name=shelves/*/books/*}", "/v1/shelves/1/books", false, nil},
+		{"/v1/shelves/{shelf.id}/books/{book_id}", "/v1/shelves/1/books/2", true, map[string]string{"shelf.id": "1", "book_id": "2"}},
+		{"/v1/files/{path=**}", "/v1/files/a/b/c.txt", true, map[string]string{"path": "a/b/c.txt"}},
+		{"/v1/messages/{message_id}:publish", "/v1/messages/1:publish", true, map[string]string{"message_id": "1"}},
+		{"/v1/messages/{message_id}:publish", "/v1/messages/1", false, nil},
+		{"/v1/*/items", "/v1/anything/items", true, map[string]string{}},
+	}
+
+	for _, tc := range testcases {
+		tmpl, err := Parse(tc.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values, ok := tmpl.Match(tc.path)
+		if ok != tc.ok || (ok && !reflect.DeepEqual(values, tc.values)) {
+			t.Errorf("%s %s: got %v %v; expected %v %v", tc.template, tc.path, values, ok, tc.values, tc.ok)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, template := range []string{"v1/messages", "/v1/{name", "/v1/**/x", "/v1/messages/", "/v1/{=*}", "/v1/{name}x"} {
+		if _, err := Parse(template); err == nil {
+			t.Errorf("%s: expected an error", template)
+		}
+	}
+}
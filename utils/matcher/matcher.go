@@ -0,0 +1,229 @@
+// Package matcher matches hostnames against a list of route patterns.
+//
+// Patterns are regular expressions, matched in order, the first match wins.
+// To scale to large route tables, two kinds of patterns are indexed instead
+// of being scanned one by one:
+//
+//	^app\.example\.com$   exact hostname, looked up in a map
+//	*.example.com         wildcard, any subdomain of example.com, looked up in a label trie
+//
+// All other patterns are compiled once and scanned in order, only up to the
+// best indexed candidate.
+//
+// Hosts are matched in their normalized form, see hostport.Normalize, so literal
+// hostnames in patterns are normalized too, and the other patterns are case-insensitive.
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-zoox/proxy/utils/hostport"
+)
+
+// Matcher is a compiled list of host patterns.
+type Matcher struct {
+	exact    map[string]int
+	wildcard *node
+	regexps  []entry
+	size     int
+}
+
+type entry struct {
+	index int
+	re    *regexp.Regexp
+}
+
+// node is a trie node keyed by reversed domain labels.
+type node struct {
+	children map[string]*node
+	index    int
+}
+
+func newNode() *node {
+	return &node{
+		children: map[string]*node{},
+		index:    -1,
+	}
+}
+
+// New compiles the patterns, returns an error if any pattern is invalid.
+func New(patterns ...string) (*Matcher, error) {
+	m := &Matcher{
+		exact:    map[string]int{},
+		wildcard: newNode(),
+		size:     len(patterns),
+	}
+
+	for index, pattern := range patterns {
+		pattern = normalize(pattern)
+
+		if host, ok := parseWildcard(pattern); ok {
+			m.addWildcard(host, index)
+			continue
+		}
+
+		if host, ok := parseExact(pattern); ok {
+			if _, exists := m.exact[host]; !exists {
+				m.exact[host] = index
+			}
+			continue
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern(%s): %v", pattern, err)
+		}
+
+		m.regexps = append(m.regexps, entry{index, re})
+	}
+
+	return m, nil
+}
+
+// Len returns the number of patterns.
+func (m *Matcher) Len() int {
+	return m.size
+}
+
+// Match returns the index of the first pattern matching host.
+func (m *Matcher) Match(host string) (int, bool) {
+	best := -1
+	if index, ok := m.exact[host]; ok {
+		best = index
+	}
+
+	// walk the trie from the top level domain,
+	//	keeping at least one label for the wildcard to match.
+	labels := strings.Split(host, ".")
+	current := m.wildcard
+	for i := len(labels) - 1; i >= 1; i-- {
+		current = current.children[labels[i]]
+		if current == nil {
+			break
+		}
+
+		if current.index != -1 && (best == -1 || current.index < best) {
+			best = current.index
+		}
+	}
+
+	// regexps are sorted by index, so the first match is the earliest one.
+	for _, e := range m.regexps {
+		if best != -1 && e.index > best {
+			break
+		}
+
+		if e.re.MatchString(host) {
+			best = e.index
+			break
+		}
+	}
+
+	return best, best != -1
+}
+
+// normalize normalizes the hostname of *.example.com, and of patterns that are
+// a literal hostname, anchored or not, like ^App\.Example\.com$ or münchen.de.
+// Other patterns are matched case-insensitively.
+func normalize(pattern string) string {
+	if strings.HasPrefix(pattern, "*.") {
+		return "*." + hostport.Normalize(pattern[2:])
+	}
+
+	prefix, raw, suffix := "", pattern, ""
+	if strings.HasPrefix(raw, "^") {
+		prefix, raw = "^", raw[1:]
+	}
+	if strings.HasSuffix(raw, "$") {
+		raw, suffix = raw[:len(raw)-1], "$"
+	}
+
+	literal := strings.ReplaceAll(raw, `\.`, "")
+	// a trailing unescaped dot matches any character, it is not the dot of fully qualified names
+	if raw == "" || strings.HasSuffix(literal, ".") || strings.ContainsAny(literal, `\+*?()|[]{}^$`) {
+		return "(?i)" + pattern
+	}
+
+	host := hostport.Normalize(strings.ReplaceAll(raw, `\.`, "."))
+	if strings.Contains(raw, `\.`) {
+		host = regexp.QuoteMeta(host)
+	}
+
+	return prefix + host + suffix
+}
+
+func (m *Matcher) addWildcard(domain string, index int) {
+	labels := strings.Split(domain, ".")
+	current := m.wildcard
+	for i := len(labels) - 1; i >= 0; i-- {
+		next, ok := current.children[labels[i]]
+		if !ok {
+			next = newNode()
+			current.children[labels[i]] = next
+		}
+		current = next
+	}
+
+	if current.index == -1 {
+		current.index = index
+	}
+}
+
+// parseWildcard parses *.example.com, returns example.com.
+//
+//	It is not a valid regular expression, so it cannot be confused with one.
+func parseWildcard(pattern string) (string, bool) {
+	if !strings.HasPrefix(pattern, "*.") {
+		return "", false
+	}
+
+	domain := pattern[2:]
+	if !isHostname(domain) {
+		return "", false
+	}
+
+	return domain, true
+}
+
+// parseExact parses ^app\.example\.com$, returns app.example.com.
+//
+//	Unescaped dots match any character, so they are left to the regexp engine.
+func parseExact(pattern string) (string, bool) {
+	if len(pattern) < 2 || pattern[0] != '^' || pattern[len(pattern)-1] != '$' {
+		return "", false
+	}
+
+	raw := pattern[1 : len(pattern)-1]
+	if strings.Contains(strings.ReplaceAll(raw, `\.`, ""), ".") {
+		return "", false
+	}
+
+	host := strings.ReplaceAll(raw, `\.`, ".")
+	if !isHostname(host) {
+		return "", false
+	}
+
+	return host, true
+}
+
+func isHostname(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z':
+		case 'A' <= c && c <= 'Z':
+		case '0' <= c && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,173 @@
+package matcher
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	m, err := New(
+		`^api\.example\.com$`,
+		`*.example.com`,
+		`^www\.example\.com$`,
+		`^static\d+\.example\.org$`,
+		`example`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host  string
+		index int
+		ok    bool
+	}{
+		{"api.example.com", 0, true},
+		{"foo.example.com", 1, true},
+		{"a.b.example.com", 1, true},
+		// the wildcard comes first
+		{"www.example.com", 1, true},
+		{"static1.example.org", 3, true},
+		{"example.com", 4, true},
+		{"example.net", 4, true},
+		{"foo.org", -1, false},
+	}
+
+	for _, c := range cases {
+		index, ok := m.Match(c.host)
+		if index != c.index || ok != c.ok {
+			t.Errorf("Match(%s) = (%d, %v), want (%d, %v)", c.host, index, ok, c.index, c.ok)
+		}
+	}
+}
+
+func TestMatchNormalized(t *testing.T) {
+	m, err := New(
+		`^App\.Example\.com$`,
+		`*.Wild.Example.com`,
+		`^bücher\.example\.com$`,
+		`^Static\d+\.example\.org$`,
+		`^fqdn\.example\.com\.$`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host  string
+		index int
+	}{
+		{"app.example.com", 0},
+		{"foo.wild.example.com", 1},
+		{"xn--bcher-kva.example.com", 2},
+		{"static1.example.org", 3},
+		{"fqdn.example.com", 4},
+	}
+
+	for _, c := range cases {
+		if index, ok := m.Match(c.host); !ok || index != c.index {
+			t.Errorf("Match(%s) = (%d, %v), want (%d, true)", c.host, index, ok, c.index)
+		}
+	}
+}
+
+func TestMatchSameAsRegexp(t *testing.T) {
+	patterns := []string{
+		`^a.example.com$`,
+		`^b\.example\.com$`,
+		`c\.example\.com`,
+	}
+	m, err := New(patterns...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"a.example.com", "axexample.com", "b.example.com", "bxexample.com", "xc.example.com.cn"} {
+		want := -1
+		for i, pattern := range patterns {
+			if regexp.MustCompile(pattern).MatchString(host) {
+				want = i
+				break
+			}
+		}
+
+		if got, _ := m.Match(host); got != want {
+			t.Errorf("Match(%s) = %d, want %d", host, got, want)
+		}
+	}
+}
+
+func TestInvalidPattern(t *testing.T) {
+	if _, err := New(`^(api\.example\.com$`); err == nil {
+		t.Errorf("expected invalid pattern error")
+	}
+}
+
+func createPatterns(n int) []string {
+	patterns := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		switch i % 3 {
+		case 0:
+			patterns = append(patterns, fmt.Sprintf(`^service%d\.example\.com$`, i))
+		case 1:
+			patterns = append(patterns, fmt.Sprintf(`*.tenant%d.example.com`, i))
+		default:
+			patterns = append(patterns, fmt.Sprintf(`^service%d\.example\.net$`, i))
+		}
+	}
+	return patterns
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, n := range []int{10, 100, 1000, 10000} {
+		patterns := createPatterns(n)
+		// the last wildcard route, the worst case for a linear scan
+		last := n - 1
+		for last%3 != 1 {
+			last--
+		}
+		host := fmt.Sprintf("app.tenant%d.example.com", last)
+
+		b.Run(fmt.Sprintf("matcher/%d", n), func(b *testing.B) {
+			m, err := New(patterns...)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, ok := m.Match(host); !ok {
+					b.Fatalf("%s should match", host)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			// the same table as a list of regexps, compiled once
+			res := make([]*regexp.Regexp, n)
+			for i, pattern := range patterns {
+				if i%3 == 1 {
+					pattern = `^[^.]+(\.[^.]+)*` + regexp.QuoteMeta(pattern[1:]) + `$`
+				}
+				res[i] = regexp.MustCompile(pattern)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				matched := false
+				for _, re := range res {
+					if re.MatchString(host) {
+						matched = true
+						break
+					}
+				}
+				if !matched {
+					b.Fatalf("%s should match", host)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-zoox/proxy/utils/ipnet"
+)
+
+// Listener wraps a listener whose connections start with a PROXY header,
+// the connections report the addresses of the header, so req.RemoteAddr of
+// net/http is the client address instead of the balancer address.
+type Listener struct {
+	net.Listener
+
+	// Trusted are the sources allowed to send the header, the header of other sources
+	// is not parsed, and the connections keep their own addresses.
+	//	Empty trusts no source, use 0.0.0.0/0 and ::/0 to trust all of them.
+	Trusted []*net.IPNet
+
+	// ReadHeaderTimeout is the timeout to read the header.
+	//	Default is 10s.
+	ReadHeaderTimeout time.Duration
+}
+
+// NewListener wraps l, trusted are the CIDRs or IPs allowed to send the header,
+// at least one is required, as any client could spoof its address otherwise.
+//
+// Example:
+//
+//	l, _ := net.Listen("tcp", ":8080")
+//	pl, err := proxyprotocol.NewListener(l, "10.0.0.0/8")
+//	http.Serve(pl, proxy.NewSingleHost("http://127.0.0.1:8081"))
+func NewListener(l net.Listener, trusted ...string) (*Listener, error) {
+	if len(trusted) == 0 {
+		return nil, errors.New("proxyprotocol: trusted sources are required")
+	}
+
+	nets, err := ParseCIDRs(trusted...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{Listener: l, Trusted: nets}, nil
+}
+
+// ParseCIDRs parses CIDRs, IPs are single addresses, see ipnet.Parse.
+func ParseCIDRs(values ...string) ([]*net.IPNet, error) {
+	nets, err := ipnet.Parse(values...)
+	if err != nil {
+		return nil, fmt.Errorf("proxyprotocol: %v", err)
+	}
+
+	return nets, nil
+}
+
+// Accept returns the next connection, the header of trusted sources is read
+// on the first Read, RemoteAddr or LocalAddr, not to block the accept loop.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !l.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	timeout := l.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &Conn{Conn: conn, r: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	ip, _ := splitAddr(addr)
+	return ipnet.Contains(l.Trusted, ip)
+}
+
+// Conn is a connection of a trusted source, which may start with a PROXY header.
+type Conn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *Header
+	err    error
+}
+
+// Header returns the header, nil if the connection has none.
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+	return c.header, c.err
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.header, c.err = Read(c.r)
+	if errors.Is(c.err, ErrNoHeader) {
+		// balancers may skip it, like for health checks
+		c.err = nil
+	}
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the source address of the header, if any.
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Source != nil {
+		return h.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address of the header, if any.
+func (c *Conn) LocalAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Destination != nil {
+		return h.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the connection, if supported.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return errors.New("half-close is not supported")
+}
@@ -0,0 +1,261 @@
+// Package proxyprotocol reads and writes the HAProxy PROXY protocol, v1 and v2,
+// which L4 load balancers send first on connections, to tell the client address.
+//
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ErrNoHeader is returned by Read if the connection does not start with a PROXY header.
+var ErrNoHeader = errors.New("proxyprotocol: no header")
+
+// signature is the v2 signature.
+var signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// v1MaxLength is the max length of a v1 header, CRLF included.
+const v1MaxLength = 107
+
+// Header is a PROXY header.
+type Header struct {
+	// Version is 1 or 2.
+	Version int
+	// Local means the connection is made by the balancer itself, like health checks,
+	// the addresses are not sent.
+	Local bool
+	// Source is the client address, nil if unknown, *net.TCPAddr or *net.UDPAddr.
+	Source net.Addr
+	// Destination is the address the client connected to, nil if unknown.
+	Destination net.Addr
+}
+
+// Read reads the header at the beginning of r, returns ErrNoHeader if there is none,
+// in which case nothing is consumed.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case 'P':
+		if prefix, err := r.Peek(6); err != nil || string(prefix) != "PROXY " {
+			return nil, ErrNoHeader
+		}
+		return readV1(r)
+	case '\r':
+		if prefix, err := r.Peek(len(signature)); err != nil || !bytes.Equal(prefix, signature) {
+			return nil, ErrNoHeader
+		}
+		return readV2(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxyprotocol: v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: 1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// the addresses are ignored
+		return h, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("proxyprotocol: invalid v1 header %q", line)
+	}
+
+	var err error
+	if h.Source, err = parseV1Addr(fields[1], fields[2], fields[4]); err != nil {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[1], fields[3], fields[5]); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func parseV1Addr(family, ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (family == "TCP4") != (addr.To4() != nil) {
+		return nil, fmt.Errorf("proxyprotocol: invalid %s address %q", family, ip)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("proxyprotocol: invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	if fixed[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxyprotocol: invalid v2 version %d", fixed[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 2}
+	switch fixed[12] & 0x0f {
+	case 0x00:
+		h.Local = true
+		return h, nil
+	case 0x01:
+	default:
+		return nil, fmt.Errorf("proxyprotocol: invalid v2 command %d", fixed[12]&0x0f)
+	}
+
+	family, transport := fixed[13]>>4, fixed[13]&0x0f
+	var size int
+	switch family {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		// unspecified or unix, the addresses are ignored
+		return h, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, errors.New("proxyprotocol: v2 addresses too short")
+	}
+
+	srcIP, dstIP := net.IP(payload[:size]), net.IP(payload[size:2*size])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*size:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*size+2:]))
+	// the rest are TLVs, which are ignored
+	if transport == 0x2 {
+		h.Source = &net.UDPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.UDPAddr{IP: dstIP, Port: dstPort}
+	} else {
+		h.Source = &net.TCPAddr{IP: srcIP, Port: srcPort}
+		h.Destination = &net.TCPAddr{IP: dstIP, Port: dstPort}
+	}
+
+	return h, nil
+}
+
+// Format returns the header in its wire format.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case 1:
+		return h.formatV1(), nil
+	case 2:
+		return h.formatV2(), nil
+	}
+
+	return nil, fmt.Errorf("proxyprotocol: unsupported version %d", h.Version)
+}
+
+// WriteTo writes the header to w.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+func (h *Header) formatV1() []byte {
+	srcIP, srcPort := splitAddr(h.Source)
+	dstIP, dstPort := splitAddr(h.Destination)
+	if h.Local || srcIP == nil || dstIP == nil || (srcIP.To4() == nil) != (dstIP.To4() == nil) {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP4"
+	if srcIP.To4() == nil {
+		family = "TCP6"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort))
+}
+
+func (h *Header) formatV2() []byte {
+	b := append([]byte{}, signature...)
+
+	srcIP, srcPort := splitAddr(h.Source)
+	dstIP, dstPort := splitAddr(h.Destination)
+	if h.Local || srcIP == nil || dstIP == nil {
+		command := byte(0x21)
+		if h.Local {
+			command = 0x20
+		}
+		return append(b, command, 0x00, 0x00, 0x00)
+	}
+
+	family, size := byte(0x10), net.IPv4len
+	if srcIP.To4() == nil || dstIP.To4() == nil {
+		family, size = 0x20, net.IPv6len
+	}
+
+	transport := byte(0x1)
+	if _, ok := h.Source.(*net.UDPAddr); ok {
+		transport = 0x2
+	}
+
+	b = append(b, 0x21, family|transport)
+	b = binary.BigEndian.AppendUint16(b, uint16(2*size+4))
+	b = append(b, ipBytes(srcIP, size)...)
+	b = append(b, ipBytes(dstIP, size)...)
+	b = binary.BigEndian.AppendUint16(b, uint16(srcPort))
+	return binary.BigEndian.AppendUint16(b, uint16(dstPort))
+}
+
+func splitAddr(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+
+	return nil, 0
+}
+
+func ipBytes(ip net.IP, size int) []byte {
+	if size == net.IPv4len {
+		return ip.To4()
+	}
+
+	return ip.To16()
+}
@@ -0,0 +1,163 @@
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	tcp := func(addr string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", addr)
+		return a
+	}
+
+	testcases := []struct {
+		name   string
+		header *Header
+		wire   string
+	}{
+		{"v1 ipv4", &Header{Version: 1, Source: tcp("203.0.113.7:51234"), Destination: tcp("10.0.0.1:443")}, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\n"},
+		{"v1 ipv6", &Header{Version: 1, Source: tcp("[2001:db8::7]:51234"), Destination: tcp("[2001:db8::1]:443")}, "PROXY TCP6 2001:db8::7 2001:db8::1 51234 443\r\n"},
+		{"v1 unknown", &Header{Version: 1}, "PROXY UNKNOWN\r\n"},
+		{"v2 ipv4", &Header{Version: 2, Source: tcp("203.0.113.7:51234"), Destination: tcp("10.0.0.1:443")}, ""},
+		{"v2 ipv6", &Header{Version: 2, Source: tcp("[2001:db8::7]:51234"), Destination: tcp("[2001:db8::1]:443")}, ""},
+		{"v2 udp", &Header{Version: 2, Source: &net.UDPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 53}, Destination: &net.UDPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 53}}, ""},
+		{"v2 local", &Header{Version: 2, Local: true}, ""},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.header.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wire != "" && string(b) != tc.wire {
+				t.Errorf("got %q; expected %q", b, tc.wire)
+			}
+
+			r := bufio.NewReader(io.MultiReader(bytes.NewReader(b), strings.NewReader("GET / HTTP/1.1\r\n")))
+			h, err := Read(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Version != tc.header.Version || h.Local != tc.header.Local ||
+				addrString(h.Source) != addrString(tc.header.Source) ||
+				addrString(h.Destination) != addrString(tc.header.Destination) {
+				t.Errorf("got %+v; expected %+v", h, tc.header)
+			}
+			if tc.header.Source != nil && h.Source.Network() != tc.header.Source.Network() {
+				t.Errorf("got network %s; expected %s", h.Source.Network(), tc.header.Source.Network())
+			}
+
+			// the rest is untouched
+			if rest, _ := io.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("got rest %q", rest)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, wire := range []string{
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234\r\n",
+		"PROXY TCP4 2001:db8::7 10.0.0.1 51234 443\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234 70000\r\n",
+		"PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\n",
+		"PROXY " + strings.Repeat("A", 120) + "\r\n",
+		string(signature) + "\x31\x11\x00\x00",
+		string(signature) + "\x21\x11\x00\x04\x01\x02\x03\x04",
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(wire))); err == nil || err == ErrNoHeader {
+			t.Errorf("%q: got %v; expected an invalid header error", wire, err)
+		}
+	}
+
+	r := bufio.NewReader(strings.NewReader("PRI * HTTP/2.0\r\n"))
+	if _, err := Read(r); err != ErrNoHeader {
+		t.Errorf("got %v; expected %v", err, ErrNoHeader)
+	}
+	if r.Buffered() != len("PRI * HTTP/2.0\r\n") {
+		t.Errorf("expected nothing consumed without header")
+	}
+}
+
+func TestListener(t *testing.T) {
+	testcases := []struct {
+		name     string
+		trusted  []string
+		wire     string
+		expected string
+	}{
+		{"trusted", []string{"127.0.0.0/8"}, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello", "203.0.113.7:51234 hello"},
+		{"trusted ip", []string{"::1", "127.0.0.1"}, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello", "203.0.113.7:51234 hello"},
+		{"trusted without header", []string{"127.0.0.1"}, "hello", "127.0.0.1 hello"},
+		{"untrusted", []string{"10.0.0.0/8"}, "PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello", "127.0.0.1 PROXY TCP4 203.0.113.7 10.0.0.1 51234 443\r\nhello"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			pl, err := NewListener(l, tc.trusted...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			go func() {
+				conn, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(tc.wire))
+				conn.Close()
+			}()
+
+			conn, err := pl.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			body, _ := io.ReadAll(conn)
+			remote := conn.RemoteAddr().String()
+			if host, _, _ := net.SplitHostPort(remote); host == "127.0.0.1" {
+				remote = host
+			}
+			if got := remote + " " + string(body); got != tc.expected {
+				t.Errorf("got %q; expected %q", got, tc.expected)
+			}
+		})
+	}
+
+	if _, err := NewListener(nil, "10.0.0.0/33"); err == nil {
+		t.Errorf("expected an error for an invalid CIDR")
+	}
+	if nets, err := ParseCIDRs("10.0.0.0/8", "::1"); err != nil || len(nets) != 2 {
+		t.Errorf("got %v, %v; expected 2 networks", nets, err)
+	}
+	if _, err := NewListener(nil); err == nil {
+		t.Errorf("expected an error without trusted sources")
+	}
+
+	// struct literals without trusted sources trust none
+	l := &Listener{}
+	if l.isTrusted(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}) {
+		t.Errorf("expected no trusted source")
+	}
+}
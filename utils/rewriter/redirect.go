@@ -0,0 +1,222 @@
+package rewriter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Redirect types.
+const (
+	// RedirectTypeRegexp redirects paths matching From to To, the default.
+	RedirectTypeRegexp = ""
+	// RedirectTypeHTTPS redirects http to https.
+	RedirectTypeHTTPS = "https"
+	// RedirectTypeWWW redirects apex domain to www.
+	RedirectTypeWWW = "www"
+	// RedirectTypeApex redirects www to apex domain.
+	RedirectTypeApex = "apex"
+	// RedirectTypeTrailingSlash adds trailing slash to paths without file extension.
+	RedirectTypeTrailingSlash = "trailing-slash"
+	// RedirectTypeNoTrailingSlash removes trailing slash.
+	RedirectTypeNoTrailingSlash = "no-trailing-slash"
+)
+
+// Redirect is a redirect rule, answered directly with a 3xx status
+// and a Location, without contacting the upstream.
+//
+//	Regexp rule (default):
+//		From matches the path, To is the location, which supports $1 captures
+//		and may be a path or an absolute url.
+//	Canonicalization rules (https, www, apex, trailing-slash, no-trailing-slash):
+//		From, if set, matches the host the rule applies to.
+//		www applies to hosts with a single dot by default.
+type Redirect struct {
+	Type string `yaml:"type" json:"type"`
+	From string `yaml:"from" json:"from"`
+	To   string `yaml:"to" json:"to"`
+	// Status is one of 301, 302, 307, 308.
+	//	Default is 302 for regexp rules, 301 for canonicalization rules.
+	Status int `yaml:"status" json:"status"`
+	// IgnoreQuery drops the request query instead of appending it to the location.
+	IgnoreQuery bool `yaml:"ignore_query" json:"ignore_query"`
+
+	// re is From compiled by Compile
+	re *regexp.Regexp
+}
+
+// Compile compiles the rule, returns an error if the rule is invalid.
+func (r *Redirect) Compile() error {
+	switch r.Type {
+	case RedirectTypeRegexp, RedirectTypeHTTPS, RedirectTypeWWW, RedirectTypeApex, RedirectTypeTrailingSlash, RedirectTypeNoTrailingSlash:
+	default:
+		return fmt.Errorf("invalid redirect type(%s)", r.Type)
+	}
+
+	switch r.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect status(%d)", r.Status)
+	}
+
+	if r.From == "" {
+		if r.Type == RedirectTypeRegexp {
+			return fmt.Errorf("invalid redirect: from is required")
+		}
+
+		return nil
+	}
+
+	re, err := regexp.Compile(r.From)
+	if err != nil {
+		return fmt.Errorf("invalid redirect(from: %s): %v", r.From, err)
+	}
+
+	r.re = re
+	return nil
+}
+
+// regexp returns From compiled, rules that are not compiled are compiled on every use.
+func (r *Redirect) regexp() (*regexp.Regexp, error) {
+	if r.re != nil {
+		return r.re, nil
+	}
+
+	return regexp.Compile(r.From)
+}
+
+// StatusCode returns the redirect status code.
+func (r *Redirect) StatusCode() int {
+	if r.Status != 0 {
+		return r.Status
+	}
+
+	if r.Type == RedirectTypeRegexp {
+		return http.StatusFound
+	}
+
+	return http.StatusMovedPermanently
+}
+
+// Redirect returns the location for the url u, which is the full url
+// the client requested, including scheme and host.
+func (r *Redirect) Redirect(u *url.URL) (string, bool) {
+	location, ok := r.location(u)
+	if !ok {
+		return "", false
+	}
+
+	if !r.IgnoreQuery && u.RawQuery != "" {
+		if strings.Contains(location, "?") {
+			location += "&" + u.RawQuery
+		} else {
+			location += "?" + u.RawQuery
+		}
+	}
+
+	return location, true
+}
+
+func (r *Redirect) location(u *url.URL) (string, bool) {
+	if r.Type == RedirectTypeRegexp {
+		re, err := r.regexp()
+		if err != nil || !re.MatchString(u.Path) {
+			return "", false
+		}
+
+		return re.ReplaceAllString(u.Path, r.To), true
+	}
+
+	hostname := u.Hostname()
+	if r.From != "" {
+		re, err := r.regexp()
+		if err != nil || !re.MatchString(hostname) {
+			return "", false
+		}
+	}
+
+	target := *u
+	target.RawQuery = ""
+	target.Fragment = ""
+
+	switch r.Type {
+	case RedirectTypeHTTPS:
+		if u.Scheme != "http" {
+			return "", false
+		}
+
+		target.Scheme = "https"
+		// the http port is meaningless for https
+		target.Host = hostname
+	case RedirectTypeWWW:
+		if strings.HasPrefix(hostname, "www.") {
+			return "", false
+		}
+
+		if r.From == "" && strings.Count(hostname, ".") != 1 {
+			return "", false
+		}
+
+		target.Host = "www." + u.Host
+	case RedirectTypeApex:
+		if !strings.HasPrefix(hostname, "www.") {
+			return "", false
+		}
+
+		target.Host = strings.TrimPrefix(u.Host, "www.")
+	case RedirectTypeTrailingSlash:
+		if strings.HasSuffix(u.Path, "/") {
+			return "", false
+		}
+
+		// files, like /app.js, keep their path
+		segment := u.Path[strings.LastIndex(u.Path, "/")+1:]
+		if strings.Contains(segment, ".") {
+			return "", false
+		}
+
+		target.Path = u.Path + "/"
+		target.RawPath = ""
+	case RedirectTypeNoTrailingSlash:
+		if u.Path == "/" || !strings.HasSuffix(u.Path, "/") {
+			return "", false
+		}
+
+		target.Path = strings.TrimRight(u.Path, "/")
+		if target.Path == "" {
+			target.Path = "/"
+		}
+		target.RawPath = ""
+	default:
+		return "", false
+	}
+
+	return target.String(), true
+}
+
+// Redirects is a list of redirect rules.
+type Redirects []Redirect
+
+// Compile compiles all the rules, returns the first error.
+func (r *Redirects) Compile() error {
+	for i := range *r {
+		if err := (*r)[i].Compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Redirect returns the location and status of the first matched rule.
+func (r *Redirects) Redirect(u *url.URL) (location string, status int, ok bool) {
+	for i := range *r {
+		if location, ok := (*r)[i].Redirect(u); ok {
+			return location, (*r)[i].StatusCode(), true
+		}
+	}
+
+	return "", 0, false
+}
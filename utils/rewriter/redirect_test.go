@@ -0,0 +1,80 @@
+package rewriter
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestRedirects(t *testing.T) {
+	rs := Redirects{
+		{Type: RedirectTypeHTTPS},
+		{Type: RedirectTypeWWW},
+		{From: "^/old/(.*)", To: "/new/$1", Status: 308},
+		{From: "^/docs$", To: "https://docs.example.com/?from=proxy"},
+		{Type: RedirectTypeTrailingSlash},
+	}
+	if err := rs.Compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		url      string
+		location string
+		status   int
+	}{
+		{"http://www.example.com/foo?a=b", "https://www.example.com/foo?a=b", 301},
+		{"https://example.com/foo", "https://www.example.com/foo", 301},
+		{"https://www.example.com/old/foo/bar?a=b", "/new/foo/bar?a=b", 308},
+		{"https://www.example.com/docs?a=b", "https://docs.example.com/?from=proxy&a=b", 302},
+		{"https://www.example.com/foo", "https://www.example.com/foo/", 301},
+		{"https://www.example.com/app.js", "", 0},
+		{"https://api.foo.example.com/foo/", "", 0},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		location, status, ok := rs.Redirect(u)
+		if ok != (c.location != "") || location != c.location || status != c.status {
+			t.Errorf("Redirect(%s) = (%s, %d, %v), want (%s, %d)", c.url, location, status, ok, c.location, c.status)
+		}
+	}
+}
+
+func TestRedirectCanonicalizations(t *testing.T) {
+	cases := []struct {
+		rule     Redirect
+		url      string
+		location string
+	}{
+		{Redirect{Type: RedirectTypeHTTPS}, "http://example.com:8080/foo", "https://example.com/foo"},
+		{Redirect{Type: RedirectTypeHTTPS}, "https://example.com/foo", ""},
+		{Redirect{Type: RedirectTypeApex}, "https://www.example.com/foo", "https://example.com/foo"},
+		{Redirect{Type: RedirectTypeWWW, From: `^example\.co\.uk$`}, "https://example.co.uk/", "https://www.example.co.uk/"},
+		{Redirect{Type: RedirectTypeNoTrailingSlash}, "https://example.com/foo/?a=b", "https://example.com/foo?a=b"},
+		{Redirect{Type: RedirectTypeNoTrailingSlash}, "https://example.com/", ""},
+		{Redirect{Type: RedirectTypeNoTrailingSlash, IgnoreQuery: true}, "https://example.com/foo/?a=b", "https://example.com/foo"},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse(c.url)
+		location, ok := c.rule.Redirect(u)
+		if ok != (c.location != "") || location != c.location {
+			t.Errorf("%s Redirect(%s) = (%s, %v), want %s", c.rule.Type, c.url, location, ok, c.location)
+		}
+	}
+}
+
+func TestRedirectCompile(t *testing.T) {
+	invalid := []Redirect{
+		{Type: "unknown"},
+		{From: "^/(.*", To: "/"},
+		{From: "^/old", To: "/new", Status: 200},
+		{To: "/new"},
+	}
+
+	for _, r := range invalid {
+		if err := r.Compile(); err == nil {
+			t.Errorf("expected %#v to be invalid", r)
+		}
+	}
+}
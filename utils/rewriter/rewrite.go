@@ -1,25 +1,61 @@
 package rewriter
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
 // Rewriter is a rewrite rule.
 type Rewriter struct {
 	From string `yaml:"from" json:"from"`
 	To   string `yaml:"to" json:"to"`
+
+	// re is From compiled by Compile
+	re *regexp.Regexp
+}
+
+// Compile compiles the rule, returns an error if From is not a valid regular expression.
+//
+//	The compiled rule is kept on the rule, rules that are not compiled are compiled on every use.
+func (r *Rewriter) Compile() error {
+	re, err := regexp.Compile(r.From)
+	if err != nil {
+		return fmt.Errorf("invalid rewriter(from: %s): %v", r.From, err)
+	}
+
+	r.re = re
+	return nil
 }
 
-func (r *Rewriter) re() *regexp.Regexp {
-	return regexp.MustCompile(r.From)
+func (r *Rewriter) regexp() *regexp.Regexp {
+	if r.re != nil {
+		return r.re
+	}
+
+	re, _ := regexp.Compile(r.From)
+	return re
 }
 
 // IsMatch returns true if the path matches the rule.
+// An invalid rule never matches, use Compile to validate it.
 func (r *Rewriter) IsMatch(path string) bool {
-	return r.re().MatchString(path)
+	re := r.regexp()
+	if re == nil {
+		return false
+	}
+
+	return re.MatchString(path)
 }
 
 // Rewrite rewrites the path.
 func (r *Rewriter) Rewrite(path string) string {
-	return r.re().ReplaceAllString(path, r.To)
+	re := r.regexp()
+	if re == nil {
+		return path
+	}
+
+	return re.ReplaceAllString(path, r.To)
 }
 
 // Rewriters is a list of rewrite rules.
@@ -33,13 +69,93 @@ func (r *Rewriters) Add(from, to string) {
 	})
 }
 
+// Compile compiles all the rules, returns the first error.
+func (r *Rewriters) Compile() error {
+	for i := range *r {
+		if err := (*r)[i].Compile(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Rewrite rewrites the path.
 func (r *Rewriters) Rewrite(path string) string {
-	for _, rewriter := range *r {
-		if rewriter.IsMatch(path) {
-			return rewriter.Rewrite(path)
+	for i := range *r {
+		if re := (*r)[i].regexp(); re != nil && re.MatchString(path) {
+			return re.ReplaceAllString(path, (*r)[i].To)
 		}
 	}
 
 	return path
 }
+
+// Reverse returns the rule rewriting paths back, for example,
+// ^/api/(.*) => /$1 is reversed to ^/(.*) => /api/$1.
+//
+// Only prefix rules, a literal with an optional trailing (.*) rewritten to
+// a literal with an optional trailing $1, can be reversed.
+func (r *Rewriter) Reverse() (Rewriter, bool) {
+	fromLiteral, fromGroup, ok := parsePrefixPattern(r.From)
+	if !ok {
+		return Rewriter{}, false
+	}
+
+	toLiteral, toGroup := r.To, false
+	for _, group := range []string{"${1}", "$1"} {
+		if strings.HasSuffix(r.To, group) {
+			toLiteral, toGroup = strings.TrimSuffix(r.To, group), true
+			break
+		}
+	}
+	if strings.Contains(toLiteral, "$") || fromGroup != toGroup {
+		return Rewriter{}, false
+	}
+
+	reversed := Rewriter{
+		From: "^" + regexp.QuoteMeta(toLiteral),
+		To:   fromLiteral,
+	}
+	if fromGroup {
+		reversed.From += "(.*)"
+		reversed.To += "$1"
+	}
+
+	// always valid, the literal is quoted
+	reversed.Compile()
+	return reversed, true
+}
+
+// parsePrefixPattern parses ^literal(.*)$, both anchors are optional.
+func parsePrefixPattern(pattern string) (literal string, group bool, ok bool) {
+	pattern = strings.TrimPrefix(pattern, "^")
+	pattern = strings.TrimSuffix(pattern, "$")
+	if strings.HasSuffix(pattern, "(.*)") {
+		pattern, group = strings.TrimSuffix(pattern, "(.*)"), true
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", false, false
+	}
+
+	literal, complete := re.LiteralPrefix()
+	if !complete {
+		return "", false, false
+	}
+
+	return literal, group, true
+}
+
+// Reverse returns the reversed rules, the rules that cannot be reversed are skipped.
+func (r *Rewriters) Reverse() Rewriters {
+	reversed := Rewriters{}
+	for i := range *r {
+		if rule, ok := (*r)[i].Reverse(); ok {
+			reversed = append(reversed, rule)
+		}
+	}
+
+	return reversed
+}
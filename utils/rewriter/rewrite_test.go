@@ -7,7 +7,7 @@ func TestRewrite(t *testing.T) {
 	from := "^/api/(.*)"
 	to := "/$1"
 
-	r := &Rewriter{from, to}
+	r := &Rewriter{From: from, To: to}
 	if !r.IsMatch(url) {
 		t.Errorf("%s should match %s", url, from)
 	}
@@ -19,8 +19,8 @@ func TestRewrite(t *testing.T) {
 
 func TestRewrites(t *testing.T) {
 	rs := Rewriters{
-		Rewriter{"^/api/foo/(.*)", "/$1"},
-		Rewriter{"^/api/(.*)", "/$1"},
+		Rewriter{From: "^/api/foo/(.*)", To: "/$1"},
+		Rewriter{From: "^/api/(.*)", To: "/$1"},
 	}
 
 	url := "/api/foo/bar"
@@ -28,3 +28,73 @@ func TestRewrites(t *testing.T) {
 		t.Errorf("%s should be rewritten to %s", url, "/bar")
 	}
 }
+
+func TestCompile(t *testing.T) {
+	rs := Rewriters{
+		Rewriter{From: "^/api/(.*)", To: "/$1"},
+		Rewriter{From: "^/api/(.*", To: "/$1"},
+	}
+
+	if err := rs[0].Compile(); err != nil {
+		t.Errorf("expected %s to compile, got %s", rs[0].From, err)
+	}
+
+	if err := rs.Compile(); err == nil {
+		t.Errorf("expected %s to fail to compile", rs[1].From)
+	}
+
+	if rs[1].IsMatch("/api/foo") {
+		t.Errorf("invalid rule %s should never match", rs[1].From)
+	}
+
+	if rs[1].Rewrite("/api/foo") != "/api/foo" {
+		t.Errorf("invalid rule %s should not rewrite", rs[1].From)
+	}
+	if rs[0].re == nil {
+		t.Errorf("expected %s to keep its compiled pattern", rs[0].From)
+	}
+}
+
+func BenchmarkRewrites(b *testing.B) {
+	rs := Rewriters{
+		Rewriter{From: "^/api/foo/(.*)", To: "/$1"},
+		Rewriter{From: "^/api/(.*)", To: "/$1"},
+	}
+	if err := rs.Compile(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.Rewrite("/api/foo/bar")
+	}
+}
+
+func TestReverse(t *testing.T) {
+	cases := []struct {
+		rule Rewriter
+		path string
+		want string
+		ok   bool
+	}{
+		{Rewriter{From: "^/api/(.*)", To: "/$1"}, "/foo/bar", "/api/foo/bar", true},
+		{Rewriter{From: "/api/v1/(.*)", To: "/v1/${1}"}, "/v1/foo", "/api/v1/foo", true},
+		{Rewriter{From: "/api/get", To: "/get"}, "/get?a=b", "/api/get?a=b", true},
+		{Rewriter{From: "^/api/(.*)/(.*)", To: "/$2/$1"}, "", "", false},
+		{Rewriter{From: "^/api/(.*)", To: "/static"}, "", "", false},
+		{Rewriter{From: "^/v1.0/(.*)", To: "/$1"}, "", "", false},
+	}
+
+	for _, c := range cases {
+		reversed, ok := c.rule.Reverse()
+		if ok != c.ok {
+			t.Errorf("%s => %s reversible: %v, want %v", c.rule.From, c.rule.To, ok, c.ok)
+			continue
+		}
+
+		if ok && reversed.Rewrite(c.path) != c.want {
+			t.Errorf("%s reversed %s => %s, want %s", c.rule.From, c.path, reversed.Rewrite(c.path), c.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Package sni reads the server name of TLS connections without terminating them,
+// for routing TLS passthrough by SNI.
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrNotTLS is returned by ServerName if the data does not start with a TLS handshake.
+var ErrNotTLS = errors.New("sni: not a tls handshake")
+
+// errDone stops the handshake once the ClientHello is read.
+var errDone = errors.New("sni: done")
+
+// ServerName reads the TLS ClientHello from r and returns its server name,
+// empty if the client sent none, and the bytes read, to be replayed to the upstream.
+//
+// The bytes read are returned with errors too, like ErrNotTLS.
+func ServerName(r io.Reader) (string, []byte, error) {
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return "", nil, err
+	}
+
+	// handshake record
+	if first[0] != 0x16 {
+		return "", first, ErrNotTLS
+	}
+
+	var read bytes.Buffer
+	read.Write(first)
+
+	var serverName string
+	conn := &readOnlyConn{r: io.MultiReader(bytes.NewReader(first), io.TeeReader(r, &read))}
+	err := tls.Server(conn, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errDone
+		},
+	}).Handshake()
+	b := read.Bytes()
+	if !errors.Is(err, errDone) {
+		return "", b, err
+	}
+
+	return serverName, b, nil
+}
+
+// readOnlyConn is the conn of the handshake, nothing is sent to the client.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,51 @@
+package sni
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+)
+
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		client.Close()
+	}()
+
+	var hello bytes.Buffer
+	buf := make([]byte, 64*1024)
+	// the ClientHello is written at once
+	n, _ := server.Read(buf)
+	hello.Write(buf[:n])
+	server.Close()
+	return hello.Bytes()
+}
+
+func TestServerName(t *testing.T) {
+	for _, name := range []string{"example.com", ""} {
+		hello := clientHello(t, name)
+
+		got, b, err := ServerName(bytes.NewReader(hello))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != name {
+			t.Errorf("got server name %q; expected %q", got, name)
+		}
+		if !bytes.Equal(b, hello) {
+			t.Errorf("expected the bytes read to be the ClientHello, got %d of %d bytes", len(b), len(hello))
+		}
+	}
+}
+
+func TestServerNameNotTLS(t *testing.T) {
+	_, b, err := ServerName(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))
+	if err != ErrNotTLS {
+		t.Errorf("got %v; expected %v", err, ErrNotTLS)
+	}
+	if string(b) != "G" {
+		t.Errorf("got %q; expected the first byte", b)
+	}
+}
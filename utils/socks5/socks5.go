@@ -0,0 +1,252 @@
+// Package socks5 implements the server side of SOCKS5 (RFC 1928),
+// with no authentication and username/password authentication (RFC 1929).
+//
+// Example:
+//
+//	req, err := socks5.Handshake(conn, nil)
+//	if err != nil {
+//		return err
+//	}
+//	if req.Command != socks5.CommandConnect {
+//		return socks5.WriteReply(conn, socks5.ReplyCommandNotSupported, nil)
+//	}
+//	backend, err := net.Dial("tcp", req.Addr())
+//	...
+//	socks5.WriteReply(conn, socks5.ReplySucceeded, backend.LocalAddr())
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Version is the protocol version.
+const Version = 0x05
+
+// Authentication methods.
+const (
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xff
+)
+
+// Commands.
+const (
+	CommandConnect      = 0x01
+	CommandBind         = 0x02
+	CommandUDPAssociate = 0x03
+)
+
+// Address types.
+const (
+	AddrTypeIPv4   = 0x01
+	AddrTypeDomain = 0x03
+	AddrTypeIPv6   = 0x04
+)
+
+// Replies.
+const (
+	ReplySucceeded            = 0x00
+	ReplyGeneralFailure       = 0x01
+	ReplyNotAllowed           = 0x02
+	ReplyNetworkUnreachable   = 0x03
+	ReplyHostUnreachable      = 0x04
+	ReplyConnectionRefused    = 0x05
+	ReplyTTLExpired           = 0x06
+	ReplyCommandNotSupported  = 0x07
+	ReplyAddrTypeNotSupported = 0x08
+)
+
+// userPassVersion is the version of the username/password subnegotiation.
+const userPassVersion = 0x01
+
+// ErrAuthFailed is returned by Handshake if the client is not authenticated.
+var ErrAuthFailed = errors.New("socks5: authentication failed")
+
+// Request is the request of a client.
+type Request struct {
+	Command byte
+	// Host is an ip or a domain name.
+	Host string
+	Port int
+	// Username is the authenticated username, empty without authentication.
+	Username string
+}
+
+// Addr returns host:port.
+func (r *Request) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// Handshake negotiates the authentication and reads the request,
+// auth nil means no authentication, otherwise username/password is required.
+//
+// Failures of the negotiation are answered before returning the error,
+// unsupported commands are returned, the caller replies.
+func Handshake(rw io.ReadWriter, auth func(username, password string) bool) (*Request, error) {
+	header, err := readBytes(rw, 2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != Version {
+		return nil, fmt.Errorf("socks5: unsupported version %d", header[0])
+	}
+
+	methods, err := readBytes(rw, int(header[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	method := byte(MethodNoAuth)
+	if auth != nil {
+		method = MethodUserPass
+	}
+	if !hasMethod(methods, method) {
+		rw.Write([]byte{Version, MethodNoAcceptable})
+		return nil, fmt.Errorf("socks5: no acceptable authentication method, expected %d", method)
+	}
+	if _, err := rw.Write([]byte{Version, method}); err != nil {
+		return nil, err
+	}
+
+	var username string
+	if auth != nil {
+		if username, err = authenticate(rw, auth); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := readRequest(rw)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Username = username
+	return req, nil
+}
+
+// WriteReply writes the reply, bind is the bound address, nil means 0.0.0.0:0.
+func WriteReply(w io.Writer, reply byte, bind net.Addr) error {
+	ip := net.IPv4zero
+	port := 0
+	if addr, ok := bind.(*net.TCPAddr); ok && addr != nil {
+		ip, port = addr.IP, addr.Port
+	}
+
+	b := []byte{Version, reply, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, AddrTypeIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, AddrTypeIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+
+	_, err := w.Write(b)
+	return err
+}
+
+func authenticate(rw io.ReadWriter, auth func(username, password string) bool) (string, error) {
+	header, err := readBytes(rw, 2)
+	if err != nil {
+		return "", err
+	}
+	if header[0] != userPassVersion {
+		return "", fmt.Errorf("socks5: unsupported authentication version %d", header[0])
+	}
+
+	username, err := readBytes(rw, int(header[1]))
+	if err != nil {
+		return "", err
+	}
+
+	passwordLength, err := readBytes(rw, 1)
+	if err != nil {
+		return "", err
+	}
+	password, err := readBytes(rw, int(passwordLength[0]))
+	if err != nil {
+		return "", err
+	}
+
+	if !auth(string(username), string(password)) {
+		rw.Write([]byte{userPassVersion, 0x01})
+		return "", ErrAuthFailed
+	}
+
+	if _, err := rw.Write([]byte{userPassVersion, 0x00}); err != nil {
+		return "", err
+	}
+
+	return string(username), nil
+}
+
+func readRequest(rw io.ReadWriter) (*Request, error) {
+	header, err := readBytes(rw, 4)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] != Version {
+		return nil, fmt.Errorf("socks5: unsupported version %d", header[0])
+	}
+
+	req := &Request{Command: header[1]}
+	switch header[3] {
+	case AddrTypeIPv4, AddrTypeIPv6:
+		size := net.IPv4len
+		if header[3] == AddrTypeIPv6 {
+			size = net.IPv6len
+		}
+
+		ip, err := readBytes(rw, size)
+		if err != nil {
+			return nil, err
+		}
+		req.Host = net.IP(ip).String()
+	case AddrTypeDomain:
+		length, err := readBytes(rw, 1)
+		if err != nil {
+			return nil, err
+		}
+
+		domain, err := readBytes(rw, int(length[0]))
+		if err != nil {
+			return nil, err
+		}
+		req.Host = string(domain)
+	default:
+		WriteReply(rw, ReplyAddrTypeNotSupported, nil)
+		return nil, fmt.Errorf("socks5: unsupported address type %d", header[3])
+	}
+
+	port, err := readBytes(rw, 2)
+	if err != nil {
+		return nil, err
+	}
+	req.Port = int(port[0])<<8 | int(port[1])
+
+	return req, nil
+}
+
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func hasMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,107 @@
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// conn reads the client messages and records the server messages.
+type conn struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	return c.in.Read(p)
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+func TestHandshake(t *testing.T) {
+	testcases := []struct {
+		name     string
+		request  []byte
+		expected string
+	}{
+		{"ipv4", []byte{5, 1, 0, 1, 127, 0, 0, 1, 0x1f, 0x90}, "127.0.0.1:8080"},
+		{"ipv6", append(append([]byte{5, 1, 0, 4}, net.ParseIP("::1")...), 0x01, 0xbb), "[::1]:443"},
+		{"domain", append(append([]byte{5, 1, 0, 3, 11}, "example.com"...), 0, 80), "example.com:80"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &conn{in: bytes.NewReader(append([]byte{5, 2, 2, 0}, tc.request...))}
+			req, err := Handshake(c, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if req.Command != CommandConnect || req.Addr() != tc.expected {
+				t.Errorf("got command %d to %s; expected connect to %s", req.Command, req.Addr(), tc.expected)
+			}
+			if !bytes.Equal(c.out.Bytes(), []byte{5, MethodNoAuth}) {
+				t.Errorf("got %v; expected no authentication selected", c.out.Bytes())
+			}
+		})
+	}
+}
+
+func TestHandshakeAuth(t *testing.T) {
+	auth := func(username, password string) bool {
+		return username == "zero" && password == "secret"
+	}
+	request := []byte{5, 1, 0, 1, 127, 0, 0, 1, 0, 80}
+
+	userPass := func(username, password string) []byte {
+		b := []byte{1, byte(len(username))}
+		b = append(b, username...)
+		b = append(b, byte(len(password)))
+		return append(b, password...)
+	}
+
+	c := &conn{in: bytes.NewReader(append(append([]byte{5, 1, 2}, userPass("zero", "secret")...), request...))}
+	req, err := Handshake(c, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Username != "zero" {
+		t.Errorf("got username %q; expected zero", req.Username)
+	}
+	if !bytes.Equal(c.out.Bytes(), []byte{5, MethodUserPass, 1, 0}) {
+		t.Errorf("got %v; expected username/password accepted", c.out.Bytes())
+	}
+
+	c = &conn{in: bytes.NewReader(append(append([]byte{5, 1, 2}, userPass("zero", "wrong")...), request...))}
+	if _, err := Handshake(c, auth); err != ErrAuthFailed {
+		t.Errorf("got %v; expected %v", err, ErrAuthFailed)
+	}
+	if !bytes.Equal(c.out.Bytes(), []byte{5, MethodUserPass, 1, 1}) {
+		t.Errorf("got %v; expected username/password rejected", c.out.Bytes())
+	}
+
+	// no authentication offered
+	c = &conn{in: bytes.NewReader(append([]byte{5, 1, 0}, request...))}
+	if _, err := Handshake(c, auth); err == nil {
+		t.Errorf("expected an error without username/password")
+	}
+	if !bytes.Equal(c.out.Bytes(), []byte{5, MethodNoAcceptable}) {
+		t.Errorf("got %v; expected no acceptable methods", c.out.Bytes())
+	}
+}
+
+func TestWriteReply(t *testing.T) {
+	var b bytes.Buffer
+	WriteReply(&b, ReplySucceeded, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1080})
+	if expected := []byte{5, 0, 0, 1, 10, 0, 0, 1, 0x04, 0x38}; !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("got %v; expected %v", b.Bytes(), expected)
+	}
+
+	b.Reset()
+	WriteReply(&b, ReplyNotAllowed, nil)
+	if expected := []byte{5, 2, 0, 1, 0, 0, 0, 0, 0, 0}; !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("got %v; expected %v", b.Bytes(), expected)
+	}
+}
@@ -0,0 +1,197 @@
+// Package sse reads and writes Server-Sent Events streams.
+//
+// See https://html.spec.whatwg.org/multipage/server-sent-events.html#parsing-an-event-stream
+package sse
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentType is the content type of event streams.
+const ContentType = "text/event-stream"
+
+// DefaultMaxEventSize is the max size of events, when Reader.MaxEventSize is 0.
+const DefaultMaxEventSize = 1 << 20
+
+// ErrEventTooLarge is returned by Reader.Next for events larger than the max size.
+var ErrEventTooLarge = errors.New("sse: event too large")
+
+// Event is an event of a stream.
+type Event struct {
+	// ID is the id field, which clients send back in Last-Event-ID when reconnecting.
+	ID string
+	// HasID is true if the event has an id field, an empty ID then resets the last event id of clients.
+	HasID bool
+	// Event is the event type, empty means message.
+	Event string
+	// Data is the data, the lines of multiple data fields are joined with \n.
+	Data string
+	// Retry is the reconnection time, 0 if there is none.
+	Retry time.Duration
+}
+
+// WriteTo writes the event, with its blank line, empty fields are not written,
+// but an empty ID with HasID.
+func (e *Event) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	if e.ID != "" || e.HasID {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+
+	if e.Data != "" {
+		for _, line := range strings.Split(e.Data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+
+	if b.Len() == 0 {
+		return 0, nil
+	}
+	b.WriteString("\n")
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// WriteComment writes a comment, which clients ignore, like heartbeats.
+func WriteComment(w io.Writer, comment string) error {
+	_, err := io.WriteString(w, ": "+comment+"\n\n")
+	return err
+}
+
+// Reader reads the events of a stream.
+type Reader struct {
+	// MaxEventSize is the max size of an event, its lines and comments included,
+	// negative means no limit.
+	//	Default is 0, which means DefaultMaxEventSize.
+	MaxEventSize int
+
+	r       *bufio.Reader
+	started bool
+	// afterCR is true after a line ended by CR, whose LF is skipped, if it is CRLF
+	afterCR bool
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next event, comments are skipped,
+// io.EOF is returned at the end of the stream, the incomplete event is discarded,
+// ErrEventTooLarge is returned for events larger than MaxEventSize.
+func (r *Reader) Next() (*Event, error) {
+	var event Event
+	var data []string
+	fields := 0
+
+	remaining := r.MaxEventSize
+	if remaining == 0 {
+		remaining = DefaultMaxEventSize
+	}
+
+	for {
+		line, err := r.readLine(remaining)
+		if err != nil {
+			return nil, err
+		}
+		if remaining >= 0 {
+			remaining -= len(line)
+		}
+
+		if line == "" {
+			if fields == 0 {
+				continue
+			}
+
+			event.Data = strings.Join(data, "\n")
+			return &event, nil
+		}
+
+		if line[0] == ':' {
+			continue
+		}
+
+		name, value, found := strings.Cut(line, ":")
+		if found {
+			value = strings.TrimPrefix(value, " ")
+		}
+
+		switch name {
+		case "event":
+			event.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if strings.ContainsRune(value, 0) {
+				continue
+			}
+			event.ID = value
+			event.HasID = true
+		case "retry":
+			ms, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				continue
+			}
+			event.Retry = time.Duration(ms) * time.Millisecond
+		default:
+			continue
+		}
+		fields++
+	}
+}
+
+// readLine reads a line ended by CRLF, LF or CR, without the end,
+// up to maxSize bytes, negative means no limit.
+func (r *Reader) readLine(maxSize int) (string, error) {
+	var line bytes.Buffer
+	for {
+		c, err := r.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+
+		// not peeked after CR, which would wait for the next event of live streams
+		if r.afterCR {
+			r.afterCR = false
+			if c == '\n' {
+				continue
+			}
+		}
+
+		if maxSize >= 0 && line.Len() >= maxSize && c != '\n' && c != '\r' {
+			return "", ErrEventTooLarge
+		}
+
+		switch c {
+		case '\n':
+		case '\r':
+			r.afterCR = true
+		default:
+			line.WriteByte(c)
+			continue
+		}
+
+		s := line.String()
+		if !r.started {
+			r.started = true
+			s = strings.TrimPrefix(s, "\xef\xbb\xbf")
+		}
+
+		return s, nil
+	}
+}
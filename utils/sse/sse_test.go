@@ -0,0 +1,108 @@
+package sse
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReader(t *testing.T) {
+	stream := "\xef\xbb\xbf: comment\n" +
+		"id: 1\nevent: update\ndata: first\ndata:second\n\n" +
+		"data: crlf\r\n\r\n" +
+		"retry: 3000\rdata\r\r" +
+		"retry: invalid\nunknown: field\n\n" +
+		"id\n\n" +
+		"data: incomplete\n"
+
+	expected := []*Event{
+		{ID: "1", HasID: true, Event: "update", Data: "first\nsecond"},
+		{Data: "crlf"},
+		{Retry: 3 * time.Second},
+		{HasID: true},
+	}
+
+	r := NewReader(strings.NewReader(stream))
+	for _, e := range expected {
+		event, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(event, e) {
+			t.Errorf("got %+v; expected %+v", event, e)
+		}
+	}
+
+	if event, err := r.Next(); err != io.EOF {
+		t.Errorf("got %+v, %v; expected EOF, the incomplete event discarded", event, err)
+	}
+}
+
+func TestReaderMaxEventSize(t *testing.T) {
+	r := NewReader(strings.NewReader("data: 1234\n\ndata: 12\ndata: 34\n\n"))
+	r.MaxEventSize = 10
+	if event, err := r.Next(); err != nil || event.Data != "1234" {
+		t.Errorf("got %+v, %v; expected the event at the max size", event, err)
+	}
+	if _, err := r.Next(); err != ErrEventTooLarge {
+		t.Errorf("got %v; expected ErrEventTooLarge", err)
+	}
+
+	// a line without end
+	r = NewReader(strings.NewReader("data: " + strings.Repeat("a", DefaultMaxEventSize)))
+	if _, err := r.Next(); err != ErrEventTooLarge {
+		t.Errorf("got %v; expected ErrEventTooLarge", err)
+	}
+}
+
+func TestReaderCR(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	// the event is returned before the next byte
+	go pw.Write([]byte("data: cr\r\r"))
+	events := make(chan *Event, 1)
+	go func() {
+		event, _ := NewReader(pr).Next()
+		events <- event
+	}()
+
+	select {
+	case event := <-events:
+		if event == nil || event.Data != "cr" {
+			t.Errorf("got %+v; expected the event", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the event ended by CR to be returned")
+	}
+}
+
+func TestWriteToEmptyID(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if _, err := (&Event{HasID: true}).WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "id: \n\n"; buf.String() != expected {
+		t.Errorf("got %q; expected %q", buf.String(), expected)
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	event := &Event{ID: "1", HasID: true, Event: "update", Data: "first\nsecond", Retry: time.Second}
+
+	buf := &bytes.Buffer{}
+	if _, err := event.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "id: 1\nevent: update\nretry: 1000\ndata: first\ndata: second\n\n"; buf.String() != expected {
+		t.Errorf("got %q; expected %q", buf.String(), expected)
+	}
+
+	parsed, err := NewReader(buf).Next()
+	if err != nil || !reflect.DeepEqual(parsed, event) {
+		t.Errorf("got %+v, %v; expected %+v", parsed, err, event)
+	}
+}
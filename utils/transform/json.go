@@ -0,0 +1,80 @@
+package transform
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// JSON transforms json bodies by paths, see gjson for the path syntax.
+type JSON struct {
+	operations []func(body []byte) ([]byte, error)
+}
+
+// NewJSON creates a new JSON transformer.
+func NewJSON() *JSON {
+	return &JSON{}
+}
+
+// Set sets the value at path.
+func (j *JSON) Set(path string, value interface{}) *JSON {
+	j.operations = append(j.operations, func(body []byte) ([]byte, error) {
+		return sjson.SetBytes(body, path, value)
+	})
+	return j
+}
+
+// SetRaw sets the raw json at path.
+func (j *JSON) SetRaw(path string, raw string) *JSON {
+	j.operations = append(j.operations, func(body []byte) ([]byte, error) {
+		return sjson.SetRawBytes(body, path, []byte(raw))
+	})
+	return j
+}
+
+// Delete deletes the value at path.
+func (j *JSON) Delete(path string) *JSON {
+	j.operations = append(j.operations, func(body []byte) ([]byte, error) {
+		return sjson.DeleteBytes(body, path)
+	})
+	return j
+}
+
+// Rename moves the value at from to to, nothing happens if from does not exist.
+func (j *JSON) Rename(from, to string) *JSON {
+	j.operations = append(j.operations, func(body []byte) ([]byte, error) {
+		value := gjson.GetBytes(body, from)
+		if !value.Exists() {
+			return body, nil
+		}
+
+		body, err := sjson.SetRawBytes(body, to, []byte(value.Raw))
+		if err != nil {
+			return nil, err
+		}
+
+		return sjson.DeleteBytes(body, from)
+	})
+	return j
+}
+
+// Transform applies the operations in order.
+func (j *JSON) Transform(body []byte) ([]byte, error) {
+	if len(j.operations) == 0 {
+		return body, nil
+	}
+
+	if !gjson.ValidBytes(body) {
+		return nil, fmt.Errorf("invalid json body")
+	}
+
+	for _, operation := range j.operations {
+		var err error
+		if body, err = operation(body); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
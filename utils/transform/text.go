@@ -0,0 +1,42 @@
+package transform
+
+import (
+	"github.com/go-zoox/proxy/utils/rewriter"
+)
+
+// Text substitutes text with regular expressions, like nginx sub_filter.
+//
+//	Unlike rewriter.Rewriters, every rule is applied, each replacing all its matches.
+type Text struct {
+	rules rewriter.Rewriters
+	err   error
+}
+
+// NewText creates a new Text transformer, From is the regular expression,
+// To is the replacement, which supports $1 captures.
+//
+//	The rules are compiled once here, see Compile for the error.
+func NewText(rules ...rewriter.Rewriter) *Text {
+	t := &Text{rules: append(rewriter.Rewriters{}, rules...)}
+	t.err = t.rules.Compile()
+	return t
+}
+
+// Compile returns the first error of the rules.
+func (t *Text) Compile() error {
+	return t.err
+}
+
+// Transform applies the rules in order.
+func (t *Text) Transform(body []byte) ([]byte, error) {
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	text := string(body)
+	for i := range t.rules {
+		text = t.rules[i].Rewrite(text)
+	}
+
+	return []byte(text), nil
+}
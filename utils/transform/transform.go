@@ -0,0 +1,106 @@
+// Package transform transforms http bodies by content type.
+//
+// A Pipeline holds transformers for content types, all the transformers matching
+// a content type are applied in the order they were added, so transforms compose.
+//
+// Example:
+//
+//	p := transform.New()
+//	p.Add("application/json", transform.NewJSON().
+//		Set("meta.proxy", "go-zoox").
+//		Delete("internal").
+//		Rename("user_name", "username"))
+//	p.Add("text/*", transform.NewText(rewriter.Rewriter{From: "http://upstream", To: "https://proxy"}))
+package transform
+
+import (
+	"mime"
+	"strings"
+)
+
+// Transformer transforms a body.
+type Transformer interface {
+	Transform(body []byte) ([]byte, error)
+}
+
+// TransformerFunc is a function Transformer.
+type TransformerFunc func(body []byte) ([]byte, error)
+
+// Transform calls fn(body).
+func (fn TransformerFunc) Transform(body []byte) ([]byte, error) {
+	return fn(body)
+}
+
+// Pipeline dispatches transformers by content type.
+type Pipeline struct {
+	rules []rule
+}
+
+type rule struct {
+	contentType  string
+	transformers []Transformer
+}
+
+// New creates a new Pipeline.
+func New() *Pipeline {
+	return &Pipeline{}
+}
+
+// Add adds transformers for the content type, which is a media type,
+// type/* matches all the subtypes, */* matches all.
+func (p *Pipeline) Add(contentType string, transformers ...Transformer) *Pipeline {
+	p.rules = append(p.rules, rule{strings.ToLower(contentType), transformers})
+	return p
+}
+
+// Match returns true if any transformer applies to the content type.
+func (p *Pipeline) Match(contentType string) bool {
+	mediaType := parseMediaType(contentType)
+	for _, r := range p.rules {
+		if matchMediaType(r.contentType, mediaType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Transform applies all the transformers matching the content type.
+func (p *Pipeline) Transform(contentType string, body []byte) ([]byte, error) {
+	mediaType := parseMediaType(contentType)
+	for _, r := range p.rules {
+		if !matchMediaType(r.contentType, mediaType) {
+			continue
+		}
+
+		for _, t := range r.transformers {
+			var err error
+			if body, err = t.Transform(body); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return body, nil
+}
+
+func parseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+
+	return mediaType
+}
+
+func matchMediaType(pattern, mediaType string) bool {
+	if mediaType == "" {
+		return false
+	}
+
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+
+	return strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+}
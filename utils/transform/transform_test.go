@@ -0,0 +1,78 @@
+package transform
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/go-zoox/proxy/utils/rewriter"
+)
+
+func TestPipeline(t *testing.T) {
+	p := New().
+		Add("application/json", NewJSON().Set("meta.proxy", "go-zoox")).
+		Add("application/*", NewJSON().Delete("internal").Rename("user_name", "user.name")).
+		Add("text/*", NewText(rewriter.Rewriter{From: `http://upstream\.local`, To: "https://proxy.local"}))
+
+	body, err := p.Transform("application/json; charset=utf-8", []byte(`{"user_name":"zero","internal":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(body), `{"meta":{"proxy":"go-zoox"},"user":{"name":"zero"}}`; g != e {
+		t.Errorf("got %s, expected %s", g, e)
+	}
+
+	body, err = p.Transform("text/plain", []byte("visit http://upstream.local/a and http://upstream.local/b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := string(body), "visit https://proxy.local/a and https://proxy.local/b"; g != e {
+		t.Errorf("got %s, expected %s", g, e)
+	}
+
+	if p.Match("image/png") {
+		t.Errorf("image/png should not match")
+	}
+
+	if _, err := p.Transform("application/json", []byte(`{invalid`)); err == nil {
+		t.Errorf("expected invalid json error")
+	}
+}
+
+func TestText(t *testing.T) {
+	text := NewText(
+		rewriter.Rewriter{From: `(\d+) items`, To: "$1 things"},
+		rewriter.Rewriter{From: "things", To: "stuffs"},
+	)
+
+	body, _ := text.Transform([]byte("1 items, 2 items"))
+	if g, e := string(body), "1 stuffs, 2 stuffs"; g != e {
+		t.Errorf("got %s, expected %s", g, e)
+	}
+
+	if _, err := NewText(rewriter.Rewriter{From: "(", To: ""}).Transform([]byte("x")); err == nil {
+		t.Errorf("expected invalid rule error")
+	}
+}
+
+func TestXML(t *testing.T) {
+	x := NewXML().
+		Delete("feed/secret").
+		Rename("feed/item", "entry").
+		SetText("feed/atom:title", "Proxied & <safe>")
+
+	body, err := x.Transform([]byte(`<?xml version="1.0"?>
+<feed xmlns:atom="http://www.w3.org/2005/Atom"><atom:title>Origin <b>bold</b></atom:title><secret><key>x</key></secret><item id="1">one</item><item/></feed>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<?xml version="1.0"?>
+<feed xmlns:atom="http://www.w3.org/2005/Atom"><atom:title>Proxied &amp; &lt;safe&gt;</atom:title><entry id="1">one</entry><entry></entry></feed>`
+	if string(body) != expected {
+		t.Errorf("got:\n%s\nexpected:\n%s", body, expected)
+	}
+
+	if _, err := x.Transform([]byte(`<feed><item></feed>`)); err == nil || !strings.Contains(err.Error(), "syntax") {
+		t.Errorf("expected syntax error, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// XML transforms xml bodies by element paths, like root/items/item,
+// matching elements by their qualified names, prefixes included.
+type XML struct {
+	deletes  map[string]bool
+	renames  map[string]string
+	setTexts map[string]string
+}
+
+// NewXML creates a new XML transformer.
+func NewXML() *XML {
+	return &XML{
+		deletes:  map[string]bool{},
+		renames:  map[string]string{},
+		setTexts: map[string]string{},
+	}
+}
+
+// Delete deletes the elements at path.
+func (x *XML) Delete(path string) *XML {
+	x.deletes[normalizeXMLPath(path)] = true
+	return x
+}
+
+// Rename renames the elements at path.
+func (x *XML) Rename(path string, name string) *XML {
+	x.renames[normalizeXMLPath(path)] = name
+	return x
+}
+
+// SetText replaces the content of the elements at path with text.
+func (x *XML) SetText(path string, text string) *XML {
+	x.setTexts[normalizeXMLPath(path)] = text
+	return x
+}
+
+// Transform streams the tokens, applying the operations, other tokens are kept.
+func (x *XML) Transform(body []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+
+	var path []string
+	var renamed []string
+	// skipDepth is the depth of the element whose content is skipped, 0 means none.
+	skipDepth := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			if len(path) != 0 {
+				return nil, fmt.Errorf("xml syntax error: unclosed element <%s>", path[len(path)-1])
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := qualifiedName(t.Name)
+			path = append(path, name)
+			if skipDepth != 0 {
+				continue
+			}
+
+			current := strings.Join(path, "/")
+			if x.deletes[current] {
+				skipDepth = len(path)
+				renamed = append(renamed, "")
+				continue
+			}
+
+			if rename, ok := x.renames[current]; ok {
+				name = rename
+			}
+			renamed = append(renamed, name)
+
+			if err := encoder.EncodeToken(rawStartElement(t, name)); err != nil {
+				return nil, err
+			}
+
+			if text, ok := x.setTexts[current]; ok {
+				if err := encoder.EncodeToken(xml.CharData(text)); err != nil {
+					return nil, err
+				}
+				skipDepth = len(path)
+			}
+		case xml.EndElement:
+			// RawToken does not check the end elements
+			depth := len(path)
+			if depth == 0 || path[depth-1] != qualifiedName(t.Name) {
+				return nil, fmt.Errorf("xml syntax error: unexpected end element </%s>", qualifiedName(t.Name))
+			}
+			path = path[:depth-1]
+			if skipDepth != 0 && depth > skipDepth {
+				continue
+			}
+
+			name := renamed[len(renamed)-1]
+			renamed = renamed[:len(renamed)-1]
+			skipDepth = 0
+			if name == "" {
+				// deleted
+				continue
+			}
+
+			if err := encoder.EncodeToken(xml.EndElement{Name: xml.Name{Local: name}}); err != nil {
+				return nil, err
+			}
+		default:
+			if skipDepth != 0 {
+				continue
+			}
+
+			if err := encoder.EncodeToken(xml.CopyToken(token)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func normalizeXMLPath(path string) string {
+	return strings.Trim(path, "/")
+}
+
+// qualifiedName returns prefix:local, RawToken does not resolve prefixes to namespaces.
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+
+	return name.Space + ":" + name.Local
+}
+
+// rawStartElement keeps the prefixes as they are,
+// so the encoder does not turn them into namespace declarations.
+func rawStartElement(start xml.StartElement, name string) xml.StartElement {
+	attrs := make([]xml.Attr, 0, len(start.Attr))
+	for _, attr := range start.Attr {
+		attrs = append(attrs, xml.Attr{
+			Name:  xml.Name{Local: qualifiedName(attr.Name)},
+			Value: attr.Value,
+		})
+	}
+
+	return xml.StartElement{
+		Name: xml.Name{Local: name},
+		Attr: attrs,
+	}
+}
@@ -0,0 +1,281 @@
+// Package websocket reads and writes WebSocket frames, for proxies inspecting the
+// messages of upgraded connections, the handshake is left to the HTTP server and client.
+//
+// See https://www.rfc-editor.org/rfc/rfc6455#section-5
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"unicode/utf8"
+)
+
+// Opcodes.
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// Close codes, see https://www.rfc-editor.org/rfc/rfc6455#section-7.4.1
+const (
+	CloseNormalClosure      = 1000
+	CloseGoingAway          = 1001
+	CloseProtocolError      = 1002
+	CloseUnsupportedData    = 1003
+	CloseNoStatusReceived   = 1005
+	CloseAbnormalClosure    = 1006
+	CloseInvalidPayloadData = 1007
+	ClosePolicyViolation    = 1008
+	CloseMessageTooBig      = 1009
+	CloseMandatoryExtension = 1010
+	CloseInternalServerErr  = 1011
+	CloseTLSHandshake       = 1015
+)
+
+// maxControlPayload is the max payload size of control frames.
+const maxControlPayload = 125
+
+// DefaultMaxSize is the max payload size of ReadFrame, when maxSize is 0.
+const DefaultMaxSize = 32 << 20
+
+// readChunkSize is the size of the chunks payloads are read by,
+// so the memory grows with the bytes received, not with the announced length.
+const readChunkSize = 64 << 10
+
+var (
+	// ErrFrameTooLarge is returned by ReadFrame if the payload is larger than the max size.
+	ErrFrameTooLarge = errors.New("websocket: frame too large")
+	// ErrProtocol is returned for frames breaking the protocol, like fragmented control frames.
+	ErrProtocol = errors.New("websocket: protocol error")
+)
+
+// Frame is a WebSocket frame, with its payload unmasked.
+type Frame struct {
+	Fin bool
+	// Rsv are the RSV1, RSV2 and RSV3 bits, as the 3 lower bits, used by extensions.
+	Rsv    byte
+	Opcode byte
+	// Masked is true if the frame is masked, as frames of clients must be, set by ReadFrame.
+	Masked  bool
+	Payload []byte
+}
+
+// IsControl returns true for close, ping and pong frames.
+func (f *Frame) IsControl() bool {
+	return f.Opcode&0x8 != 0
+}
+
+// ReadFrame reads a frame from r, and unmasks its payload,
+// frames with a payload larger than maxSize return ErrFrameTooLarge,
+// 0 means DefaultMaxSize, negative means no limit.
+func ReadFrame(r io.Reader, maxSize int64) (*Frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+
+	f := &Frame{
+		Fin:    head[0]&0x80 != 0,
+		Rsv:    (head[0] >> 4) & 0x7,
+		Opcode: head[0] & 0xf,
+	}
+	f.Masked = head[1]&0x80 != 0
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return nil, fmt.Errorf("%w: invalid payload length", ErrProtocol)
+		}
+	}
+
+	switch f.Opcode {
+	case OpContinuation, OpText, OpBinary:
+	case OpClose, OpPing, OpPong:
+		if !f.Fin || length > maxControlPayload {
+			return nil, fmt.Errorf("%w: invalid control frame", ErrProtocol)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown opcode %d", ErrProtocol, f.Opcode)
+	}
+
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if (maxSize > 0 && length > uint64(maxSize)) || length > math.MaxInt {
+		return nil, ErrFrameTooLarge
+	}
+
+	var key [4]byte
+	if f.Masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+
+	payload, err := readPayload(r, int(length))
+	if err != nil {
+		return nil, err
+	}
+	f.Payload = payload
+
+	if f.Masked {
+		maskBytes(key, f.Payload)
+	}
+
+	return f, nil
+}
+
+// WriteFrame writes f to w, masked with a random key if mask is true,
+// which clients must do, the payload of f is not modified.
+func WriteFrame(w io.Writer, f *Frame, mask bool) error {
+	buf := make([]byte, 0, 14+len(f.Payload))
+
+	b0 := f.Opcode&0xf | (f.Rsv&0x7)<<4
+	if f.Fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var b1 byte
+	if mask {
+		b1 = 0x80
+	}
+
+	switch length := len(f.Payload); {
+	case length < 126:
+		buf = append(buf, b1|byte(length))
+	case length <= 0xffff:
+		buf = append(buf, b1|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, b1|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	if !mask {
+		buf = append(buf, f.Payload...)
+		_, err := w.Write(buf)
+		return err
+	}
+
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	buf = append(buf, key[:]...)
+
+	start := len(buf)
+	buf = append(buf, f.Payload...)
+	maskBytes(key, buf[start:])
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// FormatClose returns the payload of a close frame, the reason is truncated to fit.
+func FormatClose(code int, reason string) []byte {
+	if code == CloseNoStatusReceived {
+		return nil
+	}
+
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+		// not in the middle of a rune
+		for !utf8.ValidString(reason) {
+			reason = reason[:len(reason)-1]
+		}
+	}
+
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// ParseClose parses the payload of a close frame, an empty payload is CloseNoStatusReceived,
+// the code and the UTF-8 reason are checked.
+func ParseClose(payload []byte) (code int, reason string, err error) {
+	switch len(payload) {
+	case 0:
+		return CloseNoStatusReceived, "", nil
+	case 1:
+		return 0, "", fmt.Errorf("%w: invalid close payload", ErrProtocol)
+	}
+
+	code = int(binary.BigEndian.Uint16(payload))
+	if !IsValidCloseCode(code) {
+		return 0, "", fmt.Errorf("%w: invalid close code %d", ErrProtocol, code)
+	}
+
+	if !utf8.Valid(payload[2:]) {
+		return 0, "", fmt.Errorf("%w: invalid close reason", ErrProtocol)
+	}
+
+	return code, string(payload[2:]), nil
+}
+
+// IsValidCloseCode returns true if code can be sent in a close frame,
+// codes like CloseNoStatusReceived or CloseAbnormalClosure are for APIs only.
+func IsValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+
+	return false
+}
+
+// readPayload reads length bytes by chunks.
+func readPayload(r io.Reader, length int) ([]byte, error) {
+	capacity := length
+	if capacity > readChunkSize {
+		capacity = readChunkSize
+	}
+
+	payload := make([]byte, 0, capacity)
+	for len(payload) < length {
+		n := length - len(payload)
+		if n > readChunkSize {
+			n = readChunkSize
+		}
+		payload = append(payload, make([]byte, n)...)
+		if _, err := io.ReadFull(r, payload[len(payload)-n:]); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+
+	return payload, nil
+}
+
+func maskBytes(key [4]byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i&3]
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+
+	return err
+}
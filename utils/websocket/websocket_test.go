@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	testcases := []struct {
+		name  string
+		frame *Frame
+		mask  bool
+	}{
+		{"text", &Frame{Fin: true, Opcode: OpText, Payload: []byte("hello")}, false},
+		{"masked", &Frame{Fin: true, Opcode: OpBinary, Payload: []byte{1, 2, 3}}, true},
+		{"fragment", &Frame{Opcode: OpText, Payload: []byte("hel")}, true},
+		{"16 bits length", &Frame{Fin: true, Opcode: OpBinary, Payload: bytes.Repeat([]byte("a"), 300)}, true},
+		{"64 bits length", &Frame{Fin: true, Opcode: OpBinary, Payload: bytes.Repeat([]byte("a"), 70000)}, false},
+		{"rsv", &Frame{Fin: true, Rsv: 4, Opcode: OpText, Payload: []byte("x")}, false},
+		{"empty ping", &Frame{Fin: true, Opcode: OpPing, Payload: []byte{}}, true},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := WriteFrame(buf, tc.frame, tc.mask); err != nil {
+				t.Fatal(err)
+			}
+
+			if masked := buf.Bytes()[1]&0x80 != 0; masked != tc.mask {
+				t.Errorf("got masked %v; expected %v", masked, tc.mask)
+			}
+
+			f, err := ReadFrame(buf, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Fin != tc.frame.Fin || f.Rsv != tc.frame.Rsv || f.Opcode != tc.frame.Opcode || !bytes.Equal(f.Payload, tc.frame.Payload) {
+				t.Errorf("got %+v; expected %+v", f, tc.frame)
+			}
+		})
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	buf := &bytes.Buffer{}
+	WriteFrame(buf, &Frame{Fin: true, Opcode: OpText, Payload: []byte("hello")}, true)
+	if _, err := ReadFrame(buf, 4); err != ErrFrameTooLarge {
+		t.Errorf("got %v; expected ErrFrameTooLarge", err)
+	}
+
+	// checked before allocating, even without limit
+	huge := []byte{0x80 | OpBinary, 127, 0x40, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := ReadFrame(bytes.NewReader(huge), 0); err != ErrFrameTooLarge {
+		t.Errorf("got %v; expected ErrFrameTooLarge", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(huge), -1); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v; expected io.ErrUnexpectedEOF", err)
+	}
+
+	testcases := []struct {
+		name string
+		data []byte
+	}{
+		{"fragmented control", []byte{byte(OpPing), 0}},
+		{"large control", append([]byte{0x80 | OpPing, 126, 0, 126}, make([]byte, 126)...)},
+		{"unknown opcode", []byte{0x83, 0}},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadFrame(bytes.NewReader(tc.data), 0); !errors.Is(err, ErrProtocol) {
+				t.Errorf("got %v; expected ErrProtocol", err)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	code, reason, err := ParseClose(FormatClose(CloseGoingAway, "bye"))
+	if err != nil || code != CloseGoingAway || reason != "bye" {
+		t.Errorf("got %d, %q, %v; expected 1001, bye", code, reason, err)
+	}
+
+	if code, _, err := ParseClose(nil); err != nil || code != CloseNoStatusReceived {
+		t.Errorf("got %d, %v; expected 1005", code, err)
+	}
+
+	if payload := FormatClose(CloseNormalClosure, strings.Repeat("é", 100)); len(payload) > 125 {
+		t.Errorf("got %d bytes; expected the reason truncated to 125 bytes", len(payload))
+	}
+
+	for _, payload := range [][]byte{{3}, FormatClose(CloseAbnormalClosure, ""), FormatClose(1004, ""), {3, 232, 0xff}} {
+		if _, _, err := ParseClose(payload); !errors.Is(err, ErrProtocol) {
+			t.Errorf("ParseClose(%v): got %v; expected ErrProtocol", payload, err)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-zoox/headers"
+	"github.com/go-zoox/proxy/utils/ascii"
+	"github.com/go-zoox/proxy/utils/websocket"
+)
+
+// WebSocket message types.
+const (
+	WebSocketTextMessage   = websocket.OpText
+	WebSocketBinaryMessage = websocket.OpBinary
+)
+
+// ErrDropWebSocketMessage is returned by OnWebSocketMessage to drop the message.
+var ErrDropWebSocketMessage = errors.New("drop websocket message")
+
+// wsCloseTimeout is how long the closing handshake waits for the close frame of the other side.
+const wsCloseTimeout = 5 * time.Second
+
+// WebSocketConfig enables the WebSocket-aware mode of upgraded connections:
+// frames are parsed in both directions, instead of copying the bytes, messages go
+// through OnWebSocketMessage, pings, pongs and close frames are forwarded,
+// close codes are checked, and protocol errors close both sides.
+//
+// Extensions, like permessage-deflate, are not negotiated in this mode,
+// so the messages can be read.
+type WebSocketConfig struct {
+	// MaxMessageSize is the max size of a message, fragments included,
+	// larger messages close the connection with 1009, negative means no limit.
+	//	Default is 0, which means 32 MiB, see websocket.DefaultMaxSize.
+	MaxMessageSize int64
+
+	// IdleTimeout closes the connection with 1001 if no frame is received
+	// in either direction, pings included.
+	//	Default is 0, which means no timeout.
+	IdleTimeout time.Duration
+}
+
+// WebSocketMessage is a message of a WebSocket connection.
+type WebSocketMessage struct {
+	// FromClient is true for messages of the client, false for the upstream's.
+	FromClient bool
+	// Type is WebSocketTextMessage or WebSocketBinaryMessage.
+	Type int
+	// Data is the payload, it can be modified.
+	Data []byte
+}
+
+// WebSocketCloseError is returned by OnWebSocketMessage to close the connection
+// with the code and the reason, other errors close it with 1008, policy violation,
+// like the codes which cannot be sent, see WebSocketConn.Close.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket close %d: %s", e.Code, e.Reason)
+}
+
+// WebSocketConn is a proxied WebSocket connection, see WebSocketConfig.
+type WebSocketConn struct {
+	req              *http.Request
+	cfg              *WebSocketConfig
+	onMessage        func(msg *WebSocketMessage, conn *WebSocketConn) error
+	client, upstream *wsPeer
+	lastActive       atomic.Int64
+	closeOnce        sync.Once
+}
+
+// wsPeer is a side of the connection, writes are serialized,
+// as messages can be injected by the hooks.
+type wsPeer struct {
+	r      io.Reader
+	w      io.WriteCloser
+	mask   bool
+	mu     sync.Mutex
+	closed bool
+}
+
+func (p *wsPeer) write(f *websocket.Frame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return errors.New("websocket: close frame sent")
+	}
+
+	if f.Opcode == websocket.OpClose {
+		p.closed = true
+	}
+
+	return websocket.WriteFrame(p.w, f, p.mask)
+}
+
+// Request returns the upgrade request sent to the upstream.
+func (c *WebSocketConn) Request() *http.Request {
+	return c.req
+}
+
+// SendToClient injects a message to the client.
+func (c *WebSocketConn) SendToClient(typ int, data []byte) error {
+	return c.client.write(&websocket.Frame{Fin: true, Opcode: byte(typ), Payload: data})
+}
+
+// SendToUpstream injects a message to the upstream.
+func (c *WebSocketConn) SendToUpstream(typ int, data []byte) error {
+	return c.upstream.write(&websocket.Frame{Fin: true, Opcode: byte(typ), Payload: data})
+}
+
+// Close closes both sides with the code and the reason, without waiting for their close frames.
+// The codes which cannot be sent in a close frame, like 1005 or 1006, are sent as 1008, policy violation.
+func (c *WebSocketConn) Close(code int, reason string) {
+	if !websocket.IsValidCloseCode(code) {
+		code = websocket.ClosePolicyViolation
+	}
+
+	c.closeOnce.Do(func() {
+		payload := websocket.FormatClose(code, reason)
+		for _, peer := range []*wsPeer{c.client, c.upstream} {
+			peer.write(&websocket.Frame{Fin: true, Opcode: websocket.OpClose, Payload: payload})
+			peer.w.Close()
+		}
+	})
+}
+
+// isWebSocketAware returns true if the WebSocket-aware mode is enabled, see WebSocketConfig.
+func (r *Proxy) isWebSocketAware() bool {
+	return r.webSocket != nil || r.OnWebSocketMessage != nil
+}
+
+// prepareWebSocketRequest removes the extensions, which would make messages unreadable.
+func (r *Proxy) prepareWebSocketRequest(req *http.Request) {
+	if r.isWebSocketAware() && ascii.EqualFold(upgradeType(req.Header), "websocket") {
+		req.Header.Del(headers.SecWebSocketExtensions)
+	}
+}
+
+// serveWebSocket relays the messages of the hijacked connections until both sides are closed,
+// it returns nil after a closing handshake.
+func (r *Proxy) serveWebSocket(req *http.Request, uc *UpgradedConn, user io.WriteCloser, userReader io.Reader, back io.WriteCloser, backReader io.Reader) error {
+	cfg := r.webSocket
+	if cfg == nil {
+		cfg = &WebSocketConfig{}
+	}
+
+	c := &WebSocketConn{
+		req:       req,
+		cfg:       cfg,
+		onMessage: r.OnWebSocketMessage,
+		client:    &wsPeer{r: userReader, w: user},
+		upstream:  &wsPeer{r: bufio.NewReader(backReader), w: back, mask: true},
+	}
+	c.touch()
+	// closed by the proxy, like during drains, with a close frame
+	uc.setCloseFn(func() {
+		c.Close(websocket.CloseGoingAway, "going away")
+	})
+
+	if cfg.IdleTimeout > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(cfg.IdleTimeout, func() {
+			if idle := time.Since(time.Unix(0, c.lastActive.Load())); idle < cfg.IdleTimeout {
+				timer.Reset(cfg.IdleTimeout - idle)
+				return
+			}
+
+			c.Close(websocket.CloseGoingAway, "idle timeout")
+		})
+		defer timer.Stop()
+	}
+
+	errc := make(chan error, 2)
+	go func() { errc <- c.relay(c.client, c.upstream, true) }()
+	go func() { errc <- c.relay(c.upstream, c.client, false) }()
+
+	// a forwarded close frame waits for the one of the other side
+	err := <-errc
+	if err == nil {
+		select {
+		case <-errc:
+		case <-time.After(wsCloseTimeout):
+		}
+	}
+
+	return err
+}
+
+func (c *WebSocketConn) maxMessageSize() int64 {
+	if c.cfg.MaxMessageSize == 0 {
+		return websocket.DefaultMaxSize
+	}
+
+	return c.cfg.MaxMessageSize
+}
+
+func (c *WebSocketConn) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// relay forwards the frames of from to to, it returns nil once a close frame is forwarded.
+func (c *WebSocketConn) relay(from, to *wsPeer, fromClient bool) error {
+	var message *WebSocketMessage
+	maxSize := c.maxMessageSize()
+	for {
+		f, err := websocket.ReadFrame(from.r, maxSize)
+		if err != nil {
+			switch {
+			case errors.Is(err, websocket.ErrFrameTooLarge):
+				c.Close(websocket.CloseMessageTooBig, "message too big")
+			case errors.Is(err, websocket.ErrProtocol):
+				c.Close(websocket.CloseProtocolError, err.Error())
+			}
+			return err
+		}
+		c.touch()
+
+		// clients mask their frames, servers do not, see RFC 6455 5.1
+		if f.Masked != fromClient {
+			c.Close(websocket.CloseProtocolError, "unexpected frame masking")
+			return websocket.ErrProtocol
+		}
+
+		// no extension is negotiated
+		if f.Rsv != 0 {
+			c.Close(websocket.CloseProtocolError, "unexpected rsv bits")
+			return websocket.ErrProtocol
+		}
+
+		switch f.Opcode {
+		case websocket.OpPing, websocket.OpPong:
+			if err := to.write(f); err != nil {
+				return err
+			}
+			continue
+		case websocket.OpClose:
+			if _, _, err := websocket.ParseClose(f.Payload); err != nil {
+				c.Close(websocket.CloseProtocolError, err.Error())
+				return err
+			}
+			if err := to.write(f); err != nil {
+				return err
+			}
+			return nil
+		case websocket.OpText, websocket.OpBinary:
+			if message != nil {
+				c.Close(websocket.CloseProtocolError, "expected continuation frame")
+				return websocket.ErrProtocol
+			}
+			message = &WebSocketMessage{FromClient: fromClient, Type: int(f.Opcode), Data: f.Payload}
+		case websocket.OpContinuation:
+			if message == nil {
+				c.Close(websocket.CloseProtocolError, "unexpected continuation frame")
+				return websocket.ErrProtocol
+			}
+			message.Data = append(message.Data, f.Payload...)
+		}
+
+		if maxSize > 0 && int64(len(message.Data)) > maxSize {
+			c.Close(websocket.CloseMessageTooBig, "message too big")
+			return websocket.ErrFrameTooLarge
+		}
+
+		if !f.Fin {
+			continue
+		}
+
+		msg := message
+		message = nil
+		if msg.Type == WebSocketTextMessage && !utf8.Valid(msg.Data) {
+			c.Close(websocket.CloseInvalidPayloadData, "invalid utf-8 text")
+			return websocket.ErrProtocol
+		}
+
+		if c.onMessage != nil {
+			if err := c.onMessage(msg, c); err != nil {
+				if errors.Is(err, ErrDropWebSocketMessage) {
+					continue
+				}
+
+				var closeErr *WebSocketCloseError
+				if errors.As(err, &closeErr) {
+					c.Close(closeErr.Code, closeErr.Reason)
+				} else {
+					log.Printf("websocket message error: %v (%s)", err, c.req.URL)
+					c.Close(websocket.ClosePolicyViolation, err.Error())
+				}
+				return err
+			}
+		}
+
+		if err := to.write(&websocket.Frame{Fin: true, Opcode: byte(msg.Type), Payload: msg.Data}); err != nil {
+			return err
+		}
+	}
+}
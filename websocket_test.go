@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-zoox/proxy/utils/websocket"
+)
+
+// newWebSocketBackend starts a WebSocket server echoing text messages with a prefix,
+// answering pings, and echoing close frames.
+func newWebSocketBackend(t *testing.T) (string, *http.Header) {
+	received := &http.Header{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*received = r.Header.Clone()
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprint(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		for {
+			f, err := websocket.ReadFrame(brw, 0)
+			if err != nil {
+				return
+			}
+
+			switch f.Opcode {
+			case websocket.OpText:
+				f.Payload = append([]byte("echo: "), f.Payload...)
+			case websocket.OpPing:
+				f.Opcode = websocket.OpPong
+			}
+			websocket.WriteFrame(conn, f, false)
+
+			if f.Opcode == websocket.OpClose {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+
+	return backend.URL, received
+}
+
+// serveWebSocketProxy serves p, and returns its address.
+func serveWebSocketProxy(t *testing.T, p *Proxy) string {
+	front := httptest.NewServer(p)
+	t.Cleanup(front.Close)
+
+	return front.Listener.Addr().String()
+}
+
+// dialWebSocket connects to the proxy at addr, and sends the upgrade request.
+func dialWebSocket(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+
+		"Sec-WebSocket-Extensions: permessage-deflate\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d; expected 101", res.StatusCode)
+	}
+
+	return conn, br
+}
+
+func writeFrame(t *testing.T, conn net.Conn, f *websocket.Frame) {
+	if err := websocket.WriteFrame(conn, f, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectFrame(t *testing.T, br *bufio.Reader, opcode byte, payload []byte) {
+	t.Helper()
+
+	f, err := websocket.ReadFrame(br, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Opcode != opcode || !bytes.Equal(f.Payload, payload) {
+		t.Errorf("got frame %d %q; expected %d %q", f.Opcode, f.Payload, opcode, payload)
+	}
+}
+
+func TestWebSocketMessages(t *testing.T) {
+	target, received := newWebSocketBackend(t)
+	conn, br := dialWebSocket(t, serveWebSocketProxy(t, NewSingleHost(target, &SingleHostConfig{
+		OnWebSocketMessage: func(msg *WebSocketMessage, conn *WebSocketConn) error {
+			if !msg.FromClient {
+				return nil
+			}
+
+			switch string(msg.Data) {
+			case "drop":
+				return ErrDropWebSocketMessage
+			case "inject":
+				conn.SendToClient(WebSocketTextMessage, []byte("injected"))
+				return ErrDropWebSocketMessage
+			}
+
+			msg.Data = bytes.ToUpper(msg.Data)
+			return nil
+		},
+	})))
+
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")})
+	expectFrame(t, br, websocket.OpText, []byte("echo: HELLO"))
+
+	if extensions := received.Get("Sec-WebSocket-Extensions"); extensions != "" {
+		t.Errorf("got extensions %q; expected none to be negotiated", extensions)
+	}
+
+	// dropped, and fragments are reassembled
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("drop")})
+	writeFrame(t, conn, &websocket.Frame{Opcode: websocket.OpText, Payload: []byte("fr")})
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpPing, Payload: []byte("ping")})
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpContinuation, Payload: []byte("ag")})
+	expectFrame(t, br, websocket.OpPong, []byte("ping"))
+	expectFrame(t, br, websocket.OpText, []byte("echo: FRAG"))
+
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("inject")})
+	expectFrame(t, br, websocket.OpText, []byte("injected"))
+
+	// closing handshake
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpClose, Payload: websocket.FormatClose(websocket.CloseNormalClosure, "bye")})
+	expectFrame(t, br, websocket.OpClose, websocket.FormatClose(websocket.CloseNormalClosure, "bye"))
+}
+
+func TestWebSocketErrors(t *testing.T) {
+	target, _ := newWebSocketBackend(t)
+
+	testcases := []struct {
+		name     string
+		cfg      *WebSocketConfig
+		onMsg    func(msg *WebSocketMessage, conn *WebSocketConn) error
+		frame    *websocket.Frame
+		expected int
+	}{
+		{"max message size", &WebSocketConfig{MaxMessageSize: 4}, nil, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")}, websocket.CloseMessageTooBig},
+		{"max fragmented message size", &WebSocketConfig{MaxMessageSize: 4}, nil, &websocket.Frame{Opcode: websocket.OpText, Payload: []byte("hel")}, websocket.CloseMessageTooBig},
+		{"idle timeout", &WebSocketConfig{IdleTimeout: 50 * time.Millisecond}, nil, nil, websocket.CloseGoingAway},
+		{"invalid close code", &WebSocketConfig{}, nil, &websocket.Frame{Fin: true, Opcode: websocket.OpClose, Payload: websocket.FormatClose(1004, "")}, websocket.CloseProtocolError},
+		{"invalid utf-8", &WebSocketConfig{}, nil, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte{0xff}}, websocket.CloseInvalidPayloadData},
+		{"hook error", nil, func(msg *WebSocketMessage, conn *WebSocketConn) error {
+			return fmt.Errorf("denied")
+		}, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")}, websocket.ClosePolicyViolation},
+		{"hook close", nil, func(msg *WebSocketMessage, conn *WebSocketConn) error {
+			return &WebSocketCloseError{Code: 4000, Reason: "custom"}
+		}, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")}, 4000},
+		{"hook close with invalid code", nil, func(msg *WebSocketMessage, conn *WebSocketConn) error {
+			return &WebSocketCloseError{Code: websocket.CloseAbnormalClosure, Reason: "custom"}
+		}, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")}, websocket.ClosePolicyViolation},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, br := dialWebSocket(t, serveWebSocketProxy(t, NewSingleHost(target, &SingleHostConfig{WebSocket: tc.cfg, OnWebSocketMessage: tc.onMsg})))
+			if tc.frame != nil {
+				writeFrame(t, conn, tc.frame)
+			}
+			if tc.frame != nil && !tc.frame.Fin {
+				writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpContinuation, Payload: []byte("lo")})
+			}
+
+			f, err := websocket.ReadFrame(br, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, _, err := websocket.ParseClose(f.Payload)
+			if f.Opcode != websocket.OpClose || err != nil || code != tc.expected {
+				t.Errorf("got frame %d %q; expected close %d", f.Opcode, f.Payload, tc.expected)
+			}
+		})
+	}
+}
+
+func TestWebSocketUnmaskedFrame(t *testing.T) {
+	target, _ := newWebSocketBackend(t)
+	conn, br := dialWebSocket(t, serveWebSocketProxy(t, NewSingleHost(target, &SingleHostConfig{WebSocket: &WebSocketConfig{}})))
+
+	if err := websocket.WriteFrame(conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := websocket.ReadFrame(br, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _, _ := websocket.ParseClose(f.Payload); f.Opcode != websocket.OpClose || code != websocket.CloseProtocolError {
+		t.Errorf("got frame %d %q; expected close 1002", f.Opcode, f.Payload)
+	}
+}
+
+func TestWebSocketPassthrough(t *testing.T) {
+	target, received := newWebSocketBackend(t)
+	conn, br := dialWebSocket(t, serveWebSocketProxy(t, NewSingleHost(target)))
+
+	writeFrame(t, conn, &websocket.Frame{Fin: true, Opcode: websocket.OpText, Payload: []byte("hello")})
+	expectFrame(t, br, websocket.OpText, []byte("echo: hello"))
+
+	if extensions := received.Get("Sec-WebSocket-Extensions"); !strings.Contains(extensions, "permessage-deflate") {
+		t.Errorf("got extensions %q; expected them to be passed as is", extensions)
+	}
+}